@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// The most readings that can be uploaded in one batch.
+const MaxBatchSize = 1000
+
+// BatchResult is what happened to one reading in a batch.
+type BatchResult struct {
+	Index  int    `json:"index"`           // The reading's position in the batch.
+	Key    string `json:"key,omitempty"`   // The key it was logged under.
+	Status string `json:"status"`          // "created", "duplicate", "quarantined", or "error".
+	Error  string `json:"error,omitempty"` // Why it couldn't be logged.
+}
+
+const (
+	BatchCreated     = "created"
+	BatchDuplicate   = "duplicate"
+	BatchQuarantined = "quarantined"
+	BatchError       = "error"
+)
+
+// Returns the log key for a reading with an idempotency key. It's the same
+// every time the reading is uploaded, so a retried upload finds the entry
+// from the first one.
+func idempotentKey(measured time.Time, idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(idempotencyKey))
+	return fmt.Sprintf("%s-i%s", KeyForTime(measured), hex.EncodeToString(sum[:8]))
+}
+
+// Appends readings buffered by a sensor to its running log. Every reading
+// must say when it was measured, as described in ApplyDeviceTime. A reading
+// with an "idempotency_key" is only logged once, however many times it's
+// uploaded. The newest reading replaces the sensor's latest snapshot, unless
+// the snapshot is already newer. Readings that are added to the log are also
+// added to the sensor's rollups and metrics.
+//
+// A reading that can't be logged doesn't stop the others. The returned
+// results say what happened to each reading, in order.
+func LogSensorBatch(ctx context.Context, store Store, id string, readings []map[string]interface{}, threshold time.Duration) ([]*BatchResult, error) {
+	if len(readings) > MaxBatchSize {
+		return nil, common.Errorf(http.StatusRequestEntityTooLarge, "batch has %d readings, more than %d", len(readings), MaxBatchSize)
+	}
+	reg, err := sensorRegistration(ctx, store, id)
+	if err != nil {
+		return nil, err
+	}
+
+	received := time.Now().UTC()
+	results := make([]*BatchResult, len(readings))
+	entries := map[string]map[string]interface{}{}
+	var newest map[string]interface{}
+	var newestTime time.Time
+	for i, data := range readings {
+		result := &BatchResult{Index: i}
+		results[i] = result
+
+		measured, err := ApplyDeviceTime(id, data, received, threshold)
+		if err == nil && measured.IsZero() {
+			err = common.Errorf(http.StatusBadRequest, "reading has no measured_at")
+		}
+		idempotencyKey, ok := data["idempotency_key"].(string)
+		if _, present := data["idempotency_key"]; err == nil && present && (!ok || idempotencyKey == "") {
+			err = common.Errorf(http.StatusBadRequest, "idempotency_key must be a non-empty string")
+		}
+		if err != nil {
+			result.Status = BatchError
+			result.Error = err.Error()
+			continue
+		}
+
+		if idempotencyKey != "" {
+			result.Key = idempotentKey(measured, idempotencyKey)
+		} else {
+			result.Key = KeyAt(measured)
+		}
+		if _, ok := entries[result.Key]; ok {
+			// The same reading twice in one batch.
+			result.Status = BatchDuplicate
+			continue
+		}
+		if quarantined, err := reg.check(ctx, store, id, result.Key, data); err != nil {
+			result.Status = BatchError
+			if quarantined {
+				result.Status = BatchQuarantined
+			}
+			result.Error = err.Error()
+			continue
+		}
+
+		reg.annotate(data)
+		entries[result.Key] = data
+		if newest == nil || measured.After(newestTime) {
+			newest, newestTime = data, measured
+		}
+	}
+	LogClockSkew(id, readings...)
+
+	// Only replace the snapshot with a reading newer than the one in it.
+	var snapshot map[string]interface{}
+	if newest != nil {
+		current, err := store.GetDevice(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || snapshotTime(current).Before(newestTime) {
+			snapshot = copyDoc(newest)
+		}
+	}
+
+	created, err := store.AppendDeviceLog(ctx, id, entries, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	// Only new readings are rolled up, so retries aren't counted twice.
+	logged := []map[string]interface{}{}
+	for _, result := range results {
+		if result.Status != "" {
+			continue
+		}
+		if created[result.Key] {
+			result.Status = BatchCreated
+			logged = append(logged, entries[result.Key])
+		} else {
+			result.Status = BatchDuplicate
+		}
+	}
+	if len(logged) > 0 {
+		deviceLogged(ctx, store, id, logged...)
+	}
+	return results, nil
+}
+
+// Returns when the reading in a snapshot was measured, or else when it was
+// received.
+func snapshotTime(data map[string]interface{}) time.Time {
+	if t, ok := data["measured_at"].(time.Time); ok {
+		return t
+	}
+	t, _ := data["timestamp"].(time.Time)
+	return t
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Returns a reading measured the given number of seconds ago.
+func reading(secondsAgo int, value float64, idempotencyKey string) map[string]interface{} {
+	data := map[string]interface{}{
+		"measured_at": float64(time.Now().Unix() - int64(secondsAgo)),
+		"temperature": value,
+	}
+	if idempotencyKey != "" {
+		data["idempotency_key"] = idempotencyKey
+	}
+	return data
+}
+
+// Returns the status of each result.
+func statuses(results []*BatchResult) []string {
+	s := []string{}
+	for _, result := range results {
+		s = append(s, result.Status)
+	}
+	return s
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLogSensorBatch(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	results, err := LogSensorBatch(ctx, store, LegacyDeviceID, []map[string]interface{}{
+		reading(300, 20, "a"),
+		reading(200, 21, "b"),
+		{"temperature": 22.0}, // No measured_at.
+		reading(100, 23, ""),
+		reading(300, 20, "a"), // The same reading twice in one batch.
+		reading(50, 24, "c"),
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{BatchCreated, BatchCreated, BatchError, BatchCreated, BatchDuplicate, BatchCreated}
+	if got := statuses(results); !sameStrings(got, want) {
+		t.Fatalf("statuses are %v, want %v", got, want)
+	}
+	if results[4].Key != results[0].Key {
+		t.Errorf("duplicate has key %s, want %s", results[4].Key, results[0].Key)
+	}
+	if n := len(store.GetLog("device", LegacyDeviceID)); n != 4 {
+		t.Errorf("logged %d entries, want 4", n)
+	}
+	snapshot, _ := store.GetDevice(ctx, LegacyDeviceID)
+	if snapshot["temperature"] != 24.0 {
+		t.Errorf("snapshot has temperature %v, want the newest reading's 24", snapshot["temperature"])
+	}
+}
+
+func TestLogSensorBatchRetry(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	first := reading(100, 20, "a")
+	measured := first["measured_at"]
+
+	if _, err := LogSensorBatch(ctx, store, LegacyDeviceID, []map[string]interface{}{first}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sensor didn't get the response, so it uploads the reading again,
+	// along with an older reading that was buffered since.
+	retried := map[string]interface{}{"measured_at": measured, "temperature": 20.0, "idempotency_key": "a"}
+	results, err := LogSensorBatch(ctx, store, LegacyDeviceID, []map[string]interface{}{retried, reading(500, 18, "b")}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := statuses(results), []string{BatchDuplicate, BatchCreated}; !sameStrings(got, want) {
+		t.Fatalf("statuses are %v, want %v", got, want)
+	}
+	if n := len(store.GetLog("device", LegacyDeviceID)); n != 2 {
+		t.Errorf("logged %d entries, want 2", n)
+	}
+
+	// The older reading doesn't replace the snapshot.
+	snapshot, _ := store.GetDevice(ctx, LegacyDeviceID)
+	if snapshot["temperature"] != 20.0 {
+		t.Errorf("snapshot has temperature %v, want 20", snapshot["temperature"])
+	}
+
+	// The retry isn't counted in the rollups again.
+	rollups, err := QueryRollups(ctx, store, LegacyDeviceID, time.Time{}, time.Time{}, RollupDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := int64(0)
+	for _, period := range rollups.Periods {
+		if r := period.Fields["temperature"]; r != nil {
+			count += r.Count
+		}
+	}
+	if count != 2 {
+		t.Errorf("rolled up %d temperatures, want 2", count)
+	}
+}
+
+func TestLogSensorBatchRejectsBadIdempotencyKey(t *testing.T) {
+	data := reading(10, 20, "")
+	data["idempotency_key"] = 7.0
+	results, err := LogSensorBatch(context.Background(), NewMemoryStore(), LegacyDeviceID, []map[string]interface{}{data}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != BatchError {
+		t.Errorf("status is %s, want %s", results[0].Status, BatchError)
+	}
+}
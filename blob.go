@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"google.golang.org/api/iterator"
+
+	gcs "cloud.google.com/go/storage"
+)
+
+// BlobStore saves files, such as images uploaded by cameras.
+type BlobStore interface {
+	// Creates or replaces the file at path.
+	WriteBlob(ctx context.Context, path, contentType string, data []byte) error
+	// Calls fn with the path of every file and when it was created, in path
+	// order, until fn returns false.
+	WalkBlobs(ctx context.Context, fn func(path string, created time.Time) bool) error
+	// Deletes the file at path. Deleting a file that doesn't exist is not an
+	// error.
+	DeleteBlob(ctx context.Context, path string) error
+	// Releases the store's connections.
+	Close() error
+}
+
+// FirebaseBlobStore saves files to a Firebase Storage bucket. Firebase's own
+// storage client can't be closed, so it uses a Cloud Storage client directly.
+type FirebaseBlobStore struct {
+	client *gcs.Client
+	bucket *gcs.BucketHandle
+}
+
+// Returns a store for the named bucket. The store owns client, and closes it
+// when the store is closed.
+func NewFirebaseBlobStore(client *gcs.Client, bucket string) *FirebaseBlobStore {
+	return &FirebaseBlobStore{client: client, bucket: client.Bucket(bucket)}
+}
+
+func (s *FirebaseBlobStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *FirebaseBlobStore) WriteBlob(ctx context.Context, path, contentType string, data []byte) error {
+	object := s.bucket.Object(path)
+	writer := object.NewWriter(ctx)
+	writer.ObjectAttrs.ContentType = contentType
+	if _, err := writer.Write(data); err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write file: %s", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to close file: %s", err)
+	}
+
+	return nil
+}
+
+func (s *FirebaseBlobStore) WalkBlobs(ctx context.Context, fn func(path string, created time.Time) bool) error {
+	objects := s.bucket.Objects(ctx, nil)
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return common.Errorf(http.StatusInternalServerError, "unable to list files: %s", err)
+		}
+		if !fn(attrs.Name, attrs.Created) {
+			return nil
+		}
+	}
+}
+
+func (s *FirebaseBlobStore) DeleteBlob(ctx context.Context, path string) error {
+	err := s.bucket.Object(path).Delete(ctx)
+	if err != nil && err != gcs.ErrObjectNotExist {
+		return common.Errorf(http.StatusInternalServerError, "unable to delete file %s: %s", path, err)
+	}
+	return nil
+}
+
+// Blob is a file held by a MemoryBlobStore.
+type Blob struct {
+	ContentType string
+	Data        []byte
+	Created     time.Time
+}
+
+// MemoryBlobStore is a BlobStore that keeps files in memory, for tests.
+type MemoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string]*Blob
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: map[string]*Blob{}}
+}
+
+func (s *MemoryBlobStore) WriteBlob(ctx context.Context, path, contentType string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[path] = &Blob{
+		ContentType: contentType,
+		Data:        append([]byte(nil), data...),
+		Created:     time.Now().UTC(),
+	}
+	return nil
+}
+
+func (s *MemoryBlobStore) WalkBlobs(ctx context.Context, fn func(path string, created time.Time) bool) error {
+	s.mu.Lock()
+	paths := make([]string, 0, len(s.blobs))
+	created := map[string]time.Time{}
+	for path, blob := range s.blobs {
+		paths = append(paths, path)
+		created[path] = blob.Created
+	}
+	s.mu.Unlock()
+
+	// The lock isn't held while calling fn, so it can delete files.
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !fn(path, created[path]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryBlobStore) DeleteBlob(ctx context.Context, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, path)
+	return nil
+}
+
+func (s *MemoryBlobStore) Close() error {
+	return nil
+}
+
+// Returns the file at path, or nil if there isn't one.
+func (s *MemoryBlobStore) Blob(path string) *Blob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[path]
+}
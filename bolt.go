@@ -0,0 +1,603 @@
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/bklimt/relay/common"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a Store backed by a local BoltDB file, for running relay
+// without a cloud account. It mirrors the Firestore layout: top-level
+// collections are buckets of JSON documents, and subcollections are buckets
+// nested under a bucket named "{collection}/{subcollection}", keyed by the
+// parent document's ID.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+const (
+	authBucket             = "auth"
+	userBucket             = "user"
+	userThermostatBucket   = "user/thermostat"
+	userStructureBucket    = "user/structure"
+	registryBucket         = "registry"
+	registryKeyBucket      = "registry/key"
+	deviceBucket           = "device"
+	deviceLogBucket        = "device/log"
+	deviceCommandBucket    = "device/command"
+	deviceQuarantineBucket = "device/quarantine"
+	deviceRollupHourBucket = "device/rollup_hour"
+	deviceRollupDayBucket  = "device/rollup_day"
+	structureBucket        = "structure"
+	structureLogBucket     = "structure/log"
+)
+
+var allBuckets = []string{
+	authBucket,
+	userBucket,
+	userThermostatBucket,
+	userStructureBucket,
+	registryBucket,
+	registryKeyBucket,
+	deviceBucket,
+	deviceLogBucket,
+	deviceCommandBucket,
+	deviceQuarantineBucket,
+	deviceRollupHourBucket,
+	deviceRollupDayBucket,
+	structureBucket,
+	structureLogBucket,
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		// Only one process can have the file open at a time.
+		return nil, common.Errorf(http.StatusServiceUnavailable, "unable to open %s: it's in use by another process, such as a running relay server", path)
+	}
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to open %s: %s", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range allBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to create buckets in %s: %s", path, err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Returns a random document ID, in the same style as Firestore's.
+func newDocID() (string, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	id := make([]byte, 20)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		id[i] = alphabet[n.Int64()]
+	}
+	return string(id), nil
+}
+
+func putJSON(b *bolt.Bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// Returns the bucket for the subcollection of the given parent document.
+func subBucket(tx *bolt.Tx, name, parentID string) (*bolt.Bucket, error) {
+	return tx.Bucket([]byte(name)).CreateBucketIfNotExists([]byte(parentID))
+}
+
+// The fields of device documents that are times.
+var deviceTimeFields = []string{"timestamp", "measured_at"}
+
+// Converts a decoded device document back into the shape Firestore returns,
+// where "timestamp" and "measured_at" are time.Times.
+func decodeDevice(data []byte) (map[string]interface{}, error) {
+	var device map[string]interface{}
+	if err := json.Unmarshal(data, &device); err != nil {
+		return nil, err
+	}
+	for _, field := range deviceTimeFields {
+		if s, ok := device[field].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				device[field] = t
+			}
+		}
+	}
+	return device, nil
+}
+
+func (s *BoltStore) CreateAuthState(ctx context.Context) (string, error) {
+	id, err := newDocID()
+	if err != nil {
+		return "", common.Errorf(http.StatusInternalServerError, "unable to generate state: %s", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket([]byte(authBucket)), id, map[string]interface{}{
+			"used":    false,
+			"created": time.Now().UTC(),
+		})
+	})
+	if err != nil {
+		return "", common.Errorf(http.StatusInternalServerError, "unable to write state to bolt: %s", err)
+	}
+	return id, nil
+}
+
+func (s *BoltStore) UseAuthState(ctx context.Context, state string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(authBucket))
+		data := b.Get([]byte(state))
+		if data == nil {
+			return common.Errorf(http.StatusForbidden, "invalid oauth state")
+		}
+		var stateData map[string]interface{}
+		if err := json.Unmarshal(data, &stateData); err != nil {
+			return common.Errorf(http.StatusInternalServerError, "unable to parse state: %s", err)
+		}
+		if stateData["used"] != false {
+			return common.Errorf(http.StatusForbidden, "invalid oauth state")
+		}
+		stateData["used"] = true
+		stateData["updated"] = time.Now().UTC()
+		if err := putJSON(b, state, stateData); err != nil {
+			return common.Errorf(http.StatusInternalServerError, "unable to write state to bolt: %s", err)
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) SaveUser(ctx context.Context, id string, user *User) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket([]byte(userBucket)), id, user)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write user data to bolt: %s", err)
+	}
+	return nil
+}
+
+func (s *BoltStore) SaveUserThermostat(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, userThermostatBucket, userID)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, id, data)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write thermostat data to bolt: %s", err)
+	}
+	return nil
+}
+
+func (s *BoltStore) SaveUserStructure(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, userStructureBucket, userID)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, id, data)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write structure data to bolt: %s", err)
+	}
+	return nil
+}
+
+func (s *BoltStore) GetUsers(ctx context.Context) (map[string]*User, error) {
+	users := map[string]*User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(userBucket)).ForEach(func(k, v []byte) error {
+			user := &User{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return err
+			}
+			users[string(k)] = user
+			return nil
+		})
+	})
+	if err != nil {
+		return users, common.Errorf(http.StatusInternalServerError, "unable to read users from bolt: %s", err)
+	}
+	return users, nil
+}
+
+func (s *BoltStore) SaveRegistration(ctx context.Context, id string, reg *Registration) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket([]byte(registryBucket)), id, reg)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write registration to bolt: %s", err)
+	}
+	return nil
+}
+
+func (s *BoltStore) GetRegistration(ctx context.Context, id string) (*Registration, error) {
+	var reg *Registration
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(registryBucket)).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		reg = &Registration{}
+		return json.Unmarshal(data, reg)
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read registration %s from bolt: %s", id, err)
+	}
+	return reg, nil
+}
+
+func (s *BoltStore) GetRegistrations(ctx context.Context) (map[string]*Registration, error) {
+	regs := map[string]*Registration{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(registryBucket)).ForEach(func(k, v []byte) error {
+			reg := &Registration{}
+			if err := json.Unmarshal(v, reg); err != nil {
+				return err
+			}
+			regs[string(k)] = reg
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read registry from bolt: %s", err)
+	}
+	return regs, nil
+}
+
+func (s *BoltStore) SaveDeviceKey(ctx context.Context, device, id string, key *DeviceKey) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, registryKeyBucket, device)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, id, key)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write key to bolt: %s", err)
+	}
+	return nil
+}
+
+func (s *BoltStore) GetDeviceKeys(ctx context.Context, device string) (map[string]*DeviceKey, error) {
+	keys := map[string]*DeviceKey{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(registryKeyBucket)).Bucket([]byte(device))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			key := &DeviceKey{}
+			if err := json.Unmarshal(v, key); err != nil {
+				return err
+			}
+			keys[string(k)] = key
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read keys for %s from bolt: %s", device, err)
+	}
+	return keys, nil
+}
+
+func (s *BoltStore) LogDevice(ctx context.Context, name, key string, data map[string]interface{}) error {
+	return s.logDoc(deviceBucket, deviceLogBucket, name, key, data)
+}
+
+func (s *BoltStore) LogStructure(ctx context.Context, name, key string, data map[string]interface{}) error {
+	return s.logDoc(structureBucket, structureLogBucket, name, key, data)
+}
+
+func (s *BoltStore) LogCommand(ctx context.Context, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = time.Now().UTC()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, deviceCommandBucket, name)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, key, data)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s command to bolt: %s", name, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) QuarantineReading(ctx context.Context, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = time.Now().UTC()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, deviceQuarantineBucket, name)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, key, data)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s quarantine to bolt: %s", name, err)
+	}
+	return nil
+}
+
+// Saves data as name in the bucket and appends it to the document's
+// running log in logBucket.
+func (s *BoltStore) logDoc(bucket, logBucket, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = time.Now().UTC()
+
+	// The snapshot and the log entry are written in the same transaction.
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket([]byte(bucket)), name, data); err != nil {
+			return err
+		}
+		b, err := subBucket(tx, logBucket, name)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, key, data)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s data to bolt: %s", name, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) AppendDeviceLog(ctx context.Context, name string, entries map[string]map[string]interface{}, snapshot map[string]interface{}) (map[string]bool, error) {
+	now := time.Now().UTC()
+	created := map[string]bool{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, deviceLogBucket, name)
+		if err != nil {
+			return err
+		}
+		for key, data := range entries {
+			if b.Get([]byte(key)) != nil {
+				continue
+			}
+			data["timestamp"] = now
+			if err := putJSON(b, key, data); err != nil {
+				return err
+			}
+			created[key] = true
+		}
+		if snapshot != nil {
+			snapshot["timestamp"] = now
+			return putJSON(tx.Bucket([]byte(deviceBucket)), name, snapshot)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to write %s log to bolt: %s", name, err)
+	}
+	return created, nil
+}
+
+func (s *BoltStore) QueryDeviceLog(ctx context.Context, name string, q *LogQuery) ([]*LogEntry, error) {
+	entries := []*LogEntry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(deviceLogBucket)).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(q.start())); k != nil && len(entries) < q.Limit; k, v = c.Next() {
+			key := string(k)
+			if q.To != "" && key >= q.To {
+				break
+			}
+			if !q.contains(key) {
+				continue
+			}
+			data, err := decodeDevice(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &LogEntry{Key: key, Data: data})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to query %s log from bolt: %s", name, err)
+	}
+	return entries, nil
+}
+
+// Returns the bucket holding rollups at the given resolution.
+func rollupBucket(resolution string) string {
+	if resolution == RollupDay {
+		return deviceRollupDayBucket
+	}
+	return deviceRollupHourBucket
+}
+
+func (s *BoltStore) UpdateRollup(ctx context.Context, name, resolution string, start time.Time, update func(*RollupPeriod)) error {
+	key := []byte(KeyForTime(start))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, rollupBucket(resolution), name)
+		if err != nil {
+			return err
+		}
+		period := &RollupPeriod{Start: start, Fields: map[string]*Rollup{}}
+		if data := b.Get(key); data != nil {
+			if err := json.Unmarshal(data, period); err != nil {
+				return err
+			}
+		}
+		update(period)
+		return putJSON(b, string(key), period)
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s rollup to bolt: %s", name, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) QueryRollups(ctx context.Context, name, resolution string, from, to time.Time) ([]*RollupPeriod, error) {
+	end := KeyForTime(to)
+	periods := []*RollupPeriod{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(rollupBucket(resolution))).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(KeyForTime(from))); k != nil && string(k) < end; k, v = c.Next() {
+			period := &RollupPeriod{}
+			if err := json.Unmarshal(v, period); err != nil {
+				return err
+			}
+			periods = append(periods, period)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to query %s rollups from bolt: %s", name, err)
+	}
+	return periods, nil
+}
+
+// Returns the bucket holding the named device's entries of the given kind,
+// or nil if it has none.
+func deviceEntryBucket(tx *bolt.Tx, name, kind string) (*bolt.Bucket, error) {
+	bucket := deviceBucket + "/" + kind
+	if kind == StructureLog {
+		bucket = structureLogBucket
+	}
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, common.Errorf(http.StatusBadRequest, "unknown kind of device entry %q", kind)
+	}
+	return b.Bucket([]byte(name)), nil
+}
+
+func (s *BoltStore) ListDeviceEntries(ctx context.Context, name, kind, after, before string, limit int) ([]string, error) {
+	keys := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := deviceEntryBucket(tx, name, kind)
+		if b == nil {
+			return err
+		}
+		c := b.Cursor()
+		k, _ := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, _ = c.Next()
+		}
+		for ; k != nil && string(k) < before && len(keys) < limit; k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	if _, ok := err.(*common.Error); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to list %s %s entries from bolt: %s", name, kind, err)
+	}
+	return keys, nil
+}
+
+func (s *BoltStore) DeleteDeviceEntries(ctx context.Context, name, kind string, keys []string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := deviceEntryBucket(tx, name, kind)
+		if b == nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(*common.Error); ok {
+		return err
+	}
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to delete %s %s entries from bolt: %s", name, kind, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) GetDevices(ctx context.Context) (map[string]map[string]interface{}, error) {
+	devices := map[string]map[string]interface{}{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(deviceBucket)).ForEach(func(k, v []byte) error {
+			device, err := decodeDevice(v)
+			if err != nil {
+				return err
+			}
+			devices[string(k)] = device
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read devices from bolt: %s", err)
+	}
+	return devices, nil
+}
+
+func (s *BoltStore) GetDevice(ctx context.Context, name string) (map[string]interface{}, error) {
+	var device map[string]interface{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(deviceBucket)).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		var err error
+		device, err = decodeDevice(data)
+		return err
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read device %s from bolt: %s", name, err)
+	}
+	return device, nil
+}
+
+func (s *BoltStore) GetStructures(ctx context.Context) (map[string]map[string]interface{}, error) {
+	structures := map[string]map[string]interface{}{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(structureBucket)).ForEach(func(k, v []byte) error {
+			structure, err := decodeDevice(v)
+			if err != nil {
+				return err
+			}
+			structures[string(k)] = structure
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read structures from bolt: %s", err)
+	}
+	return structures, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -2,50 +2,239 @@ package relay
 
 import (
 	"context"
-	"expvar"
+	"fmt"
 	"log"
 	"time"
 
-	firebase "firebase.google.com/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
-	checkupIntervalSeconds *expvar.Int    = expvar.NewInt("checkupIntervalSeconds")
-	lastCheckupTime        *expvar.String = expvar.NewString("lastCheckupTime")
-	mostRecentDeviceTime   *expvar.Map    = expvar.NewMap("mostRecentDeviceTime")
+	checkupIntervalSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "relay_checkup_interval_seconds",
+		Help: "How long relay waits between checkups.",
+	})
+	lastCheckupTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "relay_last_checkup_timestamp_seconds",
+		Help: "When the last checkup ran, in Unix seconds.",
+	})
+	usersNeedingReauth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_user_needs_reauth",
+		Help: "1 for each user who has to log in again.",
+	}, []string{"user"})
+	urgentEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_urgent_events_total",
+		Help: "Events that need attention right away, such as alarms.",
+	})
+	staleDevices = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_device_stale",
+		Help: "1 for each device that has gone longer than its threshold without logging.",
+	}, []string{"device"})
+	notificationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_notification_failures_total",
+		Help: "Notifications that couldn't be sent.",
+	})
 )
 
-func Checkup(ctx context.Context, app *firebase.App) {
-	timestamp := KeyForNow()
+// Reports something that needs attention right away.
+func urgent(format string, params ...interface{}) {
+	message := fmt.Sprintf(format, params...)
+	log.Printf("URGENT: %s", message)
+	urgentEvents.Inc()
+}
+
+// The smoke and CO alarm fields of a Nest Protect.
+var alarmStateFields = []string{"smoke_alarm_state", "co_alarm_state"}
+
+// Compares a new snapshot of a Nest Protect to the previous one, which may
+// be nil, and reports any change in alarm state as urgent.
+func CheckAlarm(name string, previous, current map[string]interface{}) {
+	for _, field := range alarmStateFields {
+		state, _ := current[field].(string)
+		if previous == nil {
+			if state != "" && state != "ok" {
+				urgent("Device %s has %s %q.", name, field, state)
+			}
+			continue
+		}
+		old, _ := previous[field].(string)
+		if old != state {
+			urgent("Device %s %s changed from %q to %q.", name, field, old, state)
+		}
+	}
+}
+
+// Watchdog notices when devices stop logging, and when they start again,
+// and when Nest Protect alarms go off and clear, and notifies people of each
+// change. What was last reported is only kept in memory, so a new Watchdog,
+// e.g. after relay restarts, notifies again about every device that is still
+// stale or alarming.
+type Watchdog struct {
+	Alerts    *Alerts
+	Notifiers []Notifier
+
+	stale  map[string]bool     // The devices that were stale at the last check.
+	alarms map[alarmKey]string // The alarms that weren't ok at the last check.
+}
+
+// An alarm of a device.
+type alarmKey struct {
+	device, field string
+}
+
+func NewWatchdog(alerts *Alerts) *Watchdog {
+	return &Watchdog{
+		Alerts:    alerts,
+		Notifiers: alerts.Notifiers(),
+		stale:     map[string]bool{},
+		alarms:    map[alarmKey]string{},
+	}
+}
+
+// Compares when each device last logged to its threshold, and sends a
+// notification for each device that has gone stale or recovered since the
+// last check. If a notification can't be sent, it's tried again at the next
+// check.
+func (w *Watchdog) Check(ctx context.Context, timestamps map[string]time.Time, now time.Time) {
+	for device, lastSeen := range timestamps {
+		threshold := w.Alerts.threshold(device)
+		stale := threshold > 0 && now.Sub(lastSeen) > threshold
+		if stale {
+			log.Printf("Device %s has not responded for >%s.", device, threshold)
+			staleDevices.WithLabelValues(device).Set(1)
+		} else {
+			staleDevices.WithLabelValues(device).Set(0)
+		}
+		if stale == w.stale[device] {
+			continue
+		}
+
+		event := EventRecovered
+		if stale {
+			event = EventStale
+		}
+		if w.notify(ctx, newNotification(device, event, lastSeen, threshold, now)) {
+			w.stale[device] = stale
+		}
+	}
+}
+
+// Compares the alarm states in the latest snapshot of each device to the
+// ones last reported, and sends a notification for each Nest Protect alarm
+// that has gone off, changed, or cleared. Like stale devices, an alarm whose
+// notification can't be sent is tried again at the next check.
+func (w *Watchdog) CheckAlarms(ctx context.Context, devices map[string]map[string]interface{}, now time.Time) {
+	for name, data := range devices {
+		if data["device_type"] != "smoke_co_alarm" {
+			continue
+		}
+		for _, field := range alarmStateFields {
+			state, _ := data[field].(string)
+			if state == "" {
+				state = "ok"
+			}
+			key := alarmKey{name, field}
+			previous, ok := w.alarms[key]
+			if !ok {
+				previous = "ok"
+			}
+			if state == previous {
+				continue
+			}
+
+			n := newAlarmNotification(name, field, state, snapshotTime(data), now)
+			if state != "ok" {
+				urgent("%s", n.Text)
+			}
+			if !w.notify(ctx, n) {
+				continue
+			}
+			if state == "ok" {
+				delete(w.alarms, key)
+			} else {
+				w.alarms[key] = state
+			}
+		}
+	}
+}
+
+// Sends n with every notifier, and returns whether they all succeeded.
+func (w *Watchdog) notify(ctx context.Context, n *Notification) bool {
+	log.Printf("Notifying: %s", n.Text)
+	ok := true
+	for _, notifier := range w.Notifiers {
+		if err := notifier.Notify(ctx, n); err != nil {
+			log.Printf("Unable to send notification for %s: %s", n.Device, err)
+			notificationFailures.Inc()
+			ok = false
+		}
+	}
+	return ok
+}
+
+func Checkup(ctx context.Context, store Store, watchdog *Watchdog) {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
 	log.Printf("%s: Checkup.", timestamp)
-	lastCheckupTime.Set(timestamp)
+	lastCheckupTime.SetToCurrentTime()
 
 	// Grab the most recent logs.
-	timestamps, err := GetMostRecentDeviceTimestamps(ctx, app)
+	timestamps, err := GetMostRecentDeviceTimestamps(ctx, store)
 	if err != nil {
 		log.Printf("Unable to get most recent log data: %s\n", err)
 	}
 	log.Printf("Device Timestamps: %v", timestamps)
 
 	now := time.Now().UTC()
-	mostRecentDeviceTime.Init()
 	for device, timestamp := range timestamps {
-		s := new(expvar.String)
-		s.Set(timestamp.Format(time.RFC3339))
-		mostRecentDeviceTime.Set(device, s)
-		timeSince := now.Sub(timestamp)
-		if timeSince.Hours() > 1 {
-			log.Printf("Device %s has not responded for >1 hour.", device)
+		// Devices may have been logged by another instance of relay.
+		devices.seen(device, timestamp)
+	}
+	watchdog.Check(ctx, timestamps, now)
+
+	checkAlarms(ctx, store, watchdog, now)
+	checkUsers(ctx, store, now)
+}
+
+// Notifies people of any Nest Protect alarm that has changed since the last
+// checkup.
+func checkAlarms(ctx context.Context, store Store, watchdog *Watchdog, now time.Time) {
+	devices, err := store.GetDevices(ctx)
+	if err != nil {
+		log.Printf("Unable to get devices: %s\n", err)
+		return
+	}
+	watchdog.CheckAlarms(ctx, devices, now)
+}
+
+// Reports users whose credentials have stopped working, or will soon.
+func checkUsers(ctx context.Context, store Store, now time.Time) {
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		log.Printf("Unable to get users: %s\n", err)
+		return
+	}
+
+	usersNeedingReauth.Reset()
+	for id, user := range users {
+		if user.NeedsReauth {
+			usersNeedingReauth.WithLabelValues(id).Set(1)
+			log.Printf("User %s needs to log in again: %s", id, user.ReauthReason)
+			continue
+		}
+		// Tokens with a refresh token are renewed automatically.
+		if user.RefreshToken == "" && !user.Expiry.IsZero() && user.Expiry.Sub(now).Hours() < 24*7 {
+			log.Printf("Access token for user %s expires at %s.", id, user.Expiry.Format(time.RFC3339))
 		}
 	}
 }
 
-func CheckupForever(app *firebase.App, cfg *Config) {
+func CheckupForever(store Store, cfg *Config) {
 	ctx := context.Background()
-	checkupIntervalSeconds.Set(int64(cfg.CheckupIntervalSeconds))
+	checkupIntervalSeconds.Set(float64(cfg.CheckupIntervalSeconds))
+	watchdog := NewWatchdog(cfg.Alerts)
 	for {
-		Checkup(ctx, app)
-		interval := time.Duration(checkupIntervalSeconds.Value()) * time.Second
-		time.Sleep(interval)
+		Checkup(ctx, store, watchdog)
+		time.Sleep(time.Duration(cfg.CheckupIntervalSeconds) * time.Second)
 	}
 }
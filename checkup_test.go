@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	sent []*Notification
+	err  error // Returned by Notify, if set.
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification *Notification) error {
+	n.sent = append(n.sent, notification)
+	return n.err
+}
+
+// Returns the events in sent, as "device:event".
+func events(sent []*Notification) []string {
+	names := []string{}
+	for _, n := range sent {
+		names = append(names, n.Device+":"+n.Event)
+	}
+	return names
+}
+
+func TestWatchdog(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	notifier := &recordingNotifier{}
+	watchdog := NewWatchdog(&Alerts{StaleAfterSeconds: 3600})
+	watchdog.Notifiers = []Notifier{notifier}
+
+	watchdog.Check(ctx, map[string]time.Time{"garage": now.Add(-2 * time.Hour), "hall": now}, now)
+	if got := events(notifier.sent); !sameStrings(got, []string{"garage:stale"}) {
+		t.Fatalf("sent %v, want garage:stale", got)
+	}
+	if n := notifier.sent[0]; n.Threshold != 3600 || !n.LastSeen.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("unexpected notification %+v", n)
+	}
+
+	// Nothing changed, so nothing is sent.
+	watchdog.Check(ctx, map[string]time.Time{"garage": now.Add(-2 * time.Hour), "hall": now}, now.Add(time.Minute))
+	if len(notifier.sent) != 1 {
+		t.Fatalf("sent %v, want no more", events(notifier.sent))
+	}
+
+	watchdog.Check(ctx, map[string]time.Time{"garage": now, "hall": now}, now.Add(2*time.Minute))
+	if got := events(notifier.sent); !sameStrings(got, []string{"garage:stale", "garage:recovered"}) {
+		t.Errorf("sent %v, want garage to recover", got)
+	}
+}
+
+func TestWatchdogThresholds(t *testing.T) {
+	now := time.Now().UTC()
+	notifier := &recordingNotifier{}
+	watchdog := NewWatchdog(&Alerts{
+		StaleAfterSeconds: 3600,
+		Devices:           map[string]int{"garage": 6 * 3600, "camera": -1},
+	})
+	watchdog.Notifiers = []Notifier{notifier}
+
+	watchdog.Check(context.Background(), map[string]time.Time{
+		"garage": now.Add(-2 * time.Hour),
+		"camera": now.Add(-1000 * time.Hour),
+		"hall":   now.Add(-2 * time.Hour),
+	}, now)
+	if got := events(notifier.sent); !sameStrings(got, []string{"hall:stale"}) {
+		t.Errorf("sent %v, want only hall:stale", got)
+	}
+}
+
+func TestWatchdogRetriesFailedNotifications(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	working, failing := &recordingNotifier{}, &recordingNotifier{err: errors.New("unreachable")}
+	watchdog := NewWatchdog(&Alerts{StaleAfterSeconds: 3600})
+	watchdog.Notifiers = []Notifier{working, failing}
+
+	timestamps := map[string]time.Time{"garage": now.Add(-2 * time.Hour)}
+	watchdog.Check(ctx, timestamps, now)
+	watchdog.Check(ctx, timestamps, now.Add(time.Minute))
+	if len(failing.sent) != 2 {
+		t.Fatalf("tried the failing notifier %d times, want 2", len(failing.sent))
+	}
+
+	failing.err = nil
+	watchdog.Check(ctx, timestamps, now.Add(2*time.Minute))
+	watchdog.Check(ctx, timestamps, now.Add(3*time.Minute))
+	if len(failing.sent) != 3 {
+		t.Errorf("tried the notifier %d times, want it to stop once it worked", len(failing.sent))
+	}
+
+	// A new watchdog, as after a restart, doesn't know garage was reported.
+	restarted := NewWatchdog(&Alerts{StaleAfterSeconds: 3600})
+	restarted.Notifiers = []Notifier{working}
+	sent := len(working.sent)
+	restarted.Check(ctx, timestamps, now.Add(4*time.Minute))
+	if len(working.sent) != sent+1 {
+		t.Errorf("a new watchdog didn't report garage again")
+	}
+}
+
+func TestWatchdogAlarms(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	notifier := &recordingNotifier{}
+	watchdog := NewWatchdog(&Alerts{StaleAfterSeconds: 3600})
+	watchdog.Notifiers = []Notifier{notifier}
+
+	protect := func(smoke, co string) map[string]interface{} {
+		return map[string]interface{}{"device_type": "smoke_co_alarm", "smoke_alarm_state": smoke, "co_alarm_state": co}
+	}
+	check := func(hallway map[string]interface{}) []string {
+		notifier.sent = nil
+		watchdog.CheckAlarms(ctx, map[string]map[string]interface{}{
+			"Hallway": hallway,
+			"hall":    {"device_type": "thermostat", "smoke_alarm_state": "emergency"},
+		}, now)
+		states := []string{}
+		for _, n := range notifier.sent {
+			states = append(states, n.Event+":"+n.Field+"="+n.State)
+		}
+		return states
+	}
+
+	for _, c := range []struct {
+		name    string
+		hallway map[string]interface{}
+		fail    bool // Whether notifications fail to send.
+		want    []string
+	}{
+		{"all ok", protect("ok", "ok"), false, []string{}},
+		{"no states", map[string]interface{}{"device_type": "smoke_co_alarm"}, false, []string{}},
+		{"smoke", protect("warning", "ok"), true, []string{"alarming:smoke_alarm_state=warning"}},
+		{"retried", protect("warning", "ok"), false, []string{"alarming:smoke_alarm_state=warning"}},
+		{"unchanged", protect("warning", "ok"), false, []string{}},
+		{"worse", protect("emergency", "ok"), false, []string{"alarming:smoke_alarm_state=emergency"}},
+		{"cleared", protect("ok", ""), false, []string{"clear:smoke_alarm_state=ok"}},
+		{"still ok", protect("ok", "ok"), false, []string{}},
+	} {
+		notifier.err = nil
+		if c.fail {
+			notifier.err = errors.New("unreachable")
+		}
+		if got := check(c.hallway); !sameStrings(got, c.want) {
+			t.Errorf("%s: sent %v, want %v", c.name, got, c.want)
+		}
+	}
+}
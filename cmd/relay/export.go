@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bklimt/relay"
+)
+
+// Runs "relay export", which writes a device's log to a file or stdout. It
+// reads the store directly, unless -server is given, in which case it
+// exports through that server instead. A bolt store can only be opened by
+// one process, so while the server is running, it has to be exported
+// through the server.
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	device := flags.String("device", "", "The device to export. Required.")
+	fromFlag := flags.String("from", "", "The earliest time to export, as RFC 3339 or Unix seconds.")
+	toFlag := flags.String("to", "", "The time to export up to, as RFC 3339 or Unix seconds.")
+	format := flags.String("format", relay.ExportCSV, "The format to export: csv or ndjson.")
+	output := flags.String("o", "", "The file to write to. Defaults to stdout.")
+	serverURL := flags.String("server", "", "The URL of a running relay server to export through, using the config's readToken.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: relay export -device NAME [-from TIME] [-to TIME] [-format csv|ndjson] [-o FILE] [-server URL]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *device == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var from, to time.Time
+	var err error
+	if *fromFlag != "" {
+		if from, err = relay.ParseQueryTime("from", *fromFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *toFlag != "" {
+		if to, err = relay.ParseQueryTime("to", *toFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cfg := relay.LoadConfig()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatalf("error creating %s: %s", *output, err)
+		}
+		defer out.Close()
+	}
+	writer := bufio.NewWriter(out)
+
+	if *serverURL != "" {
+		err = exportFromServer(context.Background(), *serverURL, cfg.ReadToken, *device, *fromFlag, *toFlag, *format, writer)
+	} else {
+		store := openStore(cfg)
+		defer store.Close()
+		err = relay.ExportDeviceLog(context.Background(), store, *device, from, to, *format, writer)
+	}
+	if err != nil {
+		log.Fatalf("error exporting %s: %s", *device, err)
+	}
+	if err := writer.Flush(); err != nil {
+		log.Fatalf("error writing export: %s", err)
+	}
+}
+
+// Streams a device's log from the export endpoint of the relay server at
+// serverURL to out. from and to are passed along as given.
+func exportFromServer(ctx context.Context, serverURL, token, device, from, to, format string, out io.Writer) error {
+	params := url.Values{"format": {format}}
+	if from != "" {
+		params.Set("from", from)
+	}
+	if to != "" {
+		params.Set("to", to)
+	}
+	target := fmt.Sprintf("%s/devices/%s/export?%s", strings.TrimSuffix(serverURL, "/"), url.PathEscape(device), params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return fmt.Errorf("invalid server URL %q: %s", serverURL, err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach %s: %s", serverURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", serverURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("unable to read export: %s", err)
+	}
+	return nil
+}
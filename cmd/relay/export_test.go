@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay"
+	"github.com/bklimt/relay/common"
+)
+
+// slowStore is a MemoryStore whose log queries take a while, or fail.
+type slowStore struct {
+	*relay.MemoryStore
+	delay time.Duration
+	err   error
+}
+
+func (s *slowStore) QueryDeviceLog(ctx context.Context, name string, q *relay.LogQuery) ([]*relay.LogEntry, error) {
+	time.Sleep(s.delay)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.MemoryStore.QueryDeviceLog(ctx, name, q)
+}
+
+// Logs a couple of readings from the Feather, an hour ago.
+func logForExport(t *testing.T, srv *server) {
+	base := time.Now().Add(-time.Hour).Unix()
+	batch := fmt.Sprintf(`[{"a": 1, "measured_at": %d, "n": {"x": 1, "y": "q"}}, {"b": [1, 2], "measured_at": %d}]`, base, base+5)
+	if w := do(srv, "POST", "/log/batch", batch); w.Code != http.StatusOK {
+		t.Fatalf("/log/batch returned %d: %s", w.Code, w.Body)
+	}
+}
+
+func getExport(srv *server, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/devices/feather/export"+query, nil)
+	req.Header.Set("Authorization", "Bearer read-token")
+	w := httptest.NewRecorder()
+	newRouter(srv).ServeHTTP(w, req)
+	return w
+}
+
+func TestExport(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+	logForExport(t, srv)
+
+	w := getExport(srv, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("CSV export returned %d: %s", w.Code, w.Body)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("CSV export has %d lines, want a header and 2 rows:\n%s", len(lines), w.Body)
+	}
+	if !strings.HasPrefix(lines[0], "key,a,b,") || !strings.Contains(lines[0], ",n.x,n.y,") {
+		t.Errorf("unexpected CSV header %s", lines[0])
+	}
+
+	w = getExport(srv, "?format=ndjson")
+	if w.Code != http.StatusOK {
+		t.Fatalf("NDJSON export returned %d: %s", w.Code, w.Body)
+	}
+	if n := strings.Count(w.Body.String(), "\n"); n != 2 {
+		t.Errorf("NDJSON export has %d lines, want 2", n)
+	}
+
+	if w := getExport(srv, "?format=xml"); w.Code != http.StatusBadRequest {
+		t.Errorf("XML export returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExportReportsEarlyErrors(t *testing.T) {
+	srv, store, _ := newTestServer(t)
+	srv.Store = &slowStore{MemoryStore: store, err: common.Errorf(http.StatusServiceUnavailable, "store is down")}
+
+	w := getExport(srv, "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("export from a failing store returned %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("error was sent as an attachment")
+	}
+}
+
+func TestExportOutlastsWriteTimeout(t *testing.T) {
+	srv, store, _ := newTestServer(t)
+	logForExport(t, srv)
+	srv.Store = &slowStore{MemoryStore: store, delay: 150 * time.Millisecond}
+
+	// The CSV export makes two queries, so it runs for longer than the
+	// server's write timeout.
+	ts := httptest.NewUnstartedServer(newRouter(srv))
+	ts.Config.WriteTimeout = 200 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/devices/feather/export", nil)
+	req.Header.Set("Authorization", "Bearer read-token")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("export was cut off: %s", err)
+	}
+	if n := strings.Count(string(body), "\n"); n != 3 {
+		t.Errorf("export has %d lines, want 3:\n%s", n, body)
+	}
+}
+
+func TestExportFromServer(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+	logForExport(t, srv)
+	ts := httptest.NewServer(newRouter(srv))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	if err := exportFromServer(context.Background(), ts.URL+"/", "read-token", "feather", "", "", relay.ExportNDJSON, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := getExport(srv, "?format=ndjson").Body.String(); out.String() != want {
+		t.Errorf("exported %q through the server, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	err := exportFromServer(context.Background(), ts.URL, "wrong-token", "feather", "", "", relay.ExportCSV, &out)
+	if err == nil || !strings.Contains(err.Error(), "403") || out.Len() != 0 {
+		t.Errorf("export with the wrong token returned %v and wrote %q", err, out.String())
+	}
+	err = exportFromServer(context.Background(), ts.URL, "read-token", "feather", "yesterday", "", relay.ExportCSV, &out)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("export with a bad from returned %v, want a bad request", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bklimt/relay"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_http_requests_total",
+		Help: "Requests handled, by route and status code.",
+	}, []string{"handler", "code"})
+	httpRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "relay_http_request_duration_seconds",
+		Help: "How long requests take to handle, by route and status code.",
+	}, []string{"handler", "code"})
+	configInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_info",
+		Help: "Always 1, labeled with how relay is configured.",
+	}, []string{"project_id", "store"})
+)
+
+// Records the config in relay_info.
+func recordConfig(cfg *relay.Config) {
+	configInfo.WithLabelValues(cfg.ProjectID, cfg.Store).Set(1)
+}
+
+// statusRecorder is a ResponseWriter that remembers the status code written
+// to it. It passes flushes through, and unwraps for http.ResponseController,
+// so that streaming responses still work behind it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Returns the wrapped ResponseWriter, for http.ResponseController.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Wraps every route so that its requests are counted and timed, labeled with
+// the route's path template, like "/devices/{name}", so that the number of
+// labels stays small.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		handler := "unknown"
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				handler = template
+			}
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := strconv.Itoa(status)
+		httpRequests.WithLabelValues(handler, code).Inc()
+		httpRequestSeconds.WithLabelValues(handler, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+var metricsHandler = promhttp.Handler()
+
+func handleMetrics(w http.ResponseWriter, r *http.Request, srv *server) error {
+	// Metrics are open to any scraper unless a token is configured.
+	if srv.Cfg.MetricsToken != "" {
+		if err := checkBearerToken(r, srv.Cfg.MetricsToken, "metrics"); err != nil {
+			return err
+		}
+	}
+	metricsHandler.ServeHTTP(w, r)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bklimt/relay"
+)
+
+func TestMetrics(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+	srv.Store = relay.InstrumentStore("metrics-test", relay.NewMemoryStore())
+	srv.Cfg.MetricsToken = "metrics-token"
+
+	do(srv, "POST", "/log", `{"temperature": 21.5, "label": "x"}`)
+	req := httptest.NewRequest("GET", "/devices/nope", nil)
+	req.Header.Set("Authorization", "Bearer read-token")
+	newRouter(srv).ServeHTTP(httptest.NewRecorder(), req)
+
+	if w := do(srv, "GET", "/metrics", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("/metrics without a token returned %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer metrics-token")
+	w := httptest.NewRecorder()
+	newRouter(srv).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d: %s", w.Code, w.Body)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`relay_http_requests_total{code="200",handler="/log"}`,
+		`relay_http_requests_total{code="404",handler="/devices/{name}"}`,
+		`relay_device_value{device="feather",field="temperature"}`,
+		`relay_device_last_seen_age_seconds{device="feather"}`,
+		`relay_store_call_duration_seconds_count{call="LogDevice",store="metrics-test"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+	if strings.Contains(body, `field="label"`) {
+		t.Errorf("string field label was reported as a value")
+	}
+}
+
+func TestStatusRecorderStreams(t *testing.T) {
+	underlying := httptest.NewRecorder()
+	recorder := &statusRecorder{ResponseWriter: underlying}
+
+	flusher, ok := http.ResponseWriter(recorder).(http.Flusher)
+	if !ok {
+		t.Fatal("statusRecorder isn't an http.Flusher")
+	}
+	recorder.Write([]byte("row\n"))
+	flusher.Flush()
+	if !underlying.Flushed {
+		t.Errorf("flush wasn't passed through")
+	}
+	if recorder.status != http.StatusOK {
+		t.Errorf("status is %d, want %d", recorder.status, http.StatusOK)
+	}
+
+	// ResponseController finds the underlying writer's Flush through Unwrap.
+	if recorder.Unwrap() != underlying {
+		t.Errorf("Unwrap didn't return the wrapped writer")
+	}
+	if err := http.NewResponseController(recorder).Flush(); err != nil {
+		t.Errorf("ResponseController couldn't flush: %s", err)
+	}
+}
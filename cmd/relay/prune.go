@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bklimt/relay"
+)
+
+// Runs "relay prune", which deletes everything older than the config's
+// retention policy once, or with -dry-run, reports what would be deleted. It
+// opens the store itself, so with a bolt store, the server has to be stopped
+// first.
+func runPrune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only report what would be deleted.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: relay prune [-dry-run]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg := relay.LoadConfig()
+	if cfg.Retention == nil {
+		log.Fatal("the config has no retention policy")
+	}
+	store := openStore(cfg)
+	defer store.Close()
+	blobs := openBlobs(cfg)
+	if blobs != nil {
+		defer blobs.Close()
+	}
+
+	janitor := relay.NewJanitor(store, blobs, cfg)
+	janitor.DryRun = janitor.DryRun || *dryRun
+	report, err := janitor.PruneOnce(context.Background(), time.Now().UTC())
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if err != nil {
+		log.Fatalf("error pruning: %s", err)
+	}
+}
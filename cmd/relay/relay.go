@@ -1,26 +1,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"expvar"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bklimt/relay"
 	"github.com/bklimt/relay/common"
-	"github.com/bklimt/relay/nest"
 	"github.com/gorilla/mux"
 
+	gcs "cloud.google.com/go/storage"
 	firebase "firebase.google.com/go"
 )
 
 type server struct {
-	App *firebase.App
-	Cfg *relay.Config
+	Store relay.Store     // Where device data, users, and oauth state go.
+	Blobs relay.BlobStore // Where images go. May be nil.
+	Cfg   *relay.Config
+
+	// The thermostat APIs users can log in with, keyed by provider name.
+	Providers map[string]relay.Provider
+
+	// Checks signatures on requests from sensors. If nil, they aren't
+	// checked.
+	Verifier *relay.Verifier
 }
 
 type HandlerFunc func(http.ResponseWriter, *http.Request, *server) error
@@ -34,17 +48,87 @@ func wrapHandler(f HandlerFunc, s *server) http.HandlerFunc {
 	}
 }
 
+// Returns the ID of the sensor a request is from: the device in the URL,
+// or else the one in the X-Relay-Device header, or else the original Feather.
+func requestDevice(r *http.Request) string {
+	if device, ok := mux.Vars(r)["device"]; ok {
+		return device
+	}
+	if device := r.Header.Get("X-Relay-Device"); device != "" {
+		return device
+	}
+	return relay.LegacyDeviceID
+}
+
+// Wraps a handler for requests from sensors so that it only runs if the
+// request is properly signed. Unsigned requests are allowed from sensors
+// without keys, unless the config requires signatures.
+func signedHandler(f HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, srv *server) error {
+		if srv.Verifier == nil {
+			return f(w, r, srv)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return common.Errorf(http.StatusBadRequest, "unable to read body: %s", err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		req := &relay.SignedRequest{
+			Device:    requestDevice(r),
+			KeyID:     r.Header.Get("X-Relay-Key"),
+			Timestamp: r.Header.Get("X-Relay-Timestamp"),
+			Signature: r.Header.Get("X-Relay-Signature"),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Body:      body,
+		}
+		if req.Signature == "" && !srv.Cfg.RequireSignatures {
+			hasKeys, err := relay.HasDeviceKeys(r.Context(), srv.Store, req.Device)
+			if err != nil {
+				return err
+			}
+			if !hasKeys {
+				return f(w, r, srv)
+			}
+		}
+		if err := srv.Verifier.Verify(r.Context(), req); err != nil {
+			return err
+		}
+		return f(w, r, srv)
+	}
+}
+
+// Returns the provider named in the URL, defaulting to the legacy Nest API.
+func getProvider(r *http.Request, srv *server) (string, relay.Provider, error) {
+	name, ok := mux.Vars(r)["provider"]
+	if !ok {
+		name = relay.NestProviderName
+	}
+	provider, ok := srv.Providers[name]
+	if !ok {
+		return "", nil, common.Errorf(http.StatusNotFound, "unknown provider %q", name)
+	}
+	return name, provider, nil
+}
+
 func handleLogin(w http.ResponseWriter, r *http.Request, srv *server) error {
 	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
 
+	_, provider, err := getProvider(r, srv)
+	if err != nil {
+		return err
+	}
+
 	// Generate a state token.
-	state, err := relay.GenerateStateToken(r.Context(), srv.App)
+	state, err := relay.GenerateStateToken(r.Context(), srv.Store)
 	if err != nil {
 		return err
 	}
 
-	// Redirect to the Nest oauth endpoint.
-	authURL := fmt.Sprintf("https://home.nest.com/login/oauth2?client_id=%s&state=%s", srv.Cfg.ClientID, state)
+	// Redirect to the provider's oauth endpoint.
+	authURL := provider.AuthorizationURL(state)
 	w.Header().Add("Location", authURL)
 	w.WriteHeader(http.StatusFound)
 	fmt.Fprintln(w, "Redirecting")
@@ -52,7 +136,12 @@ func handleLogin(w http.ResponseWriter, r *http.Request, srv *server) error {
 }
 
 func handleOAuth(w http.ResponseWriter, r *http.Request, srv *server) error {
-	log.Printf("Handling %s request to /oauth.\n", r.Method)
+	log.Printf("Handling %s request to %s.\n", r.Method, r.URL.Path)
+
+	name, provider, err := getProvider(r, srv)
+	if err != nil {
+		return err
+	}
 
 	params := r.URL.Query()
 	codes := params["code"]
@@ -64,24 +153,32 @@ func handleOAuth(w http.ResponseWriter, r *http.Request, srv *server) error {
 	state := states[0]
 
 	// Check the state.
-	if err := relay.CheckState(r.Context(), srv.App, state); err != nil {
+	if err := relay.CheckState(r.Context(), srv.Store, state); err != nil {
 		return err
 	}
 
-	// Get a Nest access token.
-	accessToken, err := nest.GetAccessToken(srv.Cfg.ClientID, srv.Cfg.ClientSecret, code)
+	// Get an access token.
+	token, err := provider.Exchange(r.Context(), code)
 	if err != nil {
 		return err
 	}
 
 	// Get the user ID.
-	data, err := nest.GetData(r.Context(), accessToken)
+	data, err := provider.GetData(r.Context(), token.AccessToken)
 	if err != nil {
 		return err
 	}
 
-	// Save the metadata to Firestore.
-	if err := relay.SaveNestData(r.Context(), srv.App, data); err != nil {
+	// Save the metadata to the store.
+	user := &relay.User{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+	if name != relay.NestProviderName {
+		user.Provider = name
+	}
+	if err := relay.SaveNestData(r.Context(), srv.Store, user, data); err != nil {
 		return err
 	}
 
@@ -92,7 +189,9 @@ func handleOAuth(w http.ResponseWriter, r *http.Request, srv *server) error {
 func handleLog(w http.ResponseWriter, r *http.Request, srv *server) error {
 	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
 
-	// Read the JSON for the Feather in the request body.
+	device := requestDevice(r)
+
+	// Read the JSON for the sensor in the request body.
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return common.Errorf(http.StatusBadRequest, "unable to read body: %s", err)
@@ -102,23 +201,261 @@ func handleLog(w http.ResponseWriter, r *http.Request, srv *server) error {
 		return common.Errorf(http.StatusBadRequest, "unable to parse json: %s", err)
 	}
 
+	// Readings are logged at the time they were measured, if the sensor says.
+	threshold := time.Duration(srv.Cfg.ClockSkewThresholdSeconds) * time.Second
+	measured, err := relay.ApplyDeviceTime(device, data, time.Now().UTC(), threshold)
+	if err != nil {
+		return err
+	}
+	relay.LogClockSkew(device, data)
+
 	// Make a key to store the data under.
 	key := relay.KeyForNow()
+	if !measured.IsZero() {
+		key = relay.KeyAt(measured)
+	}
 
-	// Save the data from the feather.
-	if err := relay.LogFeatherData(r.Context(), srv.App, key, data); err != nil {
+	// Save the data from the sensor.
+	if err := relay.LogSensorData(r.Context(), srv.Store, device, key, data); err != nil {
 		return err
 	}
 
-	// Get the current Nest data and save it.
-	if err := LogNestData(r.Context(), srv.App, key); err != nil {
+	fmt.Fprintln(w, "ack")
+	return nil
+}
+
+// Reads the readings in a batch upload, which is either a JSON array of
+// objects or newline-delimited JSON objects.
+func readBatch(body []byte) ([]map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	trimmed := bytes.TrimSpace(body)
+	isArray := len(trimmed) > 0 && trimmed[0] == '['
+	if isArray {
+		// Consume the opening bracket.
+		if _, err := decoder.Token(); err != nil {
+			return nil, common.Errorf(http.StatusBadRequest, "unable to parse json: %s", err)
+		}
+	}
+
+	readings := []map[string]interface{}{}
+	for decoder.More() {
+		if len(readings) == relay.MaxBatchSize {
+			return nil, common.Errorf(http.StatusRequestEntityTooLarge, "batch has more than %d readings", relay.MaxBatchSize)
+		}
+		var data map[string]interface{}
+		if err := decoder.Decode(&data); err != nil {
+			return nil, common.Errorf(http.StatusBadRequest, "unable to parse reading %d: %s", len(readings), err)
+		}
+		readings = append(readings, data)
+	}
+	if isArray {
+		if _, err := decoder.Token(); err != nil {
+			return nil, common.Errorf(http.StatusBadRequest, "unable to parse json: %s", err)
+		}
+	}
+	return readings, nil
+}
+
+func handleLogBatch(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	device := requestDevice(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return common.Errorf(http.StatusBadRequest, "unable to read body: %s", err)
+	}
+	readings, err := readBatch(body)
+	if err != nil {
 		return err
 	}
 
-	fmt.Fprintln(w, "ack")
+	threshold := time.Duration(srv.Cfg.ClockSkewThresholdSeconds) * time.Second
+	results, err := relay.LogSensorBatch(r.Context(), srv.Store, device, readings, threshold)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+	})
+}
+
+func handleGetDevices(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.ReadToken, "read"); err != nil {
+		return err
+	}
+
+	devices, err := srv.Store.GetDevices(r.Context())
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(devices)
+}
+
+func handleGetDevice(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.ReadToken, "read"); err != nil {
+		return err
+	}
+
+	name := mux.Vars(r)["name"]
+	device, err := srv.Store.GetDevice(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return common.Errorf(http.StatusNotFound, "no device named %q", name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(device)
+}
+
+func handleGetDeviceLog(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.ReadToken, "read"); err != nil {
+		return err
+	}
+
+	params := r.URL.Query()
+	from, to, err := queryTimes(params)
+	if err != nil {
+		return err
+	}
+	limit := 0
+	if s := params.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			return common.Errorf(http.StatusBadRequest, "invalid limit %q", s)
+		}
+	}
+
+	page, err := relay.QueryDeviceLog(r.Context(), srv.Store, mux.Vars(r)["name"], from, to, limit, params.Get("cursor"))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(page)
+}
+
+func handleGetDeviceRollups(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.ReadToken, "read"); err != nil {
+		return err
+	}
+
+	params := r.URL.Query()
+	from, to, err := queryTimes(params)
+	if err != nil {
+		return err
+	}
+
+	rollups, err := relay.QueryRollups(r.Context(), srv.Store, mux.Vars(r)["name"], from, to, params.Get("resolution"))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(rollups)
+}
+
+// Reads the from and to parameters of a query, either of which may be
+// missing.
+func queryTimes(params url.Values) (from, to time.Time, err error) {
+	if s := params.Get("from"); s != "" {
+		if from, err = relay.ParseQueryTime("from", s); err != nil {
+			return
+		}
+	}
+	if s := params.Get("to"); s != "" {
+		to, err = relay.ParseQueryTime("to", s)
+	}
+	return
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.ReadToken, "read"); err != nil {
+		return err
+	}
+
+	params := r.URL.Query()
+	from, to, err := queryTimes(params)
+	if err != nil {
+		return err
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = relay.ExportCSV
+	}
+	if format != relay.ExportCSV && format != relay.ExportNDJSON {
+		return common.Errorf(http.StatusBadRequest, "unknown export format %q", format)
+	}
+
+	name := mux.Vars(r)["name"]
+	w.Header().Set("Content-Type", relay.ExportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+
+	out := newExportWriter(w)
+	if err := relay.ExportDeviceLog(r.Context(), srv.Store, name, from, to, format, out); err != nil {
+		if out.written == 0 {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			return err
+		}
+		// Once rows have been sent, the status can't be changed, so errors
+		// can only be logged.
+		log.Printf("Unable to export %s: %s", name, err)
+	}
 	return nil
 }
 
+// How long each write of an export may take. Exports can run longer than
+// the server's write timeout, so the deadline is pushed back before each
+// write instead, which still cuts off clients that stop reading.
+const exportWriteTimeout = 15 * time.Second
+
+// exportWriter streams an export to a response, counting the bytes written
+// and extending the response's write deadline as it goes.
+type exportWriter struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	written    int
+}
+
+func newExportWriter(w http.ResponseWriter) *exportWriter {
+	return &exportWriter{w: w, controller: http.NewResponseController(w)}
+}
+
+func (ew *exportWriter) Write(data []byte) (int, error) {
+	// Writers that don't support deadlines, like httptest's, have no write
+	// timeout to extend.
+	if err := ew.controller.SetWriteDeadline(time.Now().Add(exportWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return 0, err
+	}
+	n, err := ew.w.Write(data)
+	ew.written += n
+	return n, err
+}
+
+// Returns the server's time, so that sensors can set their clocks.
+func handleTime(w http.ResponseWriter, r *http.Request, srv *server) error {
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"unix":    now.Unix(),
+		"unix_ms": now.UnixNano() / int64(time.Millisecond),
+		"time":    now.Format(time.RFC3339Nano),
+	})
+}
+
 func handleImage(w http.ResponseWriter, r *http.Request, srv *server) error {
 	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
 
@@ -140,11 +477,15 @@ func handleImage(w http.ResponseWriter, r *http.Request, srv *server) error {
 		return common.Errorf(http.StatusBadRequest, "unable to read body: %s", err)
 	}
 
+	if srv.Blobs == nil {
+		return common.Errorf(http.StatusServiceUnavailable, "image storage is not configured")
+	}
+
 	now := time.Now().UTC()
 	path := fmt.Sprintf("%d/%d/%d/%s", now.Year(), now.Month(), now.Day(), filename)
 
-	// Write it to Cloud Storage.
-	if err := WriteToStorage(r.Context(), srv.App, path, contentType, body); err != nil {
+	// Write it to storage.
+	if err := srv.Blobs.WriteBlob(r.Context(), path, contentType, body); err != nil {
 		return err
 	}
 
@@ -152,55 +493,219 @@ func handleImage(w http.ResponseWriter, r *http.Request, srv *server) error {
 	return nil
 }
 
-func WriteToStorage(ctx context.Context, app *firebase.App, filename, contentType string, data []byte) error {
-	storage, err := app.Storage(ctx)
+// Checks that the request carries the given bearer token. An empty token
+// means the feature it guards is turned off.
+func checkBearerToken(r *http.Request, token string, feature string) error {
+	if token == "" {
+		return common.Errorf(http.StatusServiceUnavailable, "%s is not configured", feature)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return common.Errorf(http.StatusUnauthorized, "missing %s token", feature)
+	}
+	sent := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return common.Errorf(http.StatusForbidden, "invalid %s token", feature)
+	}
+	return nil
+}
+
+func handleThermostat(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.ControlToken, "thermostat control"); err != nil {
+		return err
+	}
+
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return fmt.Errorf("unable to access storage: %s", err)
+		return common.Errorf(http.StatusBadRequest, "unable to read body: %s", err)
+	}
+	cmd := &relay.ThermostatCommand{}
+	if err := json.Unmarshal(body, cmd); err != nil {
+		return common.Errorf(http.StatusBadRequest, "unable to parse json: %s", err)
+	}
+
+	// Each endpoint only accepts the fields for its own kind of command.
+	hasTarget := cmd.Target != nil || cmd.TargetLow != nil || cmd.TargetHigh != nil
+	switch vars["command"] {
+	case "target":
+		if !hasTarget || cmd.Mode != "" || cmd.FanActive != nil {
+			return common.Errorf(http.StatusBadRequest, "target requires only target, or target_low and target_high")
+		}
+	case "mode":
+		if cmd.Mode == "" || hasTarget || cmd.FanActive != nil {
+			return common.Errorf(http.StatusBadRequest, "mode requires only mode")
+		}
+	case "fan":
+		if cmd.FanActive == nil || hasTarget || cmd.Mode != "" {
+			return common.Errorf(http.StatusBadRequest, "fan requires only fan_active and fan_duration")
+		}
+	default:
+		return common.Errorf(http.StatusNotFound, "unknown thermostat command %q", vars["command"])
+	}
+
+	key := relay.KeyForNow()
+	if err := relay.ControlThermostat(r.Context(), srv.Store, srv.Providers, name, key, cmd); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "ack")
+	return nil
+}
+
+func handleGetRegistry(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.AdminToken, "admin"); err != nil {
+		return err
 	}
 
-	bucket, err := storage.DefaultBucket()
+	regs, err := srv.Store.GetRegistrations(r.Context())
 	if err != nil {
-		return fmt.Errorf("unable to get bucket: %s", err)
+		return err
 	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(regs)
+}
+
+func handlePutRegistry(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
 
-	object := bucket.Object(filename)
-	writer := object.NewWriter(ctx)
-	writer.ObjectAttrs.ContentType = contentType
-	if _, err = writer.Write(data); err != nil {
-		return fmt.Errorf("unable to write file: %s", err)
+	if err := checkBearerToken(r, srv.Cfg.AdminToken, "admin"); err != nil {
+		return err
 	}
 
-	if err = writer.Close(); err != nil {
-		return fmt.Errorf("unable to close file: %s", err)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return common.Errorf(http.StatusBadRequest, "unable to read body: %s", err)
+	}
+	reg := &relay.Registration{}
+	if err := json.Unmarshal(body, reg); err != nil {
+		return common.Errorf(http.StatusBadRequest, "unable to parse json: %s", err)
 	}
 
+	if err := relay.RegisterDevice(r.Context(), srv.Store, mux.Vars(r)["device"], reg); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "ack")
 	return nil
 }
 
-func serve(port uint16, app *firebase.App, cfg *relay.Config) {
-	r := mux.NewRouter()
+func handleCreateKey(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
 
-	server := &server{
-		App: app,
-		Cfg: cfg,
+	if err := checkBearerToken(r, srv.Cfg.AdminToken, "admin"); err != nil {
+		return err
 	}
 
-	// Redirects to the Nest login.
+	id, key, err := relay.CreateDeviceKey(r.Context(), srv.Store, mux.Vars(r)["device"])
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      id,
+		"secret":  key.Secret,
+		"created": key.Created,
+	})
+}
+
+func handleListKeys(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.AdminToken, "admin"); err != nil {
+		return err
+	}
+
+	keys, err := srv.Store.GetDeviceKeys(r.Context(), mux.Vars(r)["device"])
+	if err != nil {
+		return err
+	}
+	// Secrets are never sent back out.
+	for _, key := range keys {
+		key.Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(keys)
+}
+
+func handleRevokeKey(w http.ResponseWriter, r *http.Request, srv *server) error {
+	log.Printf("Handling %s request to %s.\n", r.Method, r.RequestURI)
+
+	if err := checkBearerToken(r, srv.Cfg.AdminToken, "admin"); err != nil {
+		return err
+	}
+
+	vars := mux.Vars(r)
+	if err := relay.RevokeDeviceKey(r.Context(), srv.Store, vars["device"], vars["key"]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "ack")
+	return nil
+}
+
+func newRouter(server *server) *mux.Router {
+	r := mux.NewRouter()
+
+	// Redirects to the login page of a provider, the legacy Nest API by default.
 	r.HandleFunc("/login", wrapHandler(handleLogin, server))
+	r.HandleFunc("/login/{provider}", wrapHandler(handleLogin, server))
 
-	// Handles the oauth redirect from Nest.
+	// Handles the oauth redirect from a provider.
 	r.HandleFunc("/oauth", wrapHandler(handleOAuth, server))
+	r.HandleFunc("/oauth/{provider}", wrapHandler(handleOAuth, server))
+
+	// Logs a reading from a sensor.
+	r.HandleFunc("/log", wrapHandler(signedHandler(handleLog), server)).Methods("POST")
+	r.HandleFunc("/log/batch", wrapHandler(signedHandler(handleLogBatch), server)).Methods("POST")
+	r.HandleFunc("/log/{device}", wrapHandler(signedHandler(handleLog), server)).Methods("POST")
+	r.HandleFunc("/log/{device}/batch", wrapHandler(signedHandler(handleLogBatch), server)).Methods("POST")
+
+	// Reads device snapshots and logs.
+	r.HandleFunc("/devices", wrapHandler(handleGetDevices, server)).Methods("GET")
+	r.HandleFunc("/devices/{name}", wrapHandler(handleGetDevice, server)).Methods("GET")
+	r.HandleFunc("/devices/{name}/log", wrapHandler(handleGetDeviceLog, server)).Methods("GET")
+	r.HandleFunc("/devices/{name}/export", wrapHandler(handleExport, server)).Methods("GET")
+	r.HandleFunc("/devices/{name}/rollup", wrapHandler(handleGetDeviceRollups, server)).Methods("GET")
+
+	// Tells sensors the time.
+	r.HandleFunc("/time", wrapHandler(handleTime, server)).Methods("GET")
+
+	// Lists and registers sensors.
+	r.HandleFunc("/registry", wrapHandler(handleGetRegistry, server)).Methods("GET")
+	r.HandleFunc("/registry/{device}", wrapHandler(handlePutRegistry, server)).Methods("PUT")
 
-	// Logs a data snapshot to Firestore.
-	r.HandleFunc("/log", wrapHandler(handleLog, server)).Methods("POST")
+	// Manages the keys sensors sign their requests with.
+	r.HandleFunc("/registry/{device}/keys", wrapHandler(handleListKeys, server)).Methods("GET")
+	r.HandleFunc("/registry/{device}/keys", wrapHandler(handleCreateKey, server)).Methods("POST")
+	r.HandleFunc("/registry/{device}/keys/{key}", wrapHandler(handleRevokeKey, server)).Methods("DELETE")
 
-	// Saves an image to Firebase Storage.
-	r.HandleFunc("/image/{filename}", wrapHandler(handleImage, server)).Methods("POST")
+	// Saves an image to the blob store.
+	r.HandleFunc("/image/{filename}", wrapHandler(signedHandler(handleImage), server)).Methods("POST")
 
+	// Changes a thermostat's target temperature, HVAC mode, or fan timer.
+	r.HandleFunc("/thermostat/{name}/{command:target|mode|fan}", wrapHandler(handleThermostat, server)).Methods("POST")
+
+	// Reports metrics in the Prometheus text format.
+	r.HandleFunc("/metrics", wrapHandler(handleMetrics, server)).Methods("GET")
+
+	r.Use(instrumentRequests)
+	return r
+}
+
+func serve(port uint16, server *server) {
 	addr := fmt.Sprintf(":%d", port)
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         addr,
+		Handler: newRouter(server),
+		Addr:    addr,
+		// Exports stream for longer than this, so they push back their own
+		// deadline as they write. See exportWriter.
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
@@ -209,48 +714,76 @@ func serve(port uint16, app *firebase.App, cfg *relay.Config) {
 	log.Fatal(srv.ListenAndServe())
 }
 
-func LogNestData(ctx context.Context, app *firebase.App, key string) error {
-	users, err := relay.GetNestUsers(ctx, app)
-	if err != nil {
-		return err
+// Opens the store selected by the config.
+func openStore(cfg *relay.Config) relay.Store {
+	// Firebase is only needed for Firestore.
+	var app *firebase.App
+	if cfg.Store == "firestore" {
+		app = relay.InitFirebase(&firebase.Config{ProjectID: cfg.ProjectID})
 	}
 
-	for _, token := range users {
-		data, err := nest.GetData(ctx, token)
-		if err != nil {
-			return err
-		}
-
-		err = relay.LogNestData(ctx, app, key, data)
-		if err != nil {
-			return err
-		}
+	store, err := relay.OpenStore(cfg, app)
+	if err != nil {
+		log.Fatalf("error opening %s store: %s", cfg.Store, err)
 	}
-
-	return nil
-}
-
-func Checkup() {
-	log.Printf("%s: Time for a checkup...", relay.KeyForNow())
+	return store
 }
 
-func CheckupForever() {
-	for {
-		Checkup()
-		time.Sleep(1 * time.Hour)
+// Returns the store for images, or nil if the config has no bucket to save
+// them in. One client is shared by the whole process.
+func openBlobs(cfg *relay.Config) relay.BlobStore {
+	if cfg.StorageBucket == "" {
+		return nil
+	}
+	client, err := gcs.NewClient(context.Background())
+	if err != nil {
+		log.Fatalf("error initializing storage: %s", err)
 	}
+	return relay.NewFirebaseBlobStore(client, cfg.StorageBucket)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		runPrune(os.Args[2:])
+		return
+	}
+
 	cfg := relay.LoadConfig()
-	expvar.NewString("projectId").Set(cfg.ProjectID)
-	expvar.NewString("clientId").Set(cfg.ClientID)
-	app := relay.InitFirebase(&firebase.Config{
-		ProjectID:     cfg.ProjectID,
-		StorageBucket: cfg.StorageBucket,
-	})
+	recordConfig(cfg)
 
-	go CheckupForever()
+	store := openStore(cfg)
+	defer store.Close()
+
+	if err := relay.RegisterConfiguredDevices(context.Background(), store, cfg.Devices); err != nil {
+		log.Fatalf("error registering devices: %s", err)
+	}
 
-	serve(8080, app, cfg)
+	if err := relay.LoadDeviceMetrics(context.Background(), store); err != nil {
+		log.Printf("Unable to load device metrics: %s", err)
+	}
+
+	blobs := openBlobs(cfg)
+	if blobs != nil {
+		defer blobs.Close()
+	}
+	providers := cfg.Providers()
+
+	go relay.CheckupForever(store, cfg)
+	go relay.NewPoller(store, providers, cfg).PollForever(context.Background())
+	if cfg.Retention != nil {
+		go relay.NewJanitor(store, blobs, cfg).PruneForever(context.Background())
+	}
+
+	serve(8080, &server{
+		Store: store,
+		Blobs: blobs,
+		Cfg:   cfg,
+
+		Providers: providers,
+		Verifier:  relay.NewVerifier(store, time.Duration(cfg.SignatureWindowSeconds)*time.Second),
+	})
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay"
+	"github.com/bklimt/relay/nest"
+	"github.com/bklimt/relay/nest/nesttest"
+)
+
+// Returns a server backed by a MemoryStore and a fake Nest API with one
+// user, who logs in with code "code1" and has one thermostat.
+func newTestServer(t *testing.T) (*server, *relay.MemoryStore, *nesttest.Server) {
+	fake := nesttest.NewServer("client-id", "client-secret")
+	t.Cleanup(fake.Close)
+
+	data := &nest.Data{}
+	data.Devices.Thermostats = map[string]*nest.Thermostat{
+		"therm1": {DeviceID: "therm1", Name: "Hall", AmbientTemperatureC: nest.Float(20.5), HVACMode: "heat"},
+	}
+	fake.AddUser("user1", "code1", "token1", data)
+
+	store := relay.NewMemoryStore()
+	srv := &server{
+		Store: store,
+		Blobs: relay.NewMemoryBlobStore(),
+		Cfg:   &relay.Config{ReadToken: "read-token"},
+		Providers: map[string]relay.Provider{
+			relay.NestProviderName: &relay.NestProvider{
+				Client:       fake.Client(),
+				ClientID:     "client-id",
+				ClientSecret: "client-secret",
+			},
+		},
+	}
+	return srv, store, fake
+}
+
+// Sends a request through the router and returns the response.
+func do(srv *server, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newRouter(srv).ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// Logs in through /login and /oauth, and returns the state token used.
+func login(t *testing.T, srv *server) string {
+	w := do(srv, "GET", "/login", "")
+	if w.Code != http.StatusFound {
+		t.Fatalf("/login returned %d: %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %s", err)
+	}
+	state := location.Query().Get("state")
+	if state == "" {
+		t.Fatalf("redirect %s has no state", location)
+	}
+
+	w = do(srv, "GET", "/oauth?code=code1&state="+url.QueryEscape(state), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("/oauth returned %d: %s", w.Code, w.Body)
+	}
+	return state
+}
+
+type recordingNotifier struct {
+	sent []*relay.Notification
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification *relay.Notification) error {
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func TestLoginLogAndCheckup(t *testing.T) {
+	srv, store, fake := newTestServer(t)
+	ctx := context.Background()
+
+	state := login(t, srv)
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := users["user1"]; user == nil || user.AccessToken != "token1" {
+		t.Fatalf("user1 was not saved with its token: %v", users)
+	}
+	if fake.TokensIssued() != 1 {
+		t.Errorf("issued %d tokens, want 1", fake.TokensIssued())
+	}
+
+	// State tokens can only be used once.
+	if w := do(srv, "GET", "/oauth?code=code1&state="+url.QueryEscape(state), ""); w.Code == http.StatusOK {
+		t.Errorf("/oauth accepted a used state")
+	}
+
+	// A reading from the Feather.
+	if w := do(srv, "POST", "/log", `{"temperature": 21.5}`); w.Code != http.StatusOK {
+		t.Fatalf("/log returned %d: %s", w.Code, w.Body)
+	}
+
+	// The thermostat, as the poller would log it.
+	data, err := relay.FetchNestData(ctx, store, srv.Providers, "user1", users["user1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.LogNestData(ctx, store, relay.KeyForNow(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := store.GetDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := devices[relay.LegacyDeviceID]["temperature"]; got != 21.5 {
+		t.Errorf("Feather temperature is %v, want 21.5", got)
+	}
+	if got := devices["Hall"]["ambient_temperature_c"]; got != 20.5 {
+		t.Errorf("Hall ambient_temperature_c is %v, want 20.5", got)
+	}
+	if n := len(store.GetLog("device", "Hall")); n != 1 {
+		t.Errorf("Hall has %d log entries, want 1", n)
+	}
+
+	// Everything just logged, so nothing is stale.
+	notifier := &recordingNotifier{}
+	watchdog := relay.NewWatchdog(&relay.Alerts{StaleAfterSeconds: 3600})
+	watchdog.Notifiers = []relay.Notifier{notifier}
+	relay.Checkup(ctx, store, watchdog)
+	if len(notifier.sent) != 0 {
+		t.Errorf("sent %d notifications, want none", len(notifier.sent))
+	}
+}
+
+func TestOAuthRejectsUnknownState(t *testing.T) {
+	srv, store, _ := newTestServer(t)
+
+	w := do(srv, "GET", "/oauth?code=code1&state=bogus", "")
+	if w.Code == http.StatusOK {
+		t.Fatalf("/oauth accepted an unknown state")
+	}
+	users, _ := store.GetUsers(context.Background())
+	if len(users) != 0 {
+		t.Errorf("saved users %v for a rejected login", users)
+	}
+}
+
+func TestImage(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest("POST", "/image/door.jpg", strings.NewReader("jpeg"))
+	req.Header.Set("Content-Type", "image/jpeg")
+	w := httptest.NewRecorder()
+	newRouter(srv).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/image returned %d: %s", w.Code, w.Body)
+	}
+
+	found := 0
+	srv.Blobs.WalkBlobs(context.Background(), func(path string, _ time.Time) bool {
+		if strings.HasSuffix(path, "/door.jpg") {
+			found++
+		}
+		return true
+	})
+	if found != 1 {
+		t.Errorf("found %d copies of door.jpg, want 1", found)
+	}
+}
+
+func TestThermostat(t *testing.T) {
+	srv, _, fake := newTestServer(t)
+	login(t, srv)
+
+	send := func(target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		newRouter(srv).ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("/thermostat/Hall/mode", "control-token", `{"mode": "off"}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("control without a token configured returned %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	srv.Cfg.ControlToken = "control-token"
+	for _, c := range []struct {
+		target, token, body string
+		want                int
+	}{
+		{"/thermostat/Hall/mode", "", `{"mode": "off"}`, http.StatusUnauthorized},
+		{"/thermostat/Hall/mode", "read-token", `{"mode": "off"}`, http.StatusForbidden},
+		{"/thermostat/Hall/target", "control-token", `{"mode": "off"}`, http.StatusBadRequest},
+		{"/thermostat/Hall/mode", "control-token", `{"mode": "off", "target": 20}`, http.StatusBadRequest},
+		{"/thermostat/Hall/mode", "control-token", `{"mode": `, http.StatusBadRequest},
+		{"/thermostat/Attic/mode", "control-token", `{"mode": "off"}`, http.StatusNotFound},
+	} {
+		if w := send(c.target, c.token, c.body); w.Code != c.want {
+			t.Errorf("%s %s returned %d, want %d: %s", c.target, c.body, w.Code, c.want, w.Body)
+		}
+	}
+	if updates := fake.Updates("therm1"); len(updates) != 0 {
+		t.Errorf("rejected commands sent %v to Nest", updates)
+	}
+
+	w := send("/thermostat/Hall/mode", "control-token", `{"mode": "off"}`)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "ack" {
+		t.Fatalf("mode returned %d: %s", w.Code, w.Body)
+	}
+	if updates := fake.Updates("therm1"); len(updates) != 1 || updates[0]["hvac_mode"] != "off" {
+		t.Errorf("sent %v to Nest, want hvac_mode off", updates)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	srv, store, _ := newTestServer(t)
+
+	send := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		newRouter(srv).ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("GET", "/registry", "admin-token", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("registry without a token configured returned %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	srv.Cfg.AdminToken = "admin-token"
+	if w := send("PUT", "/registry/garage", "", `{"name": "Garage"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("registering without a token returned %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := send("PUT", "/registry/garage", "control-token", `{"name": "Garage"}`); w.Code != http.StatusForbidden {
+		t.Errorf("registering with the wrong token returned %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// Sensors can't log until they're registered.
+	if w := do(srv, "POST", "/log/garage", `{"temperature": 10}`); w.Code != http.StatusNotFound {
+		t.Errorf("unregistered sensor returned %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := send("PUT", "/registry/garage", "admin-token", `{"name": "Garage", "location": "garage"}`); w.Code != http.StatusOK {
+		t.Fatalf("registering returned %d: %s", w.Code, w.Body)
+	}
+	if w := do(srv, "POST", "/log/garage", `{"temperature": 10}`); w.Code != http.StatusOK {
+		t.Fatalf("/log/garage returned %d: %s", w.Code, w.Body)
+	}
+	devices, err := store.GetDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if garage := devices["garage"]; garage["name"] != "Garage" || garage["temperature"] != 10.0 {
+		t.Errorf("unexpected garage snapshot %v", garage)
+	}
+
+	w := send("GET", "/registry", "admin-token", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"location":"garage"`) {
+		t.Errorf("/registry returned %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSignedLog(t *testing.T) {
+	srv, store, _ := newTestServer(t)
+	srv.Verifier = relay.NewVerifier(store, 5*time.Minute)
+	ctx := context.Background()
+	if err := relay.RegisterDevice(ctx, store, "garage", &relay.Registration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sensors without keys don't have to sign their requests.
+	if w := do(srv, "POST", "/log/garage", `{"temperature": 20}`); w.Code != http.StatusOK {
+		t.Fatalf("unsigned /log returned %d: %s", w.Code, w.Body)
+	}
+
+	id, key, err := relay.CreateDeviceKey(ctx, store, "garage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := do(srv, "POST", "/log/garage", `{"temperature": 21}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned /log from a sensor with a key returned %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	body := `{"temperature": 22}`
+	req := &relay.SignedRequest{
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10),
+		Method:    "POST",
+		Path:      "/log/garage",
+		Body:      []byte(body),
+	}
+	signed := httptest.NewRequest("POST", "/log/garage", strings.NewReader(body))
+	signed.Header.Set("X-Relay-Key", id)
+	signed.Header.Set("X-Relay-Timestamp", req.Timestamp)
+	signed.Header.Set("X-Relay-Signature", relay.Sign(key.Secret, req))
+	w := httptest.NewRecorder()
+	newRouter(srv).ServeHTTP(w, signed)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed /log returned %d: %s", w.Code, w.Body)
+	}
+	if n := len(store.GetLog("device", "garage")); n != 2 {
+		t.Errorf("garage has %d log entries, want 2", n)
+	}
+}
+
+func TestMeasuredAtAndTime(t *testing.T) {
+	srv, store, _ := newTestServer(t)
+	if err := relay.RegisterDevice(context.Background(), store, "garage", &relay.Registration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reading buffered by the sensor is logged when it was measured.
+	measured := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	body := fmt.Sprintf(`{"temperature": 10, "measured_at": %d}`, measured.Unix())
+	if w := do(srv, "POST", "/log/garage", body); w.Code != http.StatusOK {
+		t.Fatalf("/log/garage returned %d: %s", w.Code, w.Body)
+	}
+	entries := store.GetLog("device", "garage")
+	if len(entries) != 1 {
+		t.Fatalf("garage has %d log entries, want 1", len(entries))
+	}
+	for key, entry := range entries {
+		if at, err := relay.ParseLogKey(key); err != nil || !at.Equal(measured) {
+			t.Errorf("reading measured at %s was logged under %s", measured, key)
+		}
+		if at, ok := entry["measured_at"].(time.Time); !ok || !at.Equal(measured) {
+			t.Errorf("measured_at is %v, want %s", entry["measured_at"], measured)
+		}
+	}
+
+	w := do(srv, "GET", "/time", "")
+	var got struct {
+		Unix int64 `json:"unix"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("/time returned %d: %s", w.Code, w.Body)
+	}
+	if d := time.Since(time.Unix(got.Unix, 0)); d < -time.Second || d > time.Minute {
+		t.Errorf("/time is off by %s", d)
+	}
+}
+
+func TestLogBatchFormats(t *testing.T) {
+	srv, store, _ := newTestServer(t)
+	now := time.Now().Unix()
+
+	array := fmt.Sprintf(`[{"t": 1, "measured_at": %d, "idempotency_key": "a"}, {"t": 2, "measured_at": %d}]`, now-100, now-50)
+	if w := do(srv, "POST", "/log/batch", array); w.Code != http.StatusOK {
+		t.Fatalf("array batch returned %d: %s", w.Code, w.Body)
+	}
+	ndjson := fmt.Sprintf("{\"t\": 1, \"measured_at\": %d, \"idempotency_key\": \"a\"}\n{\"t\": 3, \"measured_at\": %d}\n", now-100, now-10)
+	w := do(srv, "POST", "/log/batch", ndjson)
+	if w.Code != http.StatusOK {
+		t.Fatalf("NDJSON batch returned %d: %s", w.Code, w.Body)
+	}
+	var response struct {
+		Results []*relay.BatchResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 2 || response.Results[0].Status != relay.BatchDuplicate || response.Results[1].Status != relay.BatchCreated {
+		t.Errorf("unexpected results %s", w.Body)
+	}
+	if n := len(store.GetLog("device", relay.LegacyDeviceID)); n != 3 {
+		t.Errorf("logged %d entries, want 3", n)
+	}
+
+	if w := do(srv, "POST", "/log/batch", `[{"t": 1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("truncated batch returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Sends a GET request through the router with the given bearer token, if
+// any.
+func get(srv *server, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	newRouter(srv).ServeHTTP(w, r)
+	return w
+}
+
+func TestGetDevices(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+	logForExport(t, srv)
+
+	for _, c := range []struct {
+		target, token string
+		want          int
+	}{
+		{"/devices", "", http.StatusUnauthorized},
+		{"/devices", "control-token", http.StatusForbidden},
+		{"/devices", "read-token", http.StatusOK},
+		{"/devices/feather", "", http.StatusUnauthorized},
+		{"/devices/feather", "read-token", http.StatusOK},
+		{"/devices/attic", "read-token", http.StatusNotFound},
+		{"/devices/feather/log", "", http.StatusUnauthorized},
+		{"/devices/feather/log?from=yesterday", "read-token", http.StatusBadRequest},
+		{"/devices/feather/log?to=2019-13-01T00:00:00Z", "read-token", http.StatusBadRequest},
+		{"/devices/feather/log?from=2000&to=1000", "read-token", http.StatusBadRequest},
+		{"/devices/feather/log?limit=0", "read-token", http.StatusBadRequest},
+		{"/devices/feather/log?limit=-1", "read-token", http.StatusBadRequest},
+		{"/devices/feather/log?limit=ten", "read-token", http.StatusBadRequest},
+		{"/devices/feather/log?cursor=not-base64!", "read-token", http.StatusBadRequest},
+	} {
+		if w := get(srv, c.target, c.token); w.Code != c.want {
+			t.Errorf("%s returned %d, want %d: %s", c.target, w.Code, c.want, w.Body)
+		}
+	}
+
+	var devices map[string]map[string]interface{}
+	if err := json.Unmarshal(get(srv, "/devices", "read-token").Body.Bytes(), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := devices["feather"]; !ok {
+		t.Errorf("/devices returned %v, want the feather", devices)
+	}
+
+	// Page through the feather's log one entry at a time.
+	keys := []string{}
+	target := "/devices/feather/log?limit=1"
+	for i := 0; i < 5; i++ {
+		w := get(srv, target, "read-token")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d: %s", target, w.Code, w.Body)
+		}
+		var page relay.LogPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		target = "/devices/feather/log?limit=1&cursor=" + url.QueryEscape(page.NextCursor)
+	}
+	if len(keys) != 2 || keys[0] >= keys[1] {
+		t.Errorf("paged through keys %v, want the 2 readings in order", keys)
+	}
+}
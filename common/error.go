@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 )
@@ -21,6 +22,32 @@ func Errorf(status int, format string, params ...interface{}) error {
 	}
 }
 
+// Returns the status to report when a call to an upstream API fails with
+// the given status. Rejected credentials become StatusForbidden, so callers
+// can tell them apart from the upstream just being unavailable or rejecting
+// the request for some other reason.
+func UpstreamStatus(status int) int {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// Returns the status to report when a call to an OAuth token endpoint fails
+// with the given status and body. Token endpoints reject expired or revoked
+// grants with a 400 and an "invalid_grant" error, so that becomes
+// StatusForbidden too.
+func TokenStatus(status int, body []byte) int {
+	var oauthErr struct {
+		Error string `json:"error"`
+	}
+	if status == http.StatusBadRequest && json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error == "invalid_grant" {
+		return http.StatusForbidden
+	}
+	return UpstreamStatus(status)
+}
+
 func Status(err error) int {
 	if e, ok := err.(*Error); ok {
 		return e.Status
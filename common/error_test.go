@@ -0,0 +1,40 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpstreamStatus(t *testing.T) {
+	cases := map[int]int{
+		http.StatusBadRequest:          http.StatusBadGateway,
+		http.StatusUnauthorized:        http.StatusForbidden,
+		http.StatusForbidden:           http.StatusForbidden,
+		http.StatusNotFound:            http.StatusBadGateway,
+		http.StatusInternalServerError: http.StatusBadGateway,
+	}
+	for upstream, want := range cases {
+		if got := UpstreamStatus(upstream); got != want {
+			t.Errorf("UpstreamStatus(%d) = %d, want %d", upstream, got, want)
+		}
+	}
+}
+
+func TestTokenStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		want   int
+	}{
+		{http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`, http.StatusForbidden},
+		{http.StatusBadRequest, `{"error": "invalid_request"}`, http.StatusBadGateway},
+		{http.StatusBadRequest, `not json`, http.StatusBadGateway},
+		{http.StatusUnauthorized, `{"error": "invalid_client"}`, http.StatusForbidden},
+		{http.StatusServiceUnavailable, `{"error": "invalid_grant"}`, http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		if got := TokenStatus(c.status, []byte(c.body)); got != c.want {
+			t.Errorf("TokenStatus(%d, %s) = %d, want %d", c.status, c.body, got, c.want)
+		}
+	}
+}
@@ -5,14 +5,55 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
+
+	"github.com/bklimt/relay/nest"
+	"github.com/bklimt/relay/sdm"
 )
 
 type Config struct {
-	ClientID               string `json:"clientId"`               // The Nest client ID.
-	ClientSecret           string `json:"clientSecret"`           // The Nest client secret.
-	ProjectID              string `json:"projectId"`              // The Firebase project ID.
-	CheckupIntervalSeconds int    `json:"checkupIntervalSeconds"` // How long to wait between checkups.
-	StorageBucket          string `json:"storageBucket"`          // The Google Cloud Storage bucket.
+	ClientID                  string `json:"clientId"`                  // The Nest client ID.
+	ClientSecret              string `json:"clientSecret"`              // The Nest client secret.
+	ProjectID                 string `json:"projectId"`                 // The Firebase project ID.
+	CheckupIntervalSeconds    int    `json:"checkupIntervalSeconds"`    // How long to wait between checkups. Defaults to a quarter of Alerts.StaleAfterSeconds.
+	StorageBucket             string `json:"storageBucket"`             // The Google Cloud Storage bucket.
+	Store                     string `json:"store"`                     // The storage backend: "firestore" or "bolt".
+	BoltPath                  string `json:"boltPath"`                  // The database file for the bolt store.
+	NestAuthURL               string `json:"nestAuthUrl"`               // Overrides the Nest oauth login page.
+	NestTokenURL              string `json:"nestTokenUrl"`              // Overrides the Nest oauth token endpoint.
+	NestAPIURL                string `json:"nestApiUrl"`                // Overrides the Nest data API.
+	NestTimeoutSeconds        int    `json:"nestTimeoutSeconds"`        // How long each Nest call may take.
+	NestPollIntervalSeconds   int    `json:"nestPollIntervalSeconds"`   // How often to fetch Nest data.
+	NestPollConcurrency       int    `json:"nestPollConcurrency"`       // How many users to fetch at once.
+	NestPollMaxBackoffSeconds int    `json:"nestPollMaxBackoffSeconds"` // The longest to wait to retry a failing user.
+	SDMProjectID              string `json:"sdmProjectId"`              // The Device Access project ID. Enables SDM.
+	SDMClientID               string `json:"sdmClientId"`               // The Google oauth client ID for SDM.
+	SDMClientSecret           string `json:"sdmClientSecret"`           // The Google oauth client secret for SDM.
+	SDMRedirectURL            string `json:"sdmRedirectUrl"`            // Where Google redirects after login, i.e. .../oauth/sdm.
+	ControlToken              string `json:"controlToken"`              // The bearer token for thermostat control. Unset disables control.
+	AdminToken                string `json:"adminToken"`                // The bearer token for /registry. Unset disables it.
+	ReadToken                 string `json:"readToken"`                 // The bearer token for /devices. Unset disables it.
+	MetricsToken              string `json:"metricsToken"`              // The bearer token for /metrics. Unset leaves it open.
+
+	// When set, requests to /log and /image must be signed with one of the
+	// sensor's keys. Otherwise, only sensors that have keys must sign.
+	RequireSignatures bool `json:"requireSignatures"`
+	// How far a signature's timestamp may be from the server's clock.
+	SignatureWindowSeconds int `json:"signatureWindowSeconds"`
+
+	// How far a sensor's clock may be from the server's before its readings
+	// are flagged.
+	ClockSkewThresholdSeconds int `json:"clockSkewThresholdSeconds"`
+
+	// Sensors to register at startup, keyed by device ID.
+	Devices map[string]*Registration `json:"devices"`
+
+	// How long to keep device entries and images. If unset, nothing is ever
+	// deleted.
+	Retention *Retention `json:"retention"`
+
+	// When devices are considered stale, and who to notify.
+	Alerts *Alerts `json:"alerts"`
 }
 
 func LoadConfig() *Config {
@@ -32,9 +73,104 @@ func LoadConfig() *Config {
 		log.Fatalf("error parsing config %q: %s", data, err)
 	}
 
+	if cfg.Alerts == nil {
+		cfg.Alerts = &Alerts{}
+	}
+	if cfg.Alerts.StaleAfterSeconds == 0 {
+		cfg.Alerts.StaleAfterSeconds = 3600
+	}
+	// Checkups have to run more often than the threshold, or a device could
+	// be stale for nearly two thresholds before anyone is notified.
+	if cfg.Alerts.StaleAfterSeconds > 0 {
+		interval := (cfg.Alerts.StaleAfterSeconds + 3) / 4
+		if cfg.CheckupIntervalSeconds >= cfg.Alerts.StaleAfterSeconds {
+			log.Printf("checkupIntervalSeconds (%d) isn't less than staleAfterSeconds (%d), so using %d instead.", cfg.CheckupIntervalSeconds, cfg.Alerts.StaleAfterSeconds, interval)
+			cfg.CheckupIntervalSeconds = interval
+		}
+		if cfg.CheckupIntervalSeconds == 0 {
+			cfg.CheckupIntervalSeconds = interval
+		}
+	}
 	if cfg.CheckupIntervalSeconds == 0 {
 		cfg.CheckupIntervalSeconds = 3600
 	}
 
+	if cfg.NestPollIntervalSeconds == 0 {
+		cfg.NestPollIntervalSeconds = 300
+	}
+	if cfg.NestPollConcurrency == 0 {
+		cfg.NestPollConcurrency = 4
+	}
+	if cfg.NestPollMaxBackoffSeconds == 0 {
+		cfg.NestPollMaxBackoffSeconds = 3600
+	}
+
+	if cfg.SignatureWindowSeconds == 0 {
+		cfg.SignatureWindowSeconds = 300
+	}
+
+	if cfg.ClockSkewThresholdSeconds == 0 {
+		cfg.ClockSkewThresholdSeconds = 120
+	}
+
+	if cfg.Retention != nil {
+		if cfg.Retention.IntervalSeconds == 0 {
+			cfg.Retention.IntervalSeconds = 3600
+		}
+		if cfg.Retention.BatchSize == 0 {
+			cfg.Retention.BatchSize = 500
+		}
+	}
+
+	if cfg.Store == "" {
+		cfg.Store = "firestore"
+	}
+	if cfg.Store == "bolt" && cfg.BoltPath == "" {
+		cfg.BoltPath = "relay.db"
+	}
+
 	return cfg
 }
+
+// Returns a Nest client using the endpoints in the config, falling back to
+// the production Nest API for any that aren't set.
+func (cfg *Config) NestClient() *nest.Client {
+	client := *nest.DefaultClient
+	if cfg.NestAuthURL != "" {
+		client.AuthURL = cfg.NestAuthURL
+	}
+	if cfg.NestTokenURL != "" {
+		client.TokenURL = cfg.NestTokenURL
+	}
+	if cfg.NestAPIURL != "" {
+		client.APIURL = cfg.NestAPIURL
+	}
+	if cfg.NestTimeoutSeconds != 0 {
+		client.Timeout = time.Duration(cfg.NestTimeoutSeconds) * time.Second
+	}
+	return &client
+}
+
+// Returns the thermostat data providers enabled by the config, keyed by
+// provider name. The legacy Nest API is always enabled. Every provider
+// records metrics for its API calls.
+func (cfg *Config) Providers() map[string]Provider {
+	providers := map[string]Provider{
+		NestProviderName: &NestProvider{
+			Client:       cfg.NestClient(),
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+		},
+	}
+	if cfg.SDMProjectID != "" {
+		client := sdm.NewClient(cfg.SDMProjectID, cfg.SDMClientID, cfg.SDMClientSecret, cfg.SDMRedirectURL)
+		if cfg.NestTimeoutSeconds != 0 {
+			client.Timeout = time.Duration(cfg.NestTimeoutSeconds) * time.Second
+		}
+		providers[SDMProviderName] = &SDMProvider{Client: client}
+	}
+	for name, provider := range providers {
+		providers[name] = InstrumentProvider(name, provider)
+	}
+	return providers
+}
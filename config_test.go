@@ -0,0 +1,35 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Loads the config in data, as LoadConfig would at startup.
+func loadConfig(t *testing.T, data string) *Config {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KLIMT_RELAY_CONFIG", path)
+	return LoadConfig()
+}
+
+func TestLoadConfigCheckupInterval(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		want   int
+	}{
+		{`{}`, 900},
+		{`{"alerts": {"staleAfterSeconds": 600}}`, 150},
+		{`{"alerts": {"staleAfterSeconds": 600}, "checkupIntervalSeconds": 60}`, 60},
+		// The old default interval, with the default threshold.
+		{`{"checkupIntervalSeconds": 3600}`, 900},
+		{`{"alerts": {"staleAfterSeconds": -1}}`, 3600},
+	} {
+		if got := loadConfig(t, c.config).CheckupIntervalSeconds; got != c.want {
+			t.Errorf("checkup interval for %s is %d, want %d", c.config, got, c.want)
+		}
+	}
+}
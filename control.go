@@ -0,0 +1,258 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+)
+
+// ThermostatCommand is a change to make to a thermostat. Exactly one of
+// the groups of fields should be set: a target temperature, a target range,
+// an HVAC mode, or the fan timer.
+type ThermostatCommand struct {
+	// The scale temperatures are in: "C" or "F". Defaults to the
+	// thermostat's own temperature_scale.
+	Scale string `json:"scale,omitempty"`
+
+	Target     *float64 `json:"target,omitempty"`      // For heat or cool mode.
+	TargetLow  *float64 `json:"target_low,omitempty"`  // For heat-cool mode.
+	TargetHigh *float64 `json:"target_high,omitempty"` // For heat-cool mode.
+
+	// One of "heat", "cool", "heat-cool", "eco", or "off".
+	Mode string `json:"mode,omitempty"`
+
+	FanActive   *bool `json:"fan_active,omitempty"`
+	FanDuration int   `json:"fan_duration,omitempty"` // In minutes.
+}
+
+// The range of target temperatures, in Celsius, that Nest thermostats allow
+// when they aren't locked.
+const (
+	minTargetCelsius = 9
+	maxTargetCelsius = 32
+)
+
+// The fan timer durations, in minutes, that Nest thermostats support.
+var fanDurations = map[int]bool{15: true, 30: true, 45: true, 60: true, 120: true, 240: true, 480: true, 720: true, 1440: true}
+
+// Returns the command with its temperatures converted to Celsius.
+func (cmd *ThermostatCommand) inCelsius(therm *nest.Thermostat) (*ThermostatCommand, error) {
+	scale := cmd.Scale
+	if scale == "" {
+		scale = therm.TemperatureScale
+	}
+	if scale == "" {
+		scale = "C"
+	}
+	if scale != "C" && scale != "F" {
+		return nil, common.Errorf(http.StatusBadRequest, "scale %q is not C or F", scale)
+	}
+
+	c := *cmd
+	c.Scale = "C"
+	if scale == "F" {
+		for _, t := range []**float64{&c.Target, &c.TargetLow, &c.TargetHigh} {
+			if *t != nil {
+				*t = nest.Float(nest.FahrenheitToCelsius(**t))
+			}
+		}
+	}
+	return &c, nil
+}
+
+// Checks that a command makes sense for the thermostat in its current state,
+// and returns a copy of it with temperatures in Celsius.
+func ValidateCommand(therm *nest.Thermostat, cmd *ThermostatCommand) (*ThermostatCommand, error) {
+	cmd, err := cmd.inCelsius(therm)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []string{}
+	hasTarget := cmd.Target != nil || cmd.TargetLow != nil || cmd.TargetHigh != nil
+	groups := 0
+	for _, set := range []bool{hasTarget, cmd.Mode != "", cmd.FanActive != nil} {
+		if set {
+			groups++
+		}
+	}
+	if groups != 1 {
+		return nil, common.Errorf(http.StatusBadRequest, "command must set exactly one of a target, a mode, or the fan")
+	}
+
+	if hasTarget {
+		// Nest only lets the range be set when it's locked.
+		lo, hi := float64(minTargetCelsius), float64(maxTargetCelsius)
+		if nest.IsTrue(therm.IsLocked) && therm.LockedTempMinC != nil && therm.LockedTempMaxC != nil {
+			lo, hi = *therm.LockedTempMinC, *therm.LockedTempMaxC
+		}
+		check := func(name string, t *float64) {
+			if t != nil && (*t < lo || *t > hi) {
+				problems = append(problems, fmt.Sprintf("%s %.1fC is outside of %.1fC to %.1fC", name, *t, lo, hi))
+			}
+		}
+		check("target", cmd.Target)
+		check("target_low", cmd.TargetLow)
+		check("target_high", cmd.TargetHigh)
+
+		switch therm.HVACMode {
+		case "heat", "cool":
+			if cmd.Target == nil || cmd.TargetLow != nil || cmd.TargetHigh != nil {
+				problems = append(problems, fmt.Sprintf("thermostat is in %s mode, so only target can be set", therm.HVACMode))
+			}
+		case "heat-cool":
+			if cmd.Target != nil || cmd.TargetLow == nil || cmd.TargetHigh == nil {
+				problems = append(problems, "thermostat is in heat-cool mode, so target_low and target_high must be set")
+			} else if *cmd.TargetLow >= *cmd.TargetHigh {
+				problems = append(problems, "target_low must be less than target_high")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("can't set a target in %q mode", therm.HVACMode))
+		}
+	}
+
+	switch cmd.Mode {
+	case "":
+	case "heat":
+		if !nest.IsTrue(therm.CanHeat) {
+			problems = append(problems, "thermostat can't heat")
+		}
+	case "cool":
+		if !nest.IsTrue(therm.CanCool) {
+			problems = append(problems, "thermostat can't cool")
+		}
+	case "heat-cool":
+		if !nest.IsTrue(therm.CanHeat) || !nest.IsTrue(therm.CanCool) {
+			problems = append(problems, "thermostat can't both heat and cool")
+		}
+	case "eco", "off":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown mode %q", cmd.Mode))
+	}
+
+	if cmd.FanActive != nil {
+		if !nest.IsTrue(therm.HasFan) {
+			problems = append(problems, "thermostat doesn't have a fan")
+		}
+		if cmd.FanDuration != 0 && !fanDurations[cmd.FanDuration] {
+			problems = append(problems, fmt.Sprintf("fan duration %d is not supported", cmd.FanDuration))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, common.Errorf(http.StatusBadRequest, "invalid command: %s", strings.Join(problems, "; "))
+	}
+	return cmd, nil
+}
+
+// Returns the values to PUT to the Works with Nest API for a command that
+// has been validated.
+func nestCommandValues(cmd *ThermostatCommand) map[string]interface{} {
+	values := map[string]interface{}{}
+	if cmd.Target != nil {
+		values["target_temperature_c"] = nest.RoundCelsius(*cmd.Target)
+	}
+	if cmd.TargetLow != nil {
+		values["target_temperature_low_c"] = nest.RoundCelsius(*cmd.TargetLow)
+	}
+	if cmd.TargetHigh != nil {
+		values["target_temperature_high_c"] = nest.RoundCelsius(*cmd.TargetHigh)
+	}
+	if cmd.Mode != "" {
+		values["hvac_mode"] = cmd.Mode
+	}
+	if cmd.FanActive != nil {
+		values["fan_timer_active"] = *cmd.FanActive
+		if cmd.FanDuration != 0 {
+			values["fan_timer_duration"] = cmd.FanDuration
+		}
+	}
+	return values
+}
+
+// Finds the thermostat with the given name or device ID, validates the
+// command against it, and sends the command with its owner's credentials.
+// Every attempt is recorded in the thermostat's command log, whether or not
+// it succeeds. If the thermostat isn't found, but some users' devices
+// couldn't be fetched, it may belong to one of them, so the failure is
+// returned as a bad gateway rather than not found.
+func ControlThermostat(ctx context.Context, store Store, providers map[string]Provider, name string, key string, cmd *ThermostatCommand) error {
+	users, err := GetNestUsers(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var fetchErr error
+	for id, user := range users {
+		if user.NeedsReauth {
+			continue
+		}
+		data, err := FetchNestData(ctx, store, providers, id, user)
+		if err != nil {
+			log.Printf("Unable to get data for user %s: %s", id, err)
+			fetchErr = err
+			continue
+		}
+		for thermID, therm := range data.Devices.Thermostats {
+			if therm.Name != name && thermID != name {
+				continue
+			}
+			if therm.Name != "" {
+				name = therm.Name
+			}
+			err := sendCommand(ctx, store, providers[user.ProviderName()], id, user, therm, cmd)
+			logCommand(ctx, store, name, key, id, cmd, err)
+			return err
+		}
+	}
+
+	if fetchErr != nil {
+		return common.Errorf(http.StatusBadGateway, "unable to find thermostat %q: %s", name, fetchErr)
+	}
+	return common.Errorf(http.StatusNotFound, "no thermostat named %q", name)
+}
+
+func sendCommand(ctx context.Context, store Store, provider Provider, id string, user *User, therm *nest.Thermostat, cmd *ThermostatCommand) error {
+	cmd, err := ValidateCommand(therm, cmd)
+	if err != nil {
+		return err
+	}
+	accessToken, err := FreshAccessToken(ctx, store, provider, id, user)
+	if err != nil {
+		return err
+	}
+	return provider.SetThermostat(ctx, accessToken, therm, cmd)
+}
+
+func logCommand(ctx context.Context, store Store, name, key, userID string, cmd *ThermostatCommand, cmdErr error) {
+	entry := map[string]interface{}{
+		"user_id": userID,
+		"result":  "ok",
+	}
+	if cmd.Scale != "" {
+		entry["scale"] = cmd.Scale
+	}
+	for field, t := range map[string]*float64{"target": cmd.Target, "target_low": cmd.TargetLow, "target_high": cmd.TargetHigh} {
+		if t != nil {
+			entry[field] = *t
+		}
+	}
+	if cmd.Mode != "" {
+		entry["mode"] = cmd.Mode
+	}
+	if cmd.FanActive != nil {
+		entry["fan_active"] = *cmd.FanActive
+		entry["fan_duration"] = cmd.FanDuration
+	}
+	if cmdErr != nil {
+		entry["result"] = cmdErr.Error()
+	}
+	if err := store.LogCommand(ctx, name, key, entry); err != nil {
+		log.Printf("Unable to log command for %s: %s", name, err)
+	}
+}
@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+	"github.com/bklimt/relay/nest/nesttest"
+)
+
+func TestValidateCommand(t *testing.T) {
+	heat := &nest.Thermostat{HVACMode: "heat", CanHeat: nest.Bool(true), HasFan: nest.Bool(true), TemperatureScale: "F"}
+	range_ := &nest.Thermostat{HVACMode: "heat-cool", CanHeat: nest.Bool(true), CanCool: nest.Bool(true)}
+	locked := &nest.Thermostat{HVACMode: "heat", IsLocked: nest.Bool(true), LockedTempMinC: nest.Float(18), LockedTempMaxC: nest.Float(22)}
+
+	cases := []struct {
+		name    string
+		therm   *nest.Thermostat
+		cmd     *ThermostatCommand
+		problem string // Part of the error, or empty if the command is valid.
+	}{
+		{"target in F", heat, &ThermostatCommand{Target: nest.Float(68)}, ""},
+		{"target in C", heat, &ThermostatCommand{Target: nest.Float(20), Scale: "C"}, ""},
+		{"bad scale", heat, &ThermostatCommand{Target: nest.Float(20), Scale: "K"}, "scale"},
+		{"too hot", heat, &ThermostatCommand{Target: nest.Float(40), Scale: "C"}, "outside of"},
+		{"locked", locked, &ThermostatCommand{Target: nest.Float(23)}, "outside of 18.0C to 22.0C"},
+		{"range in heat", heat, &ThermostatCommand{TargetLow: nest.Float(65), TargetHigh: nest.Float(75)}, "only target"},
+		{"range", range_, &ThermostatCommand{TargetLow: nest.Float(19), TargetHigh: nest.Float(24)}, ""},
+		{"backwards range", range_, &ThermostatCommand{TargetLow: nest.Float(24), TargetHigh: nest.Float(19)}, "less than"},
+		{"target in off", &nest.Thermostat{HVACMode: "off"}, &ThermostatCommand{Target: nest.Float(20)}, "can't set a target"},
+		{"mode", range_, &ThermostatCommand{Mode: "cool"}, ""},
+		{"can't cool", heat, &ThermostatCommand{Mode: "cool"}, "can't cool"},
+		{"unknown mode", heat, &ThermostatCommand{Mode: "turbo"}, "unknown mode"},
+		{"fan", heat, &ThermostatCommand{FanActive: nest.Bool(true), FanDuration: 30}, ""},
+		{"no fan", range_, &ThermostatCommand{FanActive: nest.Bool(true)}, "doesn't have a fan"},
+		{"odd duration", heat, &ThermostatCommand{FanActive: nest.Bool(true), FanDuration: 20}, "not supported"},
+		{"empty", heat, &ThermostatCommand{}, "exactly one"},
+		{"two groups", heat, &ThermostatCommand{Mode: "heat", FanActive: nest.Bool(true)}, "exactly one"},
+	}
+	for _, c := range cases {
+		cmd, err := ValidateCommand(c.therm, c.cmd)
+		if c.problem == "" {
+			if err != nil {
+				t.Errorf("%s: %s", c.name, err)
+			} else if cmd.Scale != "C" {
+				t.Errorf("%s: validated command is in %q, want C", c.name, cmd.Scale)
+			}
+			continue
+		}
+		if common.Status(err) != http.StatusBadRequest || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("%s: got %v, want a bad request about %q", c.name, err, c.problem)
+		}
+	}
+
+	cmd, err := ValidateCommand(heat, &ThermostatCommand{Target: nest.Float(68)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cmd.Target != 20 {
+		t.Errorf("68F is %vC, want 20C", *cmd.Target)
+	}
+}
+
+// Returns a store with one Nest user, whose thermostat is named Hall, and
+// the fake Nest server the user's data comes from.
+func newControlTest(t *testing.T) (*MemoryStore, map[string]Provider, *nesttest.Server) {
+	fake := nesttest.NewServer("client-id", "client-secret")
+	t.Cleanup(fake.Close)
+	data := &nest.Data{}
+	data.Devices.Thermostats = map[string]*nest.Thermostat{
+		"therm1": {DeviceID: "therm1", Name: "Hall", HVACMode: "heat", CanHeat: nest.Bool(true), TemperatureScale: "C"},
+	}
+	fake.AddUser("user1", "code1", "token1", data)
+
+	store := NewMemoryStore()
+	if err := store.SaveUser(context.Background(), "user1", &User{AccessToken: "token1"}); err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]Provider{
+		NestProviderName: &NestProvider{Client: fake.Client(), ClientID: "client-id", ClientSecret: "client-secret"},
+	}
+	return store, providers, fake
+}
+
+func TestControlThermostat(t *testing.T) {
+	store, providers, fake := newControlTest(t)
+	ctx := context.Background()
+
+	if err := ControlThermostat(ctx, store, providers, "Hall", "key1", &ThermostatCommand{Target: nest.Float(21)}); err != nil {
+		t.Fatal(err)
+	}
+	// Thermostats can also be found by device ID.
+	if err := ControlThermostat(ctx, store, providers, "therm1", "key2", &ThermostatCommand{Mode: "off"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{{"target_temperature_c": 21.0}, {"hvac_mode": "off"}}
+	if got := fake.Updates("therm1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+
+	// Rejected commands are logged too.
+	err := ControlThermostat(ctx, store, providers, "Hall", "key3", &ThermostatCommand{Mode: "cool"})
+	if common.Status(err) != http.StatusBadRequest {
+		t.Errorf("invalid command returned %v, want a bad request", err)
+	}
+	keys, err := store.ListDeviceEntries(ctx, "Hall", DeviceCommand, "", "~", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameStrings(keys, []string{"key1", "key2", "key3"}) {
+		t.Errorf("logged commands %v, want key1 to key3", keys)
+	}
+	if len(fake.Updates("therm1")) != 2 {
+		t.Errorf("sent an invalid command to Nest")
+	}
+
+	err = ControlThermostat(ctx, store, providers, "Attic", "key4", &ThermostatCommand{Mode: "off"})
+	if common.Status(err) != http.StatusNotFound {
+		t.Errorf("unknown thermostat returned %v, want not found", err)
+	}
+}
+
+func TestControlThermostatWhenFetchesFail(t *testing.T) {
+	store, providers, fake := newControlTest(t)
+	fake.Close()
+
+	err := ControlThermostat(context.Background(), store, providers, "Hall", "key1", &ThermostatCommand{Mode: "off"})
+	if common.Status(err) != http.StatusBadGateway {
+		t.Errorf("got %v when Nest is down, want a bad gateway", err)
+	}
+}
@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The clock skew of each sensor's last reading with sent_at, in seconds.
+var clockSkewSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_device_clock_skew_seconds",
+	Help: "How far each sensor's clock was from relay's in its last reading.",
+}, []string{"device"})
+
+// Returns the time in a field sent by a sensor, which may be an RFC 3339
+// string or a number of Unix seconds, as from an RTC.
+func ParseDeviceTime(field string, value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, common.Errorf(http.StatusBadRequest, "invalid %s %q: must be RFC 3339 or Unix seconds", field, v)
+		}
+		return t.UTC(), nil
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+	return time.Time{}, common.Errorf(http.StatusBadRequest, "invalid %s %v: must be RFC 3339 or Unix seconds", field, value)
+}
+
+// How long before it was received a reading may have been measured. A
+// measurement time outside of this window, or later than the clock skew
+// threshold after it was received, is taken to be from a clock that's wrong.
+const maxMeasurementAge = 30 * 24 * time.Hour
+
+// Moves the times a sensor sent in a reading into the fields relay stores,
+// and returns when the reading was measured, or the zero time if the sensor
+// didn't say.
+//
+// The measurement time is taken from "measured_at". Any "timestamp" the
+// sensor sent is replaced, since "timestamp" is always the time relay
+// received the reading. The sensor's clock is compared to received using
+// "sent_at", the time on the sensor's clock when it sent the reading, or
+// else the measurement time. The difference is kept as "clock_skew_seconds",
+// and if it's more than threshold either way, "clock_skew" is set. Sensors
+// that buffer readings should send "sent_at", so that old readings aren't
+// mistaken for a wrong clock. A measurement time that can't be right, such as
+// one from before the sensor's clock was set, is replaced with received, and
+// "clock_skew" is set.
+func ApplyDeviceTime(name string, data map[string]interface{}, received time.Time, threshold time.Duration) (time.Time, error) {
+	var measured time.Time
+	if value, ok := data["measured_at"]; ok {
+		t, err := ParseDeviceTime("measured_at", value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		measured = t
+	}
+	delete(data, "timestamp")
+
+	sent := measured
+	if value, ok := data["sent_at"]; ok {
+		t, err := ParseDeviceTime("sent_at", value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		sent = t
+		delete(data, "sent_at")
+	}
+
+	implausible := !measured.IsZero() &&
+		(measured.Before(received.Add(-maxMeasurementAge)) || measured.After(received.Add(threshold)))
+	if implausible {
+		measured = received
+	}
+
+	if measured.IsZero() {
+		delete(data, "measured_at")
+	} else {
+		data["measured_at"] = measured
+	}
+	if sent.IsZero() {
+		return measured, nil
+	}
+
+	skew := sent.Sub(received)
+	data["clock_skew_seconds"] = skew.Seconds()
+	data["clock_skew"] = implausible || skew > threshold || skew < -threshold
+	clockSkewSeconds.WithLabelValues(name).Set(skew.Seconds())
+	return measured, nil
+}
+
+// Logs that readings from the named sensor were flagged by ApplyDeviceTime,
+// once for all of them, so that a sensor uploading a large batch from a
+// wrong clock doesn't flood the log.
+func LogClockSkew(name string, readings ...map[string]interface{}) {
+	flagged := 0
+	var worst float64
+	for _, data := range readings {
+		if data["clock_skew"] != true {
+			continue
+		}
+		flagged++
+		if skew, _ := data["clock_skew_seconds"].(float64); math.Abs(skew) > math.Abs(worst) {
+			worst = skew
+		}
+	}
+	if flagged > 0 {
+		skew := time.Duration(worst * float64(time.Second)).Round(time.Second)
+		log.Printf("Device %s clock is off by up to %s in %d of %d readings.", name, skew, flagged, len(readings))
+	}
+}
@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+func TestApplyDeviceTime(t *testing.T) {
+	received := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		data     map[string]interface{}
+		measured time.Time
+		flagged  bool
+	}{
+		{"no times", map[string]interface{}{}, time.Time{}, false},
+		{"RFC 3339", map[string]interface{}{"measured_at": "2020-06-01T11:59:00Z"}, received.Add(-time.Minute), false},
+		{"Unix seconds", map[string]interface{}{"measured_at": float64(received.Unix() - 60)}, received.Add(-time.Minute), false},
+		// Before this, timestamp was overwritten, so sensors may send
+		// anything in it, such as their uptime.
+		{"uptime timestamp", map[string]interface{}{"timestamp": 123456.0}, time.Time{}, false},
+		{"string timestamp", map[string]interface{}{"timestamp": "boot+5"}, time.Time{}, false},
+		{"buffered", map[string]interface{}{"measured_at": float64(received.Unix() - 2*86400), "sent_at": float64(received.Unix())}, received.Add(-48 * time.Hour), false},
+		{"slow clock", map[string]interface{}{"measured_at": float64(received.Unix() - 600)}, received.Add(-10 * time.Minute), true},
+		{"unset clock", map[string]interface{}{"measured_at": 5.0}, received, true},
+		{"future", map[string]interface{}{"measured_at": float64(received.Unix() + 3600)}, received, true},
+		{"too old to buffer", map[string]interface{}{"measured_at": float64(received.Unix() - 60*86400), "sent_at": float64(received.Unix())}, received, true},
+	}
+	for _, c := range cases {
+		measured, err := ApplyDeviceTime("garage", c.data, received, 2*time.Minute)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !measured.Equal(c.measured) {
+			t.Errorf("%s: measured at %s, want %s", c.name, measured, c.measured)
+		}
+		if flagged, _ := c.data["clock_skew"].(bool); flagged != c.flagged {
+			t.Errorf("%s: clock_skew is %v, want %v", c.name, flagged, c.flagged)
+		}
+		if _, ok := c.data["timestamp"]; ok {
+			t.Errorf("%s: the sensor's timestamp was kept", c.name)
+		}
+		if got, ok := c.data["measured_at"].(time.Time); c.measured.IsZero() == ok || (ok && !got.Equal(c.measured)) {
+			t.Errorf("%s: measured_at is %v, want %s", c.name, c.data["measured_at"], c.measured)
+		}
+	}
+
+	_, err := ApplyDeviceTime("garage", map[string]interface{}{"measured_at": "yesterday"}, received, time.Minute)
+	if common.Status(err) != http.StatusBadRequest {
+		t.Errorf("invalid measured_at returned %v, want a bad request", err)
+	}
+}
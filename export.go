@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// The formats a device log can be exported in.
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// Returns the content type for an export format.
+func ExportContentType(format string) string {
+	if format == ExportCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// Calls f with each entry of the named device's log written in [from, to),
+// oldest first, reading one page at a time so that the whole range is never
+// held in memory.
+func eachLogEntry(ctx context.Context, store Store, name string, from, to time.Time, f func(*LogEntry) error) error {
+	cursor := ""
+	for {
+		page, err := QueryDeviceLog(ctx, store, name, from, to, MaxQueryLimit, cursor)
+		if err != nil {
+			return err
+		}
+		for _, entry := range page.Entries {
+			if err := f(entry); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// Writes the named device's log entries written in [from, to) to w, as CSV
+// or NDJSON.
+//
+// Each NDJSON line is an entry, like the entries from QueryDeviceLog. CSV
+// has a "key" column followed by a column for every field of every entry in
+// the range, sorted, with nested objects flattened into dotted names like
+// "a.b". This takes two passes over the range: one to find the columns, and
+// one to write the rows. If to is zero, the range ends when the export
+// starts, so that both passes see the same entries.
+func ExportDeviceLog(ctx context.Context, store Store, name string, from, to time.Time, format string, w io.Writer) error {
+	switch format {
+	case ExportNDJSON:
+		encoder := json.NewEncoder(w)
+		return eachLogEntry(ctx, store, name, from, to, func(entry *LogEntry) error {
+			return encoder.Encode(entry)
+		})
+	case ExportCSV:
+		return exportCSV(ctx, store, name, from, to, w)
+	}
+	return common.Errorf(http.StatusBadRequest, "unknown export format %q: must be %s or %s", format, ExportCSV, ExportNDJSON)
+}
+
+func exportCSV(ctx context.Context, store Store, name string, from, to time.Time, w io.Writer) error {
+	// Entries logged after the first pass could have fields that aren't in
+	// the columns.
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+
+	fields := map[string]bool{}
+	err := eachLogEntry(ctx, store, name, from, to, func(entry *LogEntry) error {
+		for field := range flatten(entry.Data) {
+			fields[field] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	columns := make([]string, 0, len(fields))
+	for field := range fields {
+		columns = append(columns, field)
+	}
+	sort.Strings(columns)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append([]string{"key"}, columns...)); err != nil {
+		return err
+	}
+	row := make([]string, len(columns)+1)
+	err = eachLogEntry(ctx, store, name, from, to, func(entry *LogEntry) error {
+		values := flatten(entry.Data)
+		row[0] = entry.Key
+		for i, column := range columns {
+			row[i+1] = values[column]
+		}
+		return writer.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Returns the fields of data as strings, with nested objects flattened into
+// dotted names. Times are RFC 3339, and arrays are JSON.
+func flatten(data map[string]interface{}) map[string]string {
+	values := map[string]string{}
+	var add func(prefix string, data map[string]interface{})
+	add = func(prefix string, data map[string]interface{}) {
+		for field, value := range data {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				add(prefix+field+".", v)
+			case time.Time:
+				values[prefix+field] = v.UTC().Format(time.RFC3339Nano)
+			case string:
+				values[prefix+field] = v
+			case nil:
+				values[prefix+field] = ""
+			case []interface{}, []string:
+				encoded, _ := json.Marshal(v)
+				values[prefix+field] = string(encoded)
+			default:
+				values[prefix+field] = fmt.Sprint(v)
+			}
+		}
+	}
+	add("", data)
+	return values
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+// growingStore is a MemoryStore that has a new entry logged while the first
+// query of its log is running.
+type growingStore struct {
+	*MemoryStore
+	grown bool
+}
+
+func (s *growingStore) QueryDeviceLog(ctx context.Context, name string, q *LogQuery) ([]*LogEntry, error) {
+	entries, err := s.MemoryStore.QueryDeviceLog(ctx, name, q)
+	if !s.grown {
+		s.grown = true
+		time.Sleep(time.Millisecond)
+		s.LogDevice(ctx, name, KeyForNow(), map[string]interface{}{"late": 1.0})
+	}
+	return entries, err
+}
+
+func TestExportCSVIgnoresEntriesLoggedDuringExport(t *testing.T) {
+	ctx := context.Background()
+	store := &growingStore{MemoryStore: NewMemoryStore()}
+	store.LogDevice(ctx, "garage", KeyForNow(), map[string]interface{}{"temperature": 20.0})
+
+	var out bytes.Buffer
+	if err := ExportDeviceLog(ctx, store, "garage", time.Time{}, time.Time{}, ExportCSV, &out); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("export has %d rows, want a header and 1 row: %v", len(rows), rows)
+	}
+	want := []string{"key", "temperature", "timestamp"}
+	if !sameStrings(rows[0], want) {
+		t.Errorf("header is %v, want %v", rows[0], want)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	at := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	got := flatten(map[string]interface{}{
+		"a": 1.5,
+		"n": map[string]interface{}{"x": true, "y": "q"},
+		"l": []interface{}{1.0, "b"},
+		"t": at,
+		"z": nil,
+	})
+	want := map[string]string{
+		"a":   "1.5",
+		"n.x": "true",
+		"n.y": "q",
+		"l":   `[1,"b"]`,
+		"t":   "2019-01-02T03:04:05Z",
+		"z":   "",
+	}
+	if len(got) != len(want) {
+		t.Errorf("flatten returned %v, want %v", got, want)
+	}
+	for field, value := range want {
+		if got[field] != value {
+			t.Errorf("%s is %q, want %q", field, got[field], value)
+		}
+	}
+}
@@ -4,28 +4,34 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/bklimt/relay/common"
-	"github.com/bklimt/relay/nest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	firebase "firebase.google.com/go"
 )
 
-func KeyForNow() string {
-	return time.Now().UTC().Format(time.RFC3339)
+// FirestoreStore is a Store backed by Cloud Firestore. It uses the
+// collections "auth", "user", "user/{id}/thermostat", "user/{id}/structure",
+// "registry", "registry/{id}/key", "device", "device/{name}/log", "device/{name}/command",
+// "device/{name}/quarantine", "device/{name}/rollup_hour",
+// "device/{name}/rollup_day", "structure", and "structure/{name}/log".
+type FirestoreStore struct {
+	client *firestore.Client
 }
 
-func GenerateStateToken(ctx context.Context, app *firebase.App) (string, error) {
-	// Generate a state token.
-	client, err := app.Firestore(ctx)
-	if err != nil {
-		return "", common.Errorf(http.StatusInternalServerError, "unable to initialize firestore: %s", err)
-	}
-	defer client.Close()
+// Returns a store that uses client for every call. Closing the store closes
+// the client.
+func NewFirestoreStore(client *firestore.Client) *FirestoreStore {
+	return &FirestoreStore{client: client}
+}
 
-	doc, _, err := client.Collection("auth").Add(ctx, map[string]interface{}{
+func (s *FirestoreStore) CreateAuthState(ctx context.Context) (string, error) {
+	doc, _, err := s.client.Collection("auth").Add(ctx, map[string]interface{}{
 		"used":    false,
 		"created": firestore.ServerTimestamp,
 	})
@@ -35,167 +41,409 @@ func GenerateStateToken(ctx context.Context, app *firebase.App) (string, error)
 	return doc.ID, nil
 }
 
-func CheckState(ctx context.Context, app *firebase.App, state string) error {
-	fs, err := app.Firestore(ctx)
-	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to initialize firestore: %s", err)
+func (s *FirestoreStore) UseAuthState(ctx context.Context, state string) error {
+	// The read and the write are in a transaction, so that two requests with
+	// the same state can't both see it as unused.
+	ref := s.client.Collection("auth").Doc(state)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return common.Errorf(http.StatusForbidden, "invalid oauth state")
+		}
+		if err != nil {
+			return common.Errorf(http.StatusInternalServerError, "unable to read state from firestore: %s", err)
+		}
+		stateData := doc.Data()
+		if stateData["used"] != false {
+			return common.Errorf(http.StatusForbidden, "invalid oauth state")
+		}
+		stateData["used"] = true
+		stateData["updated"] = firestore.ServerTimestamp
+		if err := tx.Set(ref, stateData); err != nil {
+			return common.Errorf(http.StatusInternalServerError, "unable to write state to firestore: %s", err)
+		}
+		return nil
+	})
+	if _, ok := err.(*common.Error); err != nil && !ok {
+		return common.Errorf(http.StatusInternalServerError, "unable to use state: %s", err)
 	}
-	defer fs.Close()
+	return err
+}
 
-	doc, err := fs.Collection("auth").Doc(state).Get(ctx)
+func (s *FirestoreStore) SaveUser(ctx context.Context, id string, user *User) error {
+	_, err := s.client.Collection("user").Doc(id).Set(ctx, user)
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to read state from firestore: %s", err)
-	}
-	stateData := doc.Data()
-	if stateData["used"] != false {
-		return common.Errorf(http.StatusForbidden, "invalid oauth state")
+		return common.Errorf(http.StatusInternalServerError, "unable to write user data to firestore: %s", err)
 	}
-	stateData["used"] = true
-	stateData["updated"] = firestore.ServerTimestamp
-	_, err = fs.Collection("auth").Doc(state).Set(ctx, stateData)
+	return nil
+}
+
+func (s *FirestoreStore) SaveUserThermostat(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	thermDoc := s.client.Collection("user").Doc(userID).Collection("thermostat").Doc(id)
+	_, err := thermDoc.Set(ctx, data)
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to write state to firestore: %s", err)
+		return common.Errorf(http.StatusInternalServerError, "unable to write thermostat data to firestore: %s", err)
 	}
 	return nil
 }
 
-func SaveNestData(ctx context.Context, app *firebase.App, data *nest.Data) error {
-	fs, err := app.Firestore(ctx)
+func (s *FirestoreStore) SaveUserStructure(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	structureDoc := s.client.Collection("user").Doc(userID).Collection("structure").Doc(id)
+	_, err := structureDoc.Set(ctx, data)
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to initialize firestore: %s", err)
+		return common.Errorf(http.StatusInternalServerError, "unable to write structure data to firestore: %s", err)
 	}
-	defer fs.Close()
+	return nil
+}
 
-	userDoc := fs.Collection("user").Doc(data.Metadata.UserID)
-	_, err = userDoc.Set(ctx, map[string]interface{}{
-		"access_token": data.Metadata.AccessToken,
-	})
+func (s *FirestoreStore) GetUsers(ctx context.Context) (map[string]*User, error) {
+	users := map[string]*User{}
+
+	userDocs, err := s.client.Collection("user").Documents(ctx).GetAll()
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to write user data to firestore: %s", err)
+		return users, common.Errorf(http.StatusInternalServerError, "unable to query for users: %s", err)
 	}
 
-	for id, therm := range data.Devices.Thermostats {
-		thermDoc := userDoc.Collection("thermostat").Doc(id)
-		_, err = thermDoc.Set(ctx, therm)
-		if err != nil {
-			return common.Errorf(http.StatusInternalServerError, "unable to write thermostat data to firestore: %s", err)
+	for _, userDoc := range userDocs {
+		user := &User{}
+		if err := userDoc.DataTo(user); err != nil {
+			return users, common.Errorf(http.StatusInternalServerError, "invalid user %s: %s", userDoc.Ref.ID, err)
 		}
+		users[userDoc.Ref.ID] = user
 	}
 
+	return users, nil
+}
+
+func (s *FirestoreStore) SaveRegistration(ctx context.Context, id string, reg *Registration) error {
+	_, err := s.client.Collection("registry").Doc(id).Set(ctx, reg)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write registration to firestore: %s", err)
+	}
 	return nil
 }
 
-func LogNestData(ctx context.Context, app *firebase.App, key string, data *nest.Data) error {
-	fs, err := app.Firestore(ctx)
+func (s *FirestoreStore) GetRegistration(ctx context.Context, id string) (*Registration, error) {
+	doc, err := s.client.Collection("registry").Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to initialize firestore: %s", err)
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read registration %s: %s", id, err)
 	}
-	defer fs.Close()
+	reg := &Registration{}
+	if err := doc.DataTo(reg); err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "invalid registration %s: %s", id, err)
+	}
+	return reg, nil
+}
 
-	for id, therm := range data.Devices.Thermostats {
-		name, ok := therm["name"].(string)
-		if !ok {
-			name = id
-		}
-		therm["timestamp"] = firestore.ServerTimestamp
+func (s *FirestoreStore) GetRegistrations(ctx context.Context) (map[string]*Registration, error) {
+	docs, err := s.client.Collection("registry").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read registry: %s", err)
+	}
 
-		// Log the data for the device itself.
-		_, err = fs.Collection("device").Doc(name).Set(ctx, therm)
-		if err != nil {
-			return common.Errorf(http.StatusInternalServerError, "unable to write to thermostat data to firestore: %s", err)
+	regs := map[string]*Registration{}
+	for _, doc := range docs {
+		reg := &Registration{}
+		if err := doc.DataTo(reg); err != nil {
+			return nil, common.Errorf(http.StatusInternalServerError, "invalid registration %s: %s", doc.Ref.ID, err)
 		}
+		regs[doc.Ref.ID] = reg
+	}
+	return regs, nil
+}
 
-		// Log the data to the running log.
-		_, err = fs.Collection("device").Doc(name).Collection("log").Doc(key).Set(ctx, therm)
-		if err != nil {
-			return common.Errorf(http.StatusInternalServerError, "unable to write to thermostat log to firestore: %s", err)
+func (s *FirestoreStore) SaveDeviceKey(ctx context.Context, device, id string, key *DeviceKey) error {
+	_, err := s.client.Collection("registry").Doc(device).Collection("key").Doc(id).Set(ctx, key)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write key to firestore: %s", err)
+	}
+	return nil
+}
+
+func (s *FirestoreStore) GetDeviceKeys(ctx context.Context, device string) (map[string]*DeviceKey, error) {
+	docs, err := s.client.Collection("registry").Doc(device).Collection("key").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read keys for %s: %s", device, err)
+	}
+
+	keys := map[string]*DeviceKey{}
+	for _, doc := range docs {
+		key := &DeviceKey{}
+		if err := doc.DataTo(key); err != nil {
+			return nil, common.Errorf(http.StatusInternalServerError, "invalid key %s for %s: %s", doc.Ref.ID, device, err)
 		}
+		keys[doc.Ref.ID] = key
 	}
+	return keys, nil
+}
 
-	return nil
+func (s *FirestoreStore) LogDevice(ctx context.Context, name, key string, data map[string]interface{}) error {
+	return s.logDoc(ctx, "device", name, key, data)
 }
 
-// Returns a map of device name to timestamp.
-func GetMostRecentDeviceTimestamps(ctx context.Context, app *firebase.App) (map[string]time.Time, error) {
-	fs, err := app.Firestore(ctx)
+func (s *FirestoreStore) LogStructure(ctx context.Context, name, key string, data map[string]interface{}) error {
+	return s.logDoc(ctx, "structure", name, key, data)
+}
+
+func (s *FirestoreStore) LogCommand(ctx context.Context, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = firestore.ServerTimestamp
+
+	_, err := s.client.Collection("device").Doc(name).Collection("command").Doc(key).Set(ctx, data)
 	if err != nil {
-		return nil, common.Errorf(http.StatusInternalServerError, "unable to initialize firestore: %s", err)
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s command to firestore: %s", name, err)
 	}
-	defer fs.Close()
+	return nil
+}
 
-	// Get the list of devices.
-	devices, err := fs.Collection("device").Documents(ctx).GetAll()
+func (s *FirestoreStore) QuarantineReading(ctx context.Context, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = firestore.ServerTimestamp
+
+	_, err := s.client.Collection("device").Doc(name).Collection("quarantine").Doc(key).Set(ctx, data)
 	if err != nil {
-		return nil, common.Errorf(http.StatusInternalServerError, "unable to read devices: %s", err)
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s quarantine to firestore: %s", name, err)
 	}
+	return nil
+}
+
+// Saves data as the document collection/name and appends it to that
+// document's running log, in a single batch.
+func (s *FirestoreStore) logDoc(ctx context.Context, collection, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = firestore.ServerTimestamp
+
+	doc := s.client.Collection(collection).Doc(name)
+	batch := s.client.Batch()
+	batch.Set(doc, data)
+	batch.Set(doc.Collection("log").Doc(key), data)
+	if _, err := batch.Commit(ctx); err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s data to firestore: %s", name, err)
+	}
+	return nil
+}
 
-	timestamps := map[string]time.Time{}
-	for _, device := range devices {
-		data := device.Data()
-		if timestamp, ok := data["timestamp"].(time.Time); ok {
-			timestamps[device.Ref.ID] = timestamp
-		} else {
-			return nil, common.Errorf(
-				http.StatusInternalServerError,
-				"device %s has invalid timestamp: %v", device.Ref.ID, data["timestamp"])
+// The most entries to write in one transaction. Firestore allows 500 writes,
+// and one is saved for the snapshot.
+const firestoreMaxWrites = 499
+
+func (s *FirestoreStore) AppendDeviceLog(ctx context.Context, name string, entries map[string]map[string]interface{}, snapshot map[string]interface{}) (map[string]bool, error) {
+	doc := s.client.Collection("device").Doc(name)
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	created := map[string]bool{}
+	for start := 0; start < len(keys); start += firestoreMaxWrites {
+		end := start + firestoreMaxWrites
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunk := keys[start:end]
+		last := end == len(keys)
+
+		// Checking for existing entries and writing the new ones happen in a
+		// transaction, so that concurrent retries can't both add an entry.
+		var added []string
+		err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			added = nil
+			refs := make([]*firestore.DocumentRef, len(chunk))
+			for i, key := range chunk {
+				refs[i] = doc.Collection("log").Doc(key)
+			}
+			existing, err := tx.GetAll(refs)
+			if err != nil {
+				return err
+			}
+			for i, snap := range existing {
+				if snap.Exists() {
+					continue
+				}
+				data := entries[chunk[i]]
+				data["timestamp"] = firestore.ServerTimestamp
+				if err := tx.Set(refs[i], data); err != nil {
+					return err
+				}
+				added = append(added, chunk[i])
+			}
+			if last && snapshot != nil {
+				snapshot["timestamp"] = firestore.ServerTimestamp
+				return tx.Set(doc, snapshot)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, common.Errorf(http.StatusInternalServerError, "unable to write %s log to firestore: %s", name, err)
+		}
+		for _, key := range added {
+			created[key] = true
 		}
 	}
+	return created, nil
+}
 
-	return timestamps, nil
+func (s *FirestoreStore) QueryDeviceLog(ctx context.Context, name string, q *LogQuery) ([]*LogEntry, error) {
+	query := s.client.Collection("device").Doc(name).Collection("log").OrderBy(firestore.DocumentID, firestore.Asc)
+	if q.After != "" && q.After >= q.From {
+		query = query.StartAfter(q.After)
+	} else if q.From != "" {
+		query = query.StartAt(q.From)
+	}
+	if q.To != "" {
+		query = query.EndBefore(q.To)
+	}
+	docs, err := query.Limit(q.Limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to query %s log: %s", name, err)
+	}
+
+	entries := make([]*LogEntry, 0, len(docs))
+	for _, doc := range docs {
+		entries = append(entries, &LogEntry{Key: doc.Ref.ID, Data: doc.Data()})
+	}
+	return entries, nil
 }
 
-func GetNestUsers(ctx context.Context, app *firebase.App) (map[string]string, error) {
-	users := map[string]string{}
+// Returns the collection holding the named device's rollups at the given
+// resolution.
+func (s *FirestoreStore) rollups(name, resolution string) *firestore.CollectionRef {
+	return s.client.Collection("device").Doc(name).Collection("rollup_" + resolution)
+}
 
-	fs, err := app.Firestore(ctx)
+func (s *FirestoreStore) UpdateRollup(ctx context.Context, name, resolution string, start time.Time, update func(*RollupPeriod)) error {
+	// The read and the write are in a transaction, so that concurrent
+	// readings can't both start from the same rollups and lose one.
+	ref := s.rollups(name, resolution).Doc(KeyForTime(start))
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		period := &RollupPeriod{Start: start, Fields: map[string]*Rollup{}}
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if err := doc.DataTo(period); err != nil {
+				return err
+			}
+		}
+		update(period)
+		return tx.Set(ref, period)
+	})
 	if err != nil {
-		return users, common.Errorf(http.StatusInternalServerError, "unable to initialize firestore: %s", err)
+		return common.Errorf(http.StatusInternalServerError, "unable to write %s rollup to firestore: %s", name, err)
 	}
-	defer fs.Close()
+	return nil
+}
 
-	userDocs, err := fs.Collection("user").Documents(ctx).GetAll()
+func (s *FirestoreStore) QueryRollups(ctx context.Context, name, resolution string, from, to time.Time) ([]*RollupPeriod, error) {
+	docs, err := s.rollups(name, resolution).
+		OrderBy(firestore.DocumentID, firestore.Asc).
+		StartAt(KeyForTime(from)).
+		EndBefore(KeyForTime(to)).
+		Documents(ctx).GetAll()
 	if err != nil {
-		return users, common.Errorf(http.StatusInternalServerError, "unable to query for users: %s", err)
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to query %s rollups: %s", name, err)
 	}
 
-	for _, userDoc := range userDocs {
-		id := userDoc.Ref.ID
-		accessToken, ok := userDoc.Data()["access_token"]
-		if !ok {
-			return users, common.Errorf(http.StatusInternalServerError, "user missing access token: %s", id)
+	periods := make([]*RollupPeriod, 0, len(docs))
+	for _, doc := range docs {
+		period := &RollupPeriod{}
+		if err := doc.DataTo(period); err != nil {
+			return nil, common.Errorf(http.StatusInternalServerError, "unable to decode %s rollup %s: %s", name, doc.Ref.ID, err)
 		}
-		token, ok := accessToken.(string)
-		if !ok {
-			return users, common.Errorf(http.StatusInternalServerError, "access token was not a string: %v", accessToken)
-		}
-		users[id] = token
+		periods = append(periods, period)
 	}
+	return periods, nil
+}
 
-	return users, nil
+// Returns the collection holding the named device's entries of the given
+// kind.
+func (s *FirestoreStore) deviceEntries(name, kind string) *firestore.CollectionRef {
+	if kind == StructureLog {
+		return s.client.Collection("structure").Doc(name).Collection("log")
+	}
+	return s.client.Collection("device").Doc(name).Collection(kind)
 }
 
-func LogFeatherData(ctx context.Context, app *firebase.App, key string, data map[string]interface{}) error {
-	data["timestamp"] = firestore.ServerTimestamp
+func (s *FirestoreStore) ListDeviceEntries(ctx context.Context, name, kind, after, before string, limit int) ([]string, error) {
+	// Only the IDs are needed, so no fields are read.
+	query := s.deviceEntries(name, kind).
+		OrderBy(firestore.DocumentID, firestore.Asc).
+		Select()
+	if after != "" {
+		query = query.StartAfter(after)
+	}
+	docs, err := query.EndBefore(before).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to list %s %s entries: %s", name, kind, err)
+	}
 
-	client, err := app.Firestore(ctx)
+	keys := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		keys = append(keys, doc.Ref.ID)
+	}
+	return keys, nil
+}
+
+func (s *FirestoreStore) DeleteDeviceEntries(ctx context.Context, name, kind string, keys []string) error {
+	collection := s.deviceEntries(name, kind)
+	for start := 0; start < len(keys); start += firestoreMaxWrites {
+		end := start + firestoreMaxWrites
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := s.client.Batch()
+		for _, key := range keys[start:end] {
+			batch.Delete(collection.Doc(key))
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return common.Errorf(http.StatusInternalServerError, "unable to delete %s %s entries: %s", name, kind, err)
+		}
+	}
+	return nil
+}
+
+func (s *FirestoreStore) GetDevices(ctx context.Context) (map[string]map[string]interface{}, error) {
+	// Get the list of devices.
+	docs, err := s.client.Collection("device").Documents(ctx).GetAll()
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to initialize firestore: %s", err)
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read devices: %s", err)
+	}
+
+	devices := map[string]map[string]interface{}{}
+	for _, doc := range docs {
+		devices[doc.Ref.ID] = doc.Data()
 	}
-	defer client.Close()
+	return devices, nil
+}
 
-	// Save the data for the device itself.
-	_, err = client.Collection("device").Doc("feather").Set(ctx, data)
+func (s *FirestoreStore) GetDevice(ctx context.Context, name string) (map[string]interface{}, error) {
+	doc, err := s.client.Collection("device").Doc(name).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to write data to firestore: %s", err)
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read device %s: %s", name, err)
 	}
+	return doc.Data(), nil
+}
 
-	// Save the data to the running log.
-	_, err = client.Collection("device").Doc("feather").Collection("log").Doc(key).Set(ctx, data)
+func (s *FirestoreStore) GetStructures(ctx context.Context) (map[string]map[string]interface{}, error) {
+	docs, err := s.client.Collection("structure").Documents(ctx).GetAll()
 	if err != nil {
-		return common.Errorf(http.StatusInternalServerError, "unable to write log to firestore: %s", err)
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read structures: %s", err)
 	}
 
-	return nil
+	structures := map[string]map[string]interface{}{}
+	for _, doc := range docs {
+		structures[doc.Ref.ID] = doc.Data()
+	}
+	return structures, nil
+}
+
+func (s *FirestoreStore) Close() error {
+	return s.client.Close()
 }
 
 func InitFirebase(cfg *firebase.Config) *firebase.App {
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The layout of the time at the start of a log key. Unlike time.RFC3339Nano,
+// it always has nine fractional digits, so that keys sort in time order.
+//
+// Keys written before sub-second keys were introduced are plain time.RFC3339
+// at one-second resolution, like "2019-01-02T03:04:05Z". Since '.' sorts
+// before 'Z', an old key sorts after every new key from the same second and
+// before every key from the next second, so ranges of whole seconds contain
+// the same entries with either kind of key.
+const logKeyLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+var (
+	// Identifies this process, so that keys from replicas writing at the same
+	// instant don't collide.
+	replicaID = newReplicaID()
+
+	keyMu       sync.Mutex
+	lastKeyTime time.Time
+	keySeq      uint64
+)
+
+func newReplicaID() string {
+	id, err := newDocID()
+	if err != nil {
+		return fmt.Sprintf("p%d", os.Getpid())
+	}
+	return id[:8]
+}
+
+// Returns a new, unique key for a log entry written now. Keys from this
+// process are strictly increasing, and keys from different processes sort
+// by time, to the nanosecond.
+func KeyForNow() string {
+	keyMu.Lock()
+	now := time.Now().UTC()
+	if !now.After(lastKeyTime) {
+		now = lastKeyTime.Add(time.Nanosecond)
+	}
+	lastKeyTime = now
+	keyMu.Unlock()
+
+	return KeyForTime(now) + "-" + replicaID
+}
+
+// Returns a new, unique key for a log entry about something that happened
+// at t, such as a reading a sensor buffered before uploading it. Keys for the
+// same t are distinct, but only sort in the order they were made within
+// this process. The sequence number is zero-padded, so that the 10th key
+// for t doesn't sort before the 9th.
+func KeyAt(t time.Time) string {
+	keyMu.Lock()
+	keySeq++
+	seq := keySeq
+	keyMu.Unlock()
+
+	return fmt.Sprintf("%s-%s-%020d", KeyForTime(t), replicaID, seq)
+}
+
+// Returns the prefix shared by keys for entries written at t. It sorts
+// before every key written at or after t, so it can be used as a bound when
+// querying a log by time.
+func KeyForTime(t time.Time) string {
+	return t.UTC().Format(logKeyLayout)
+}
+
+// Returns the time a log entry was written, from its key. Both current keys
+// and old one-second keys are accepted.
+func ParseLogKey(key string) (time.Time, error) {
+	if i := strings.Index(key, "Z-"); i >= 0 {
+		key = key[:i+1]
+	}
+	t, err := time.Parse(time.RFC3339Nano, key)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid log key %q: %s", key, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestKeyForNowIsUniqueAndSorted(t *testing.T) {
+	keys := []string{}
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		key := KeyForNow()
+		if seen[key] {
+			t.Fatalf("duplicate key %s", key)
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("keys aren't in the order they were made")
+	}
+}
+
+func TestKeyAtSortsInOrderMade(t *testing.T) {
+	at := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	keys := []string{}
+	// Enough keys for the sequence number to gain a digit along the way.
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, KeyAt(at))
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("keys for the same time aren't in the order they were made: %s, ..., %s", keys[0], keys[len(keys)-1])
+	}
+
+	for _, key := range keys {
+		parsed, err := ParseLogKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(at) {
+			t.Errorf("key %s parsed as %s, want %s", key, parsed, at)
+		}
+	}
+	if later := KeyAt(at.Add(time.Nanosecond)); later < keys[len(keys)-1] {
+		t.Errorf("key %s for a later time sorts before %s", later, keys[len(keys)-1])
+	}
+}
+
+func TestOldKeysSortWithinTheirSecond(t *testing.T) {
+	old := "2019-01-02T03:04:05Z"
+	start := KeyForTime(time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC))
+	end := KeyForTime(time.Date(2019, 1, 2, 3, 4, 6, 0, time.UTC))
+	if !(start < old && old < end) {
+		t.Errorf("old key %s isn't between %s and %s", old, start, end)
+	}
+	parsed, err := ParseLogKey(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC); !parsed.Equal(want) {
+		t.Errorf("old key parsed as %s, want %s", parsed, want)
+	}
+}
@@ -0,0 +1,459 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It is meant for
+// tests and for trying relay out without any persistent storage.
+type MemoryStore struct {
+	mu          sync.Mutex
+	auth        map[string]bool
+	users       map[string]*User
+	thermostats map[string]map[string]map[string]interface{}
+	structures  map[string]map[string]map[string]interface{}
+	registry    map[string]*Registration
+	deviceKeys  map[string]map[string]*DeviceKey                        // device -> key ID -> key
+	docs        map[string]map[string]map[string]interface{}            // collection -> name -> data
+	logs        map[string]map[string]map[string]map[string]interface{} // collection -> name -> key -> data
+	commands    map[string]map[string]map[string]interface{}            // device -> key -> data
+	quarantine  map[string]map[string]map[string]interface{}            // device -> key -> data
+	rollups     map[string]map[string]map[string]*RollupPeriod          // resolution -> device -> key -> period
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		auth:        map[string]bool{},
+		users:       map[string]*User{},
+		thermostats: map[string]map[string]map[string]interface{}{},
+		structures:  map[string]map[string]map[string]interface{}{},
+		registry:    map[string]*Registration{},
+		deviceKeys:  map[string]map[string]*DeviceKey{},
+		docs:        map[string]map[string]map[string]interface{}{},
+		logs:        map[string]map[string]map[string]map[string]interface{}{},
+		commands:    map[string]map[string]map[string]interface{}{},
+		quarantine:  map[string]map[string]map[string]interface{}{},
+		rollups:     map[string]map[string]map[string]*RollupPeriod{},
+	}
+}
+
+// Returns a shallow copy of data, so that callers can't modify stored docs.
+func copyDoc(data map[string]interface{}) map[string]interface{} {
+	doc := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		doc[k] = v
+	}
+	return doc
+}
+
+func (s *MemoryStore) CreateAuthState(ctx context.Context) (string, error) {
+	id, err := newDocID()
+	if err != nil {
+		return "", common.Errorf(http.StatusInternalServerError, "unable to generate state: %s", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth[id] = false
+	return id, nil
+}
+
+func (s *MemoryStore) UseAuthState(ctx context.Context, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, ok := s.auth[state]
+	if !ok || used {
+		return common.Errorf(http.StatusForbidden, "invalid oauth state")
+	}
+	s.auth[state] = true
+	return nil
+}
+
+func (s *MemoryStore) SaveUser(ctx context.Context, id string, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := *user
+	s.users[id] = &u
+	return nil
+}
+
+func (s *MemoryStore) SaveUserThermostat(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.thermostats[userID] == nil {
+		s.thermostats[userID] = map[string]map[string]interface{}{}
+	}
+	s.thermostats[userID][id] = copyDoc(data)
+	return nil
+}
+
+func (s *MemoryStore) SaveUserStructure(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.structures[userID] == nil {
+		s.structures[userID] = map[string]map[string]interface{}{}
+	}
+	s.structures[userID][id] = copyDoc(data)
+	return nil
+}
+
+func (s *MemoryStore) GetUsers(ctx context.Context) (map[string]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := map[string]*User{}
+	for id, user := range s.users {
+		u := *user
+		users[id] = &u
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) SaveRegistration(ctx context.Context, id string, reg *Registration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := *reg
+	s.registry[id] = &r
+	return nil
+}
+
+func (s *MemoryStore) GetRegistration(ctx context.Context, id string) (*Registration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, ok := s.registry[id]
+	if !ok {
+		return nil, nil
+	}
+	r := *reg
+	return &r, nil
+}
+
+func (s *MemoryStore) GetRegistrations(ctx context.Context) (map[string]*Registration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	regs := map[string]*Registration{}
+	for id, reg := range s.registry {
+		r := *reg
+		regs[id] = &r
+	}
+	return regs, nil
+}
+
+func (s *MemoryStore) SaveDeviceKey(ctx context.Context, device, id string, key *DeviceKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deviceKeys[device] == nil {
+		s.deviceKeys[device] = map[string]*DeviceKey{}
+	}
+	k := *key
+	s.deviceKeys[device][id] = &k
+	return nil
+}
+
+func (s *MemoryStore) GetDeviceKeys(ctx context.Context, device string) (map[string]*DeviceKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := map[string]*DeviceKey{}
+	for id, key := range s.deviceKeys[device] {
+		k := *key
+		keys[id] = &k
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) LogDevice(ctx context.Context, name, key string, data map[string]interface{}) error {
+	return s.logDoc("device", name, key, data)
+}
+
+func (s *MemoryStore) LogStructure(ctx context.Context, name, key string, data map[string]interface{}) error {
+	return s.logDoc("structure", name, key, data)
+}
+
+func (s *MemoryStore) LogCommand(ctx context.Context, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.commands[name] == nil {
+		s.commands[name] = map[string]map[string]interface{}{}
+	}
+	s.commands[name][key] = copyDoc(data)
+	return nil
+}
+
+// Returns a copy of the command log for the named device, keyed by log key.
+func (s *MemoryStore) GetCommands(name string) map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := map[string]map[string]interface{}{}
+	for key, data := range s.commands[name] {
+		entries[key] = copyDoc(data)
+	}
+	return entries
+}
+
+func (s *MemoryStore) QuarantineReading(ctx context.Context, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quarantine[name] == nil {
+		s.quarantine[name] = map[string]map[string]interface{}{}
+	}
+	s.quarantine[name][key] = copyDoc(data)
+	return nil
+}
+
+// Returns a copy of the quarantine log for the named device, keyed by log
+// key.
+func (s *MemoryStore) GetQuarantine(name string) map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := map[string]map[string]interface{}{}
+	for key, data := range s.quarantine[name] {
+		entries[key] = copyDoc(data)
+	}
+	return entries
+}
+
+// Saves data as collection/name and appends it to the document's log.
+func (s *MemoryStore) logDoc(collection, name, key string, data map[string]interface{}) error {
+	data["timestamp"] = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.docs[collection] == nil {
+		s.docs[collection] = map[string]map[string]interface{}{}
+		s.logs[collection] = map[string]map[string]map[string]interface{}{}
+	}
+	s.docs[collection][name] = copyDoc(data)
+	if s.logs[collection][name] == nil {
+		s.logs[collection][name] = map[string]map[string]interface{}{}
+	}
+	s.logs[collection][name][key] = copyDoc(data)
+	return nil
+}
+
+func (s *MemoryStore) AppendDeviceLog(ctx context.Context, name string, entries map[string]map[string]interface{}, snapshot map[string]interface{}) (map[string]bool, error) {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.docs["device"] == nil {
+		s.docs["device"] = map[string]map[string]interface{}{}
+		s.logs["device"] = map[string]map[string]map[string]interface{}{}
+	}
+	if s.logs["device"][name] == nil {
+		s.logs["device"][name] = map[string]map[string]interface{}{}
+	}
+	created := map[string]bool{}
+	for key, data := range entries {
+		if _, ok := s.logs["device"][name][key]; ok {
+			continue
+		}
+		data["timestamp"] = now
+		s.logs["device"][name][key] = copyDoc(data)
+		created[key] = true
+	}
+	if snapshot != nil {
+		snapshot["timestamp"] = now
+		s.docs["device"][name] = copyDoc(snapshot)
+	}
+	return created, nil
+}
+
+func (s *MemoryStore) QueryDeviceLog(ctx context.Context, name string, q *LogQuery) ([]*LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.logs["device"][name] {
+		if q.contains(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > q.Limit {
+		keys = keys[:q.Limit]
+	}
+
+	entries := make([]*LogEntry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, &LogEntry{Key: key, Data: copyDoc(s.logs["device"][name][key])})
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) GetDevices(ctx context.Context) (map[string]map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := map[string]map[string]interface{}{}
+	for name, data := range s.docs["device"] {
+		devices[name] = copyDoc(data)
+	}
+	return devices, nil
+}
+
+func (s *MemoryStore) GetDevice(ctx context.Context, name string) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.docs["device"][name]
+	if !ok {
+		return nil, nil
+	}
+	return copyDoc(data), nil
+}
+
+func (s *MemoryStore) GetStructures(ctx context.Context) (map[string]map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	structures := map[string]map[string]interface{}{}
+	for name, data := range s.docs["structure"] {
+		structures[name] = copyDoc(data)
+	}
+	return structures, nil
+}
+
+// Returns a deep copy of period, so that callers can't modify stored rollups.
+func copyRollupPeriod(period *RollupPeriod) *RollupPeriod {
+	p := &RollupPeriod{Start: period.Start, Fields: map[string]*Rollup{}}
+	for field, rollup := range period.Fields {
+		r := *rollup
+		p.Fields[field] = &r
+	}
+	return p
+}
+
+func (s *MemoryStore) UpdateRollup(ctx context.Context, name, resolution string, start time.Time, update func(*RollupPeriod)) error {
+	key := KeyForTime(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rollups[resolution] == nil {
+		s.rollups[resolution] = map[string]map[string]*RollupPeriod{}
+	}
+	if s.rollups[resolution][name] == nil {
+		s.rollups[resolution][name] = map[string]*RollupPeriod{}
+	}
+	period := &RollupPeriod{Start: start, Fields: map[string]*Rollup{}}
+	if current, ok := s.rollups[resolution][name][key]; ok {
+		period = copyRollupPeriod(current)
+	}
+	update(period)
+	s.rollups[resolution][name][key] = period
+	return nil
+}
+
+func (s *MemoryStore) QueryRollups(ctx context.Context, name, resolution string, from, to time.Time) ([]*RollupPeriod, error) {
+	start, end := KeyForTime(from), KeyForTime(to)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.rollups[resolution][name] {
+		if key >= start && key < end {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	periods := make([]*RollupPeriod, 0, len(keys))
+	for _, key := range keys {
+		periods = append(periods, copyRollupPeriod(s.rollups[resolution][name][key]))
+	}
+	return periods, nil
+}
+
+// Returns the keys of the named device's entries of the given kind.
+func (s *MemoryStore) deviceEntryKeys(name, kind string) ([]string, error) {
+	keys := []string{}
+	switch kind {
+	case DeviceLog:
+		for key := range s.logs["device"][name] {
+			keys = append(keys, key)
+		}
+	case DeviceQuarantine:
+		for key := range s.quarantine[name] {
+			keys = append(keys, key)
+		}
+	case DeviceCommand:
+		for key := range s.commands[name] {
+			keys = append(keys, key)
+		}
+	case DeviceRollupHour, DeviceRollupDay:
+		for key := range s.rollups[strings.TrimPrefix(kind, "rollup_")][name] {
+			keys = append(keys, key)
+		}
+	case StructureLog:
+		for key := range s.logs["structure"][name] {
+			keys = append(keys, key)
+		}
+	default:
+		return nil, common.Errorf(http.StatusBadRequest, "unknown kind of device entry %q", kind)
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) ListDeviceEntries(ctx context.Context, name, kind, after, before string, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.deviceEntryKeys(name, kind)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, key := range all {
+		if key > after && key < before {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) DeleteDeviceEntries(ctx context.Context, name, kind string, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.deviceEntryKeys(name, kind); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		switch kind {
+		case DeviceLog:
+			delete(s.logs["device"][name], key)
+		case DeviceQuarantine:
+			delete(s.quarantine[name], key)
+		case DeviceCommand:
+			delete(s.commands[name], key)
+		case DeviceRollupHour, DeviceRollupDay:
+			delete(s.rollups[strings.TrimPrefix(kind, "rollup_")][name], key)
+		case StructureLog:
+			delete(s.logs["structure"][name], key)
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the running log for the named document in collection,
+// such as "device" or "structure", keyed by log key.
+func (s *MemoryStore) GetLog(collection, name string) map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := map[string]map[string]interface{}{}
+	for key, data := range s.logs[collection][name] {
+		entries[key] = copyDoc(data)
+	}
+	return entries
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	storeCallSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "relay_store_call_duration_seconds",
+		Help: "How long calls to the store take, by store and method.",
+	}, []string{"store", "call"})
+	storeCallErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_store_call_errors_total",
+		Help: "Calls to the store that failed, by store and method.",
+	}, []string{"store", "call"})
+
+	providerCallSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "relay_provider_call_duration_seconds",
+		Help: "How long calls to the Nest and SDM APIs take, by provider and method.",
+	}, []string{"provider", "call"})
+	providerCallErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_provider_call_errors_total",
+		Help: "Calls to the Nest and SDM APIs that failed, by provider and method.",
+	}, []string{"provider", "call"})
+)
+
+// Records how long a call that started at start took, and whether it
+// failed.
+func observeCall(seconds *prometheus.HistogramVec, errors *prometheus.CounterVec, source, call string, start time.Time, err error) {
+	seconds.WithLabelValues(source, call).Observe(time.Since(start).Seconds())
+	if err != nil {
+		errors.WithLabelValues(source, call).Inc()
+	}
+}
+
+// deviceMetrics reports when each device was last heard from and the latest
+// value of each of its numeric fields. Ages are computed when the metrics
+// are scraped, so they keep growing while a device is silent.
+type deviceMetrics struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	valuesAt map[string]time.Time // When the values in values were measured.
+	values   map[string]map[string]float64
+}
+
+var (
+	deviceLastSeenDesc = prometheus.NewDesc(
+		"relay_device_last_seen_age_seconds",
+		"How long ago each device was last logged.",
+		[]string{"device"}, nil)
+	deviceValueDesc = prometheus.NewDesc(
+		"relay_device_value",
+		"The latest value of each numeric field of each device.",
+		[]string{"device", "field"}, nil)
+)
+
+var devices = newDeviceMetrics()
+
+func newDeviceMetrics() *deviceMetrics {
+	m := &deviceMetrics{
+		lastSeen: map[string]time.Time{},
+		valuesAt: map[string]time.Time{},
+		values:   map[string]map[string]float64{},
+	}
+	prometheus.MustRegister(m)
+	return m
+}
+
+func (m *deviceMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceLastSeenDesc
+	ch <- deviceValueDesc
+}
+
+func (m *deviceMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for name, seen := range m.lastSeen {
+		ch <- prometheus.MustNewConstMetric(deviceLastSeenDesc, prometheus.GaugeValue, now.Sub(seen).Seconds(), name)
+	}
+	for name, values := range m.values {
+		for field, value := range values {
+			ch <- prometheus.MustNewConstMetric(deviceValueDesc, prometheus.GaugeValue, value, name, field)
+		}
+	}
+}
+
+// Records that the named device was heard from at the given time, unless
+// it's already known to have been heard from since.
+func (m *deviceMetrics) seen(name string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if at.After(m.lastSeen[name]) {
+		m.lastSeen[name] = at
+	}
+}
+
+// Records the numeric fields of data, measured at the given time, as the
+// named device's latest values, unless newer ones have already been
+// recorded.
+func (m *deviceMetrics) update(name string, measured time.Time, data map[string]interface{}) {
+	values := numericFields(data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if measured.Before(m.valuesAt[name]) {
+		return
+	}
+	m.valuesAt[name] = measured
+	m.values[name] = values
+}
+
+// Updates the device metrics from the latest snapshot of every device, for
+// when relay starts up, or when devices may have been logged by another
+// instance.
+func LoadDeviceMetrics(ctx context.Context, store Store) error {
+	snapshots, err := store.GetDevices(ctx)
+	if err != nil {
+		return err
+	}
+	for name, data := range snapshots {
+		if timestamp, ok := data["timestamp"].(time.Time); ok {
+			devices.seen(name, timestamp)
+		}
+		devices.update(name, snapshotTime(data), data)
+	}
+	return nil
+}
+
+// Updates everything derived from entries newly logged for the named
+// device: its rollups and its metrics.
+func deviceLogged(ctx context.Context, store Store, name string, entries ...map[string]interface{}) {
+	updateRollups(ctx, store, name, entries)
+	devices.seen(name, time.Now().UTC())
+	for _, data := range entries {
+		devices.update(name, entryTime(data), data)
+	}
+}
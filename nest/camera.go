@@ -0,0 +1,75 @@
+package nest
+
+import (
+	"encoding/json"
+)
+
+// CameraEvent is the most recent sound or motion event seen by a camera.
+type CameraEvent struct {
+	HasSound         *bool    `json:"has_sound,omitempty"`
+	HasMotion        *bool    `json:"has_motion,omitempty"`
+	HasPerson        *bool    `json:"has_person,omitempty"`
+	StartTime        string   `json:"start_time,omitempty"`
+	EndTime          string   `json:"end_time,omitempty"`
+	URLsExpireTime   string   `json:"urls_expire_time,omitempty"`
+	WebURL           string   `json:"web_url,omitempty"`
+	AppURL           string   `json:"app_url,omitempty"`
+	ImageURL         string   `json:"image_url,omitempty"`
+	AnimatedImageURL string   `json:"animated_image_url,omitempty"`
+	ActivityZoneIDs  []string `json:"activity_zone_ids,omitempty"`
+}
+
+// Camera is a Nest Cam as returned by the Works with Nest API. Fields that
+// aren't declared here are kept in Raw and passed through untouched.
+type Camera struct {
+	DeviceID              string       `json:"device_id,omitempty"`
+	SoftwareVersion       string       `json:"software_version,omitempty"`
+	StructureID           string       `json:"structure_id,omitempty"`
+	WhereID               string       `json:"where_id,omitempty"`
+	WhereName             string       `json:"where_name,omitempty"`
+	Name                  string       `json:"name,omitempty"`
+	NameLong              string       `json:"name_long,omitempty"`
+	IsOnline              *bool        `json:"is_online,omitempty"`
+	IsStreaming           *bool        `json:"is_streaming,omitempty"`
+	IsAudioInputEnabled   *bool        `json:"is_audio_input_enabled,omitempty"`
+	LastIsOnlineChange    string       `json:"last_is_online_change,omitempty"`
+	IsVideoHistoryEnabled *bool        `json:"is_video_history_enabled,omitempty"`
+	IsPublicShareEnabled  *bool        `json:"is_public_share_enabled,omitempty"`
+	LastEvent             *CameraEvent `json:"last_event,omitempty"`
+
+	// Every field returned by the API that isn't declared above, such as
+	// the snapshot and share URLs.
+	Raw map[string]interface{} `json:"-"`
+
+	// Problems found while parsing the camera. Fields with problems are left
+	// unset.
+	Problems []string `json:"-"`
+}
+
+// Used to marshal and unmarshal without recursing into Camera's own
+// methods.
+type cameraFieldsOnly Camera
+
+var cameraFields = jsonFieldNames(&cameraFieldsOnly{})
+
+func (c *Camera) UnmarshalJSON(data []byte) error {
+	parsed := cameraFieldsOnly{}
+	raw, problems, err := decodeFields(data, cameraFields, &parsed)
+	if err != nil {
+		return err
+	}
+	*c = Camera(parsed)
+	c.Raw = raw
+	c.Problems = problems
+	return nil
+}
+
+func (c *Camera) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Fields())
+}
+
+// Returns every field of the camera, including the ones in Raw, keyed by
+// JSON name.
+func (c *Camera) Fields() map[string]interface{} {
+	return mergeFields(c.Raw, (*cameraFieldsOnly)(c))
+}
@@ -0,0 +1,51 @@
+package nest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/bklimt/relay/common"
+)
+
+// Updates fields of a thermostat, such as "target_temperature_c" or
+// "hvac_mode". Nest validates the new values against the thermostat's
+// current state and rejects the whole update if any of them are invalid.
+func (c *Client) SetThermostat(ctx context.Context, accessToken string, deviceID string, values map[string]interface{}) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	body, err := json.Marshal(values)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to encode thermostat update: %s", err)
+	}
+
+	u := fmt.Sprintf("%s/devices/thermostats/%s", strings.TrimSuffix(c.APIURL, "/"), deviceID)
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to create request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	response, err := c.doAPI(req)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to connect to nest: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		status := common.UpstreamStatus(response.StatusCode)
+		if response.StatusCode == http.StatusBadRequest {
+			// Nest rejected the values, not the credentials.
+			status = http.StatusBadRequest
+		}
+		return common.Errorf(status, "unable to update thermostat %s: %s: %s", deviceID, response.Status, message)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package nest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Returns the JSON names of the fields declared on the struct pointed to
+// by v.
+func jsonFieldNames(v interface{}) map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// Decodes the JSON object in data into the struct pointed to by v, one
+// field at a time, so that a field with the wrong type doesn't lose the
+// rest of the object. Returns the fields that aren't in known, along with a
+// description of each field that couldn't be decoded.
+func decodeFields(data []byte, known map[string]bool, v interface{}) (map[string]interface{}, []string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+
+	problems := []string{}
+	for name, value := range raw {
+		if !known[name] {
+			continue
+		}
+		delete(raw, name)
+		field, _ := json.Marshal(map[string]interface{}{name: value})
+		check := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err := json.Unmarshal(field, check); err != nil {
+			problems = append(problems, fmt.Sprintf("%s has invalid value %v", name, value))
+			continue
+		}
+		json.Unmarshal(field, v)
+	}
+	return raw, problems, nil
+}
+
+// Returns the JSON fields of v merged over raw.
+func mergeFields(raw map[string]interface{}, v interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for k, val := range raw {
+		fields[k] = val
+	}
+	data, _ := json.Marshal(v)
+	var known map[string]interface{}
+	json.Unmarshal(data, &known)
+	for k, val := range known {
+		fields[k] = val
+	}
+	return fields
+}
@@ -0,0 +1,133 @@
+package nest_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+	"github.com/bklimt/relay/nest/nesttest"
+)
+
+func newFake(t *testing.T) *nesttest.Server {
+	fake := nesttest.NewServer("client-id", "client-secret")
+	t.Cleanup(fake.Close)
+
+	data := &nest.Data{}
+	data.Devices.Thermostats = map[string]*nest.Thermostat{
+		"therm1": {Name: "Hall", AmbientTemperatureF: nest.Float(68)},
+	}
+	fake.AddUser("user1", "code1", "token1", data)
+	return fake
+}
+
+func TestAuthorizationURL(t *testing.T) {
+	fake := newFake(t)
+
+	authURL, err := url.Parse(fake.Client().AuthorizationURL("client-id", "state1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL.String(), fake.URL+"/login/oauth2?") {
+		t.Errorf("unexpected authorization URL %s", authURL)
+	}
+	if got := authURL.Query().Get("client_id"); got != "client-id" {
+		t.Errorf("client_id is %q, want client-id", got)
+	}
+	if got := authURL.Query().Get("state"); got != "state1" {
+		t.Errorf("state is %q, want state1", got)
+	}
+}
+
+func TestGetAccessTokenAndData(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	ctx := context.Background()
+
+	token, expiry, err := client.GetAccessToken(ctx, "client-id", "client-secret", "code1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token1" {
+		t.Errorf("token is %q, want token1", token)
+	}
+	if !expiry.After(time.Now()) {
+		t.Errorf("token expires in the past, at %s", expiry)
+	}
+
+	data, err := client.GetData(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Metadata.UserID != "user1" {
+		t.Errorf("user ID is %q, want user1", data.Metadata.UserID)
+	}
+	therm := data.Devices.Thermostats["therm1"]
+	if therm == nil || therm.Name != "Hall" {
+		t.Fatalf("thermostat therm1 is missing or misnamed: %+v", therm)
+	}
+	if therm.AmbientTemperatureC == nil || *therm.AmbientTemperatureC != 20 {
+		t.Errorf("ambient temperature wasn't converted to 20C: %v", therm.AmbientTemperatureC)
+	}
+	if fake.DataRequests() != 1 {
+		t.Errorf("served %d data requests, want 1", fake.DataRequests())
+	}
+}
+
+func TestGetAccessTokenRejectsBadCode(t *testing.T) {
+	fake := newFake(t)
+	ctx := context.Background()
+
+	if _, _, err := fake.Client().GetAccessToken(ctx, "client-id", "client-secret", "bogus"); err == nil {
+		t.Fatal("got a token for an unknown code")
+	}
+
+	// Codes can only be used once.
+	if _, _, err := fake.Client().GetAccessToken(ctx, "client-id", "client-secret", "code1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fake.Client().GetAccessToken(ctx, "client-id", "client-secret", "code1"); err == nil {
+		t.Fatal("got a second token for the same code")
+	}
+}
+
+func TestGetDataRejectsBadToken(t *testing.T) {
+	fake := newFake(t)
+
+	_, err := fake.Client().GetData(context.Background(), "bogus")
+	if err == nil {
+		t.Fatal("got data for an unknown token")
+	}
+	if status := common.Status(err); status != http.StatusForbidden {
+		t.Errorf("status is %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// A server that doesn't answer until the test is over.
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+	client := &nest.Client{
+		TokenURL:   slow.URL,
+		APIURL:     slow.URL,
+		HTTPClient: slow.Client(),
+		Timeout:    50 * time.Millisecond,
+	}
+	ctx := context.Background()
+
+	if _, _, err := client.GetAccessToken(ctx, "client-id", "client-secret", "code1"); err == nil {
+		t.Error("got a token from a server that never answered")
+	}
+	if _, err := client.GetData(ctx, "token1"); err == nil {
+		t.Error("got data from a server that never answered")
+	}
+}
@@ -0,0 +1,222 @@
+// Package nesttest provides a fake Nest API server for hermetic tests.
+package nesttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bklimt/relay/nest"
+)
+
+// Server is a fake Nest API. It serves the oauth access token endpoint at
+// /oauth2/access_token, the data endpoint at /, and thermostat updates at
+// /devices/thermostats/{id}.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	codes  map[string]string     // authorization code -> access token
+	data   map[string]*nest.Data // access token -> data
+	tokens int                   // number of tokens issued
+	gets   int                   // number of data requests served
+
+	updates map[string][]map[string]interface{} // device ID -> values PUT
+}
+
+// Starts a new fake Nest server that accepts the given client credentials.
+// Callers should call Close when done.
+func NewServer(clientID, clientSecret string) *Server {
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		codes:        map[string]string{},
+		data:         map[string]*nest.Data{},
+		updates:      map[string][]map[string]interface{}{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/access_token", s.handleAccessToken)
+	mux.HandleFunc("/devices/thermostats/", s.handleThermostat)
+	mux.HandleFunc("/", s.handleData)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Returns a nest.Client that talks to this server.
+func (s *Server) Client() *nest.Client {
+	return &nest.Client{
+		AuthURL:    s.URL + "/login/oauth2",
+		TokenURL:   s.URL + "/oauth2/access_token",
+		APIURL:     s.URL + "/",
+		HTTPClient: s.Server.Client(),
+		Timeout:    10 * time.Second,
+	}
+}
+
+// Registers a user. Exchanging code at the token endpoint yields
+// accessToken, and fetching data with accessToken returns data with its
+// metadata filled in.
+func (s *Server) AddUser(userID, code, accessToken string, data *nest.Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data.Metadata.UserID = userID
+	data.Metadata.AccessToken = accessToken
+	s.codes[code] = accessToken
+	s.data[accessToken] = data
+}
+
+// Replaces the data returned for the given access token.
+func (s *Server) SetData(accessToken string, data *nest.Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.data[accessToken]; ok {
+		data.Metadata = old.Metadata
+	}
+	s.data[accessToken] = data
+}
+
+// Returns the number of access tokens issued so far.
+func (s *Server) TokensIssued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens
+}
+
+// Returns the number of data requests served so far.
+func (s *Server) DataRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+// Returns the values PUT to the given thermostat so far, in order.
+func (s *Server) Updates(deviceID string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]interface{}{}, s.updates[deviceID]...)
+}
+
+// Returns the data for the bearer token in the request, or writes an error
+// and returns nil. s.mu must be held.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) *nest.Data {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		http.Error(w, "missing access token", http.StatusUnauthorized)
+		return nil
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	data, ok := s.data[token]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown access token %q", token), http.StatusUnauthorized)
+		return nil
+	}
+	return data
+}
+
+func (s *Server) handleAccessToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		http.Error(w, "unsupported grant type", http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("client_id") != s.ClientID || r.PostForm.Get("client_secret") != s.ClientSecret {
+		http.Error(w, "invalid client", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := r.PostForm.Get("code")
+	token, ok := s.codes[code]
+	if !ok {
+		http.Error(w, "invalid code", http.StatusBadRequest)
+		return
+	}
+	// Codes can only be used once.
+	delete(s.codes, code)
+	s.tokens++
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"expires_in":   315360000,
+	})
+}
+
+func (s *Server) handleData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.authorize(w, r)
+	if data == nil {
+		return
+	}
+	s.gets++
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// Applies the values in the request body to the thermostat, the way the Nest
+// API does, so later data requests see them.
+func (s *Server) handleThermostat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.authorize(w, r)
+	if data == nil {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/devices/thermostats/")
+	therm, ok := data.Devices.Thermostats[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown thermostat %q", id), http.StatusNotFound)
+		return
+	}
+
+	var values map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields := therm.Fields()
+	for k, v := range values {
+		fields[k] = v
+	}
+	updated, err := json.Marshal(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	therm = &nest.Thermostat{}
+	if err := json.Unmarshal(updated, therm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.Devices.Thermostats[id] = therm
+	s.updates[id] = append(s.updates[id], values)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
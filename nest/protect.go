@@ -0,0 +1,62 @@
+package nest
+
+import (
+	"encoding/json"
+)
+
+// SmokeCOAlarm is a Nest Protect as returned by the Works with Nest API.
+// Fields that aren't declared here are kept in Raw and passed through
+// untouched.
+type SmokeCOAlarm struct {
+	DeviceID           string `json:"device_id,omitempty"`
+	Locale             string `json:"locale,omitempty"`
+	SoftwareVersion    string `json:"software_version,omitempty"`
+	StructureID        string `json:"structure_id,omitempty"`
+	Name               string `json:"name,omitempty"`
+	NameLong           string `json:"name_long,omitempty"`
+	LastConnection     string `json:"last_connection,omitempty"`
+	IsOnline           *bool  `json:"is_online,omitempty"`
+	BatteryHealth      string `json:"battery_health,omitempty"`    // "ok" or "replace".
+	COAlarmState       string `json:"co_alarm_state,omitempty"`    // "ok", "warning", or "emergency".
+	SmokeAlarmState    string `json:"smoke_alarm_state,omitempty"` // "ok", "warning", or "emergency".
+	IsManualTestActive *bool  `json:"is_manual_test_active,omitempty"`
+	LastManualTestTime string `json:"last_manual_test_time,omitempty"`
+	UIColorState       string `json:"ui_color_state,omitempty"` // "gray", "green", "yellow", or "red".
+	WhereID            string `json:"where_id,omitempty"`
+	WhereName          string `json:"where_name,omitempty"`
+
+	// Every field returned by the API that isn't declared above.
+	Raw map[string]interface{} `json:"-"`
+
+	// Problems found while parsing the alarm. Fields with problems are left
+	// unset.
+	Problems []string `json:"-"`
+}
+
+// Used to marshal and unmarshal without recursing into SmokeCOAlarm's own
+// methods.
+type smokeCOAlarmFieldsOnly SmokeCOAlarm
+
+var smokeCOAlarmFields = jsonFieldNames(&smokeCOAlarmFieldsOnly{})
+
+func (a *SmokeCOAlarm) UnmarshalJSON(data []byte) error {
+	parsed := smokeCOAlarmFieldsOnly{}
+	raw, problems, err := decodeFields(data, smokeCOAlarmFields, &parsed)
+	if err != nil {
+		return err
+	}
+	*a = SmokeCOAlarm(parsed)
+	a.Raw = raw
+	a.Problems = problems
+	return nil
+}
+
+func (a *SmokeCOAlarm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Fields())
+}
+
+// Returns every field of the alarm, including the ones in Raw, keyed by
+// JSON name.
+func (a *SmokeCOAlarm) Fields() map[string]interface{} {
+	return mergeFields(a.Raw, (*smokeCOAlarmFieldsOnly)(a))
+}
@@ -0,0 +1,67 @@
+package nest
+
+import (
+	"encoding/json"
+)
+
+// ETA is a user's estimated arrival at a structure.
+type ETA struct {
+	TripID                      string `json:"trip_id,omitempty"`
+	EstimatedArrivalWindowBegin string `json:"estimated_arrival_window_begin,omitempty"`
+	EstimatedArrivalWindowEnd   string `json:"estimated_arrival_window_end,omitempty"`
+}
+
+// Structure is a home as returned by the Works with Nest API. Fields that
+// aren't declared here are kept in Raw and passed through untouched.
+type Structure struct {
+	StructureID         string   `json:"structure_id,omitempty"`
+	Name                string   `json:"name,omitempty"`
+	Away                string   `json:"away,omitempty"` // "home", "away", or "unknown".
+	CountryCode         string   `json:"country_code,omitempty"`
+	PostalCode          string   `json:"postal_code,omitempty"`
+	TimeZone            string   `json:"time_zone,omitempty"`
+	Thermostats         []string `json:"thermostats,omitempty"`
+	SmokeCOAlarms       []string `json:"smoke_co_alarms,omitempty"`
+	Cameras             []string `json:"cameras,omitempty"`
+	ETA                 *ETA     `json:"eta,omitempty"`
+	ETABegin            string   `json:"eta_begin,omitempty"`
+	RHREnrollment       *bool    `json:"rhr_enrollment,omitempty"`
+	PeakPeriodStartTime string   `json:"peak_period_start_time,omitempty"`
+	PeakPeriodEndTime   string   `json:"peak_period_end_time,omitempty"`
+	WWNSecurityState    string   `json:"wwn_security_state,omitempty"`
+
+	// Every field returned by the API that isn't declared above.
+	Raw map[string]interface{} `json:"-"`
+
+	// Problems found while parsing the structure. Fields with problems are
+	// left unset.
+	Problems []string `json:"-"`
+}
+
+// Used to marshal and unmarshal without recursing into Structure's own
+// methods.
+type structureFieldsOnly Structure
+
+var structureFields = jsonFieldNames(&structureFieldsOnly{})
+
+func (s *Structure) UnmarshalJSON(data []byte) error {
+	parsed := structureFieldsOnly{}
+	raw, problems, err := decodeFields(data, structureFields, &parsed)
+	if err != nil {
+		return err
+	}
+	*s = Structure(parsed)
+	s.Raw = raw
+	s.Problems = problems
+	return nil
+}
+
+func (s *Structure) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Fields())
+}
+
+// Returns every field of the structure, including the ones in Raw, keyed by
+// JSON name.
+func (s *Structure) Fields() map[string]interface{} {
+	return mergeFields(s.Raw, (*structureFieldsOnly)(s))
+}
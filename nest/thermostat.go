@@ -0,0 +1,221 @@
+package nest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Thermostat is a thermostat as returned by the Works with Nest API.
+//
+// Numeric and boolean fields are pointers, since Nest omits some of them
+// depending on the thermostat's mode and capabilities, and a missing
+// temperature should not be recorded as zero, nor a missing flag as false. Fields that aren't declared here are kept in Raw
+// and passed through untouched.
+type Thermostat struct {
+	Humidity                  *float64 `json:"humidity,omitempty"`
+	Locale                    string   `json:"locale,omitempty"`
+	TemperatureScale          string   `json:"temperature_scale,omitempty"`
+	IsUsingEmergencyHeat      *bool    `json:"is_using_emergency_heat,omitempty"`
+	HasFan                    *bool    `json:"has_fan,omitempty"`
+	SoftwareVersion           string   `json:"software_version,omitempty"`
+	HasLeaf                   *bool    `json:"has_leaf,omitempty"`
+	DeviceID                  string   `json:"device_id,omitempty"`
+	Name                      string   `json:"name,omitempty"`
+	CanHeat                   *bool    `json:"can_heat,omitempty"`
+	CanCool                   *bool    `json:"can_cool,omitempty"`
+	TargetTemperatureC        *float64 `json:"target_temperature_c,omitempty"`
+	TargetTemperatureF        *float64 `json:"target_temperature_f,omitempty"`
+	TargetTemperatureHighC    *float64 `json:"target_temperature_high_c,omitempty"`
+	TargetTemperatureHighF    *float64 `json:"target_temperature_high_f,omitempty"`
+	TargetTemperatureLowC     *float64 `json:"target_temperature_low_c,omitempty"`
+	TargetTemperatureLowF     *float64 `json:"target_temperature_low_f,omitempty"`
+	AmbientTemperatureC       *float64 `json:"ambient_temperature_c,omitempty"`
+	AmbientTemperatureF       *float64 `json:"ambient_temperature_f,omitempty"`
+	AwayTemperatureHighC      *float64 `json:"away_temperature_high_c,omitempty"`
+	AwayTemperatureHighF      *float64 `json:"away_temperature_high_f,omitempty"`
+	AwayTemperatureLowC       *float64 `json:"away_temperature_low_c,omitempty"`
+	AwayTemperatureLowF       *float64 `json:"away_temperature_low_f,omitempty"`
+	EcoTemperatureHighC       *float64 `json:"eco_temperature_high_c,omitempty"`
+	EcoTemperatureHighF       *float64 `json:"eco_temperature_high_f,omitempty"`
+	EcoTemperatureLowC        *float64 `json:"eco_temperature_low_c,omitempty"`
+	EcoTemperatureLowF        *float64 `json:"eco_temperature_low_f,omitempty"`
+	IsLocked                  *bool    `json:"is_locked,omitempty"`
+	LockedTempMinC            *float64 `json:"locked_temp_min_c,omitempty"`
+	LockedTempMinF            *float64 `json:"locked_temp_min_f,omitempty"`
+	LockedTempMaxC            *float64 `json:"locked_temp_max_c,omitempty"`
+	LockedTempMaxF            *float64 `json:"locked_temp_max_f,omitempty"`
+	SunlightCorrectionActive  *bool    `json:"sunlight_correction_active,omitempty"`
+	SunlightCorrectionEnabled *bool    `json:"sunlight_correction_enabled,omitempty"`
+	StructureID               string   `json:"structure_id,omitempty"`
+	FanTimerActive            *bool    `json:"fan_timer_active,omitempty"`
+	FanTimerTimeout           string   `json:"fan_timer_timeout,omitempty"`
+	FanTimerDuration          *float64 `json:"fan_timer_duration,omitempty"`
+	PreviousHVACMode          string   `json:"previous_hvac_mode,omitempty"`
+	HVACMode                  string   `json:"hvac_mode,omitempty"`
+	TimeToTarget              string   `json:"time_to_target,omitempty"`
+	TimeToTargetTraining      string   `json:"time_to_target_training,omitempty"`
+	Label                     string   `json:"label,omitempty"`
+	NameLong                  string   `json:"name_long,omitempty"`
+	IsOnline                  *bool    `json:"is_online,omitempty"`
+	LastConnection            string   `json:"last_connection,omitempty"`
+	HVACState                 string   `json:"hvac_state,omitempty"`
+
+	// Every field returned by the API that isn't declared above.
+	Raw map[string]interface{} `json:"-"`
+
+	// Problems found while parsing or validating the thermostat. Fields with
+	// problems are left unset rather than recorded with bad values.
+	Problems []string `json:"-"`
+}
+
+// Used to marshal and unmarshal without recursing into Thermostat's own
+// methods.
+type thermostatFieldsOnly Thermostat
+
+var thermostatFields = jsonFieldNames(&thermostatFieldsOnly{})
+
+func (t *Thermostat) UnmarshalJSON(data []byte) error {
+	parsed := thermostatFieldsOnly{}
+	raw, problems, err := decodeFields(data, thermostatFields, &parsed)
+	if err != nil {
+		return err
+	}
+	*t = Thermostat(parsed)
+	t.Raw = raw
+	t.Problems = problems
+	t.Validate()
+	return nil
+}
+
+func (t *Thermostat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Fields())
+}
+
+// Returns every field of the thermostat, including the ones in Raw, keyed
+// by JSON name. Numbers are always float64, so that they are stored with
+// the same type no matter how the API formatted them.
+func (t *Thermostat) Fields() map[string]interface{} {
+	return mergeFields(t.Raw, (*thermostatFieldsOnly)(t))
+}
+
+// Returns every temperature field, keyed by JSON name without the unit
+// suffix, as a pair of Celsius and Fahrenheit pointers.
+func (t *Thermostat) temperatures() map[string][2]**float64 {
+	return map[string][2]**float64{
+		"target_temperature":      {&t.TargetTemperatureC, &t.TargetTemperatureF},
+		"target_temperature_high": {&t.TargetTemperatureHighC, &t.TargetTemperatureHighF},
+		"target_temperature_low":  {&t.TargetTemperatureLowC, &t.TargetTemperatureLowF},
+		"ambient_temperature":     {&t.AmbientTemperatureC, &t.AmbientTemperatureF},
+		"away_temperature_high":   {&t.AwayTemperatureHighC, &t.AwayTemperatureHighF},
+		"away_temperature_low":    {&t.AwayTemperatureLowC, &t.AwayTemperatureLowF},
+		"eco_temperature_high":    {&t.EcoTemperatureHighC, &t.EcoTemperatureHighF},
+		"eco_temperature_low":     {&t.EcoTemperatureLowC, &t.EcoTemperatureLowF},
+		"locked_temp_min":         {&t.LockedTempMinC, &t.LockedTempMinF},
+		"locked_temp_max":         {&t.LockedTempMaxC, &t.LockedTempMaxF},
+	}
+}
+
+// The range of temperatures, in Celsius, that any Nest thermostat field can
+// plausibly hold. Anything outside of it is a bug.
+const (
+	minCelsius = -40
+	maxCelsius = 60
+)
+
+// Checks that numeric fields are in range, clearing any that aren't and
+// recording why in Problems. Then fills in any temperature that is only
+// present in one unit. Returns false if there were any problems.
+func (t *Thermostat) Validate() bool {
+	if t.Humidity != nil && (*t.Humidity < 0 || *t.Humidity > 100) {
+		t.Problems = append(t.Problems, fmt.Sprintf("humidity %v is out of range", *t.Humidity))
+		t.Humidity = nil
+	}
+	if t.FanTimerDuration != nil && *t.FanTimerDuration < 0 {
+		t.Problems = append(t.Problems, fmt.Sprintf("fan_timer_duration %v is negative", *t.FanTimerDuration))
+		t.FanTimerDuration = nil
+	}
+	switch t.TemperatureScale {
+	case "", "C", "F":
+	default:
+		t.Problems = append(t.Problems, fmt.Sprintf("temperature_scale %q is not C or F", t.TemperatureScale))
+		t.TemperatureScale = ""
+	}
+
+	for name, pair := range t.temperatures() {
+		c, f := pair[0], pair[1]
+		if *c != nil && (**c < minCelsius || **c > maxCelsius) {
+			t.Problems = append(t.Problems, fmt.Sprintf("%s_c %v is out of range", name, **c))
+			*c = nil
+		}
+		if *f != nil && (**f < CelsiusToFahrenheit(minCelsius) || **f > CelsiusToFahrenheit(maxCelsius)) {
+			t.Problems = append(t.Problems, fmt.Sprintf("%s_f %v is out of range", name, **f))
+			*f = nil
+		}
+		if *c != nil && *f == nil {
+			v := RoundFahrenheit(CelsiusToFahrenheit(**c))
+			*f = &v
+		}
+		if *f != nil && *c == nil {
+			v := RoundCelsius(FahrenheitToCelsius(**f))
+			*c = &v
+		}
+	}
+
+	return len(t.Problems) == 0
+}
+
+// Returns the temperature from the pair of fields in the thermostat's own
+// temperature_scale, defaulting to Celsius if it doesn't have one.
+func (t *Thermostat) InScale(celsius, fahrenheit *float64) (float64, bool) {
+	v := celsius
+	if t.TemperatureScale == "F" {
+		v = fahrenheit
+	}
+	if v == nil {
+		return 0, false
+	}
+	return *v, true
+}
+
+// Sets a pair of Celsius and Fahrenheit fields from a temperature in
+// Celsius, rounded the way Nest rounds them.
+func SetTemperature(celsius, fahrenheit **float64, c float64) {
+	rc := RoundCelsius(c)
+	rf := RoundFahrenheit(CelsiusToFahrenheit(c))
+	*celsius = &rc
+	*fahrenheit = &rf
+}
+
+func CelsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+func FahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// Nest reports Celsius to the nearest half degree.
+func RoundCelsius(c float64) float64 {
+	return math.Round(c*2) / 2
+}
+
+// Nest reports Fahrenheit to the nearest degree.
+func RoundFahrenheit(f float64) float64 {
+	return math.Round(f)
+}
+
+// Returns a pointer to v, for setting numeric fields.
+func Float(v float64) *float64 {
+	return &v
+}
+
+// Returns a pointer to v, for setting boolean fields.
+func Bool(v bool) *bool {
+	return &v
+}
+
+// Returns whether b is set and true.
+func IsTrue(b *bool) bool {
+	return b != nil && *b
+}
@@ -0,0 +1,93 @@
+package nest
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestThermostatUnmarshal(t *testing.T) {
+	var therm Thermostat
+	err := json.Unmarshal([]byte(`{
+		"name": "Hall",
+		"humidity": "45",
+		"ambient_temperature_f": 68,
+		"target_temperature_c": 21,
+		"temperature_scale": "F",
+		"locked_temp_min_c": 500,
+		"new_field": 1
+	}`), &therm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if therm.Name != "Hall" {
+		t.Errorf("name is %q, want Hall", therm.Name)
+	}
+	// A string where a number belongs, and a temperature out of range.
+	if therm.Humidity != nil || therm.LockedTempMinC != nil {
+		t.Errorf("invalid fields were kept: humidity %v, locked_temp_min_c %v", therm.Humidity, therm.LockedTempMinC)
+	}
+	if len(therm.Problems) != 2 {
+		t.Errorf("got problems %v, want 2", therm.Problems)
+	}
+	// Each temperature is filled in for the unit that was missing.
+	if therm.AmbientTemperatureC == nil || *therm.AmbientTemperatureC != 20 {
+		t.Errorf("ambient_temperature_c is %v, want 20", therm.AmbientTemperatureC)
+	}
+	if therm.TargetTemperatureF == nil || *therm.TargetTemperatureF != 70 {
+		t.Errorf("target_temperature_f is %v, want 70", therm.TargetTemperatureF)
+	}
+	if v, ok := therm.InScale(therm.AmbientTemperatureC, therm.AmbientTemperatureF); !ok || v != 68 {
+		t.Errorf("ambient temperature in F is %v, want 68", v)
+	}
+	if therm.Raw["new_field"] != 1.0 {
+		t.Errorf("unknown field wasn't passed through: %v", therm.Raw)
+	}
+}
+
+func TestThermostatFieldsAreTyped(t *testing.T) {
+	var therm Thermostat
+	if err := json.Unmarshal([]byte(`{"humidity": 45, "ambient_temperature_c": 20, "humidity_x": "y", "hvac_mode": 3}`), &therm); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := therm.Fields()
+	// Integers from the API are written as float64, like any other number.
+	if _, ok := fields["humidity"].(float64); !ok {
+		t.Errorf("humidity is %T, want float64", fields["humidity"])
+	}
+	if _, ok := fields["ambient_temperature_f"].(float64); !ok {
+		t.Errorf("ambient_temperature_f is %T, want float64", fields["ambient_temperature_f"])
+	}
+	// A declared field with the wrong type is left out, not written as is.
+	if v, ok := fields["hvac_mode"]; ok {
+		t.Errorf("hvac_mode was written as %v", v)
+	}
+	// Missing numbers aren't written as zero.
+	if v, ok := fields["target_temperature_c"]; ok {
+		t.Errorf("target_temperature_c was written as %v", v)
+	}
+	if fields["humidity_x"] != "y" {
+		t.Errorf("unknown field wasn't passed through: %v", fields)
+	}
+}
+
+func TestAlarmAndCameraUnmarshal(t *testing.T) {
+	var data Data
+	err := json.Unmarshal([]byte(`{"devices": {
+		"smoke_co_alarms": {"a": {"name": "Hall", "co_alarm_state": "emergency", "x": 2}},
+		"cameras": {"c": {"name": "Door", "is_streaming": true, "last_event": {"has_motion": true}}}
+	}}`), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alarm := data.Devices.SmokeCOAlarms["a"]
+	if alarm.COAlarmState != "emergency" || alarm.Raw["x"] != 2.0 {
+		t.Errorf("alarm wasn't parsed: %+v", alarm)
+	}
+	camera := data.Devices.Cameras["c"]
+	if !IsTrue(camera.IsStreaming) || camera.LastEvent == nil || !IsTrue(camera.LastEvent.HasMotion) {
+		t.Errorf("camera wasn't parsed: %+v", camera)
+	}
+}
@@ -0,0 +1,257 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// The events that notifications are sent for.
+const (
+	EventStale     = "stale"     // A device stopped logging.
+	EventRecovered = "recovered" // A stale device started logging again.
+	EventAlarming  = "alarming"  // A Nest Protect's smoke or CO alarm went off.
+	EventClear     = "clear"     // An alarm that went off is ok again.
+)
+
+// Notification says that a device has gone stale or recovered, or that one
+// of its alarms has gone off or cleared.
+type Notification struct {
+	Device    string    `json:"device"`
+	Event     string    `json:"event"`
+	LastSeen  time.Time `json:"last_seen"`         // When the device last logged.
+	Threshold float64   `json:"threshold_seconds"` // How long it may go without logging.
+	Field     string    `json:"field,omitempty"`   // The alarm, such as "co_alarm_state".
+	State     string    `json:"state,omitempty"`   // The alarm's state, such as "emergency".
+	Time      time.Time `json:"time"`              // When the change was noticed.
+	Text      string    `json:"text"`              // A description, for people.
+}
+
+// Returns a notification for the given event, with its text filled in.
+func newNotification(device, event string, lastSeen time.Time, threshold time.Duration, now time.Time) *Notification {
+	n := &Notification{
+		Device:    device,
+		Event:     event,
+		LastSeen:  lastSeen,
+		Threshold: threshold.Seconds(),
+		Time:      now,
+	}
+	silent := now.Sub(lastSeen).Round(time.Second)
+	if event == EventStale {
+		n.Text = fmt.Sprintf("Device %s has not logged for %s, since %s.", device, silent, lastSeen.Format(time.RFC3339))
+	} else {
+		n.Text = fmt.Sprintf("Device %s is logging again, as of %s.", device, lastSeen.Format(time.RFC3339))
+	}
+	return n
+}
+
+// Returns a notification that the given alarm of a device, last logged at
+// lastSeen, has changed to state.
+func newAlarmNotification(device, field, state string, lastSeen, now time.Time) *Notification {
+	n := &Notification{
+		Device:   device,
+		Event:    EventAlarming,
+		LastSeen: lastSeen,
+		Field:    field,
+		State:    state,
+		Time:     now,
+	}
+	if state == "ok" {
+		n.Event = EventClear
+		n.Text = fmt.Sprintf("Device %s %s is ok again.", device, field)
+	} else {
+		n.Text = fmt.Sprintf("Device %s has %s %q.", device, field, state)
+	}
+	return n
+}
+
+// Alerts is the config for noticing devices that have stopped logging, and
+// for telling people about them.
+type Alerts struct {
+	// How long a device may go without logging before it's stale.
+	StaleAfterSeconds int `json:"staleAfterSeconds"`
+	// Thresholds for particular devices, by name, overriding
+	// StaleAfterSeconds. A negative threshold never goes stale.
+	Devices map[string]int `json:"devices"`
+
+	Webhooks []*WebhookNotifier `json:"webhooks"`
+	Email    *EmailNotifier     `json:"email"`
+}
+
+// Returns every notifier in the config.
+func (a *Alerts) Notifiers() []Notifier {
+	notifiers := []Notifier{}
+	for _, webhook := range a.Webhooks {
+		notifiers = append(notifiers, webhook)
+	}
+	if a.Email != nil {
+		notifiers = append(notifiers, a.Email)
+	}
+	return notifiers
+}
+
+// Returns how long the named device may go without logging before it's
+// stale, or zero if it never goes stale.
+func (a *Alerts) threshold(name string) time.Duration {
+	seconds := a.StaleAfterSeconds
+	if s, ok := a.Devices[name]; ok {
+		seconds = s
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Notifier sends notifications somewhere people will see them.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// WebhookNotifier POSTs each notification as JSON to a URL. The "text"
+// field makes it work with chat webhooks, like Slack's, as well.
+type WebhookNotifier struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"` // Extra headers, e.g. for authorization.
+}
+
+// How long a webhook may take.
+const webhookTimeout = 10 * time.Second
+
+func (wh *WebhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to encode notification: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to create webhook request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range wh.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return common.Errorf(http.StatusBadGateway, "unable to call webhook: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return common.Errorf(http.StatusBadGateway, "webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailNotifier emails each notification through an SMTP server.
+type EmailNotifier struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`     // Defaults to 587.
+	Username string   `json:"username"` // If empty, no authentication is used.
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// How long sending an email may take.
+const emailTimeout = 30 * time.Second
+
+func (e *EmailNotifier) Notify(ctx context.Context, n *Notification) error {
+	port := e.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, e.Password, e.Host)
+	}
+
+	subject := fmt.Sprintf("relay: %s is %s", n.Device, n.Event)
+	message := strings.Join([]string{
+		"From: " + e.From,
+		"To: " + strings.Join(e.To, ", "),
+		"Subject: " + subject,
+		"Date: " + n.Time.Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		n.Text,
+		"",
+	}, "\r\n")
+
+	ctx, cancel := context.WithTimeout(ctx, emailTimeout)
+	defer cancel()
+	addr := fmt.Sprintf("%s:%d", e.Host, port)
+	if err := e.send(ctx, addr, auth, []byte(message)); err != nil {
+		return common.Errorf(http.StatusBadGateway, "unable to send email through %s: %s", addr, err)
+	}
+	return nil
+}
+
+// Sends message like smtp.SendMail, except that it gives up when ctx is
+// done, so that a server that stops responding can't hang the checkup.
+func (e *EmailNotifier) send(ctx context.Context, addr string, auth smtp.Auth, message []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Closing the connection interrupts whatever is waiting on it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: e.Host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNotification() *Notification {
+	now := time.Now().UTC()
+	return newNotification("garage", EventStale, now.Add(-2*time.Hour), time.Hour, now)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan *Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		n := &Notification{}
+		if err := json.NewDecoder(r.Body).Decode(n); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- n
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	webhook := &WebhookNotifier{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer secret"}}
+	if err := webhook.Notify(ctx, testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-received; n.Device != "garage" || n.Event != EventStale || n.Threshold != 3600 || n.Text == "" {
+		t.Errorf("unexpected notification %+v", n)
+	}
+
+	webhook.Headers = nil
+	if err := webhook.Notify(ctx, testNotification()); err == nil {
+		t.Errorf("a rejected webhook didn't fail")
+	}
+}
+
+// Listens for SMTP on localhost, and returns an EmailNotifier that sends to
+// it. Each connection is passed to serve.
+func smtpServer(t *testing.T, serve func(net.Conn)) *EmailNotifier {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	return &EmailNotifier{Host: "127.0.0.1", Port: port, From: "relay@example.com", To: []string{"me@example.com"}}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	messages := make(chan string, 1)
+	email := smtpServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.Fields(line)[0]); command {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				reply("250 OK")
+			case "DATA":
+				reply("354 Go ahead")
+				var message strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					message.WriteString(line)
+				}
+				messages <- message.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	})
+
+	if err := email.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	message := <-messages
+	if !strings.Contains(message, "Subject: relay: garage is stale\r\n") || !strings.Contains(message, "Device garage has not logged") {
+		t.Errorf("unexpected message %q", message)
+	}
+}
+
+func TestEmailNotifierGivesUp(t *testing.T) {
+	// The server accepts connections, but never says anything.
+	done := make(chan bool)
+	defer close(done)
+	email := smtpServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		<-done
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := email.Notify(ctx, testNotification()); err == nil {
+		t.Fatal("sent email through a server that never responded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up, want about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lastNestPollTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "relay_nest_last_poll_timestamp_seconds",
+		Help: "When Nest data was last polled, in Unix seconds.",
+	})
+	nestPollFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_nest_poll_failures",
+		Help: "How many times in a row polling each user has failed.",
+	}, []string{"user"})
+)
+
+// Poller periodically fetches every user's Nest data and logs it, so that
+// slow or failing Nest calls never hold up requests from sensors.
+type Poller struct {
+	Store     Store
+	Providers map[string]Provider
+
+	Interval    time.Duration // How often to poll.
+	Concurrency int           // How many users to poll at once.
+	MaxBackoff  time.Duration // The longest to wait before retrying a failing user.
+
+	mu       sync.Mutex
+	failures map[string]int       // user ID -> consecutive failures
+	retryAt  map[string]time.Time // user ID -> when to try again after a failure
+}
+
+func NewPoller(store Store, providers map[string]Provider, cfg *Config) *Poller {
+	return &Poller{
+		Store:       store,
+		Providers:   providers,
+		Interval:    time.Duration(cfg.NestPollIntervalSeconds) * time.Second,
+		Concurrency: cfg.NestPollConcurrency,
+		MaxBackoff:  time.Duration(cfg.NestPollMaxBackoffSeconds) * time.Second,
+		failures:    map[string]int{},
+		retryAt:     map[string]time.Time{},
+	}
+}
+
+// Fetches and logs the data for every user who isn't backing off at now, and
+// waits for them all to finish.
+func (p *Poller) PollOnce(ctx context.Context, now time.Time) {
+	key := KeyForNow()
+	lastNestPollTime.SetToCurrentTime()
+
+	users, err := GetNestUsers(ctx, p.Store)
+	if err != nil {
+		log.Printf("Unable to get users to poll: %s", err)
+		return
+	}
+
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for id, user := range users {
+		// Users who need to log in again are reported by the checkup.
+		if user.NeedsReauth || !p.ready(id, now) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string, user *User) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.pollUser(ctx, key, id, user, now)
+		}(id, user)
+	}
+	wg.Wait()
+}
+
+func (p *Poller) pollUser(ctx context.Context, key string, id string, user *User, now time.Time) {
+	data, err := FetchNestData(ctx, p.Store, p.Providers, id, user)
+	if err == nil {
+		err = LogNestData(ctx, p.Store, key, data)
+	}
+	if err != nil {
+		delay := p.failed(id, now)
+		log.Printf("Unable to poll Nest data for user %s, retrying in %s: %s", id, delay, err)
+		return
+	}
+	p.succeeded(id)
+}
+
+// Returns whether the user's backoff, if any, has passed.
+func (p *Poller) ready(id string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !now.Before(p.retryAt[id])
+}
+
+// Records a failure for the user at now and returns how long to back off,
+// which doubles with each consecutive failure.
+func (p *Poller) failed(id string, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[id]++
+	delay := p.Interval
+	for i := 1; i < p.failures[id] && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	p.retryAt[id] = now.Add(delay)
+
+	nestPollFailures.WithLabelValues(id).Set(float64(p.failures[id]))
+	return delay
+}
+
+func (p *Poller) succeeded(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failures, id)
+	delete(p.retryAt, id)
+	nestPollFailures.DeleteLabelValues(id)
+}
+
+// Polls every Interval until ctx is cancelled.
+func (p *Poller) PollForever(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		p.PollOnce(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
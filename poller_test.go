@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+)
+
+// fakeProvider is a Provider whose data fetches fail a given number of times
+// before they succeed, and which records how many run at once.
+type fakeProvider struct {
+	delay time.Duration // How long each fetch takes.
+
+	mu        sync.Mutex
+	failures  int // How many more fetches fail.
+	calls     int
+	active    int
+	maxActive int
+}
+
+func (p *fakeProvider) AuthorizationURL(state string) string {
+	return ""
+}
+
+func (p *fakeProvider) Exchange(ctx context.Context, code string) (*Token, error) {
+	return nil, common.Errorf(http.StatusNotImplemented, "not implemented")
+}
+
+func (p *fakeProvider) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	return nil, common.Errorf(http.StatusNotImplemented, "not implemented")
+}
+
+func (p *fakeProvider) GetData(ctx context.Context, accessToken string) (*nest.Data, error) {
+	p.mu.Lock()
+	p.calls++
+	p.active++
+	if p.active > p.maxActive {
+		p.maxActive = p.active
+	}
+	fail := p.failures > 0
+	if fail {
+		p.failures--
+	}
+	p.mu.Unlock()
+
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+	if fail {
+		return nil, common.Errorf(http.StatusBadGateway, "provider is down")
+	}
+	return &nest.Data{}, nil
+}
+
+func (p *fakeProvider) SetThermostat(ctx context.Context, accessToken string, therm *nest.Thermostat, cmd *ThermostatCommand) error {
+	return common.Errorf(http.StatusNotImplemented, "not implemented")
+}
+
+func (p *fakeProvider) stats() (calls, maxActive int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls, p.maxActive
+}
+
+// Saves users with access tokens that don't need refreshing.
+func saveUsers(t *testing.T, store Store, users map[string]*User) {
+	for id, user := range users {
+		user.AccessToken = "token-" + id
+		user.Expiry = time.Now().Add(24 * time.Hour)
+		if err := store.SaveUser(context.Background(), id, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPollerBacksOffFailingUsers(t *testing.T) {
+	store := NewMemoryStore()
+	saveUsers(t, store, map[string]*User{
+		"up":     {},
+		"down":   {Provider: SDMProviderName},
+		"reauth": {NeedsReauth: true},
+	})
+	up, down := &fakeProvider{}, &fakeProvider{failures: 5}
+	p := NewPoller(store, map[string]Provider{NestProviderName: up, SDMProviderName: down}, &Config{
+		NestPollIntervalSeconds:   60,
+		NestPollConcurrency:       2,
+		NestPollMaxBackoffSeconds: 300,
+	})
+	ctx := context.Background()
+
+	now := time.Now()
+	polls := 0
+	poll := func(at time.Time) {
+		p.PollOnce(ctx, at)
+		polls++
+	}
+
+	// Each failure doubles the wait before the next try, up to the maximum.
+	for i, delay := range []time.Duration{60, 120, 240, 300, 300} {
+		delay *= time.Second
+		poll(now)
+		if calls, _ := down.stats(); calls != i+1 {
+			t.Fatalf("failing user was fetched %d times by try %d", calls, i+1)
+		}
+		poll(now.Add(delay - time.Second))
+		if calls, _ := down.stats(); calls != i+1 {
+			t.Errorf("failing user was retried before its %s backoff passed", delay)
+		}
+		now = now.Add(delay)
+	}
+
+	// A success resets the backoff, so the next failure only waits one
+	// interval.
+	poll(now)
+	poll(now.Add(time.Second))
+	if calls, _ := down.stats(); calls != 7 {
+		t.Errorf("recovered user was fetched %d times, want 7", calls)
+	}
+	down.mu.Lock()
+	down.failures = 1
+	down.mu.Unlock()
+	now = now.Add(2 * time.Second)
+	poll(now)
+	poll(now.Add(59 * time.Second))
+	poll(now.Add(60 * time.Second))
+	if calls, _ := down.stats(); calls != 9 {
+		t.Errorf("user was fetched %d times after failing again, want 9", calls)
+	}
+
+	// Other users are polled every time, and users who need to log in again
+	// are never polled.
+	if calls, _ := up.stats(); calls != polls {
+		t.Errorf("working user was fetched %d times in %d polls", calls, polls)
+	}
+}
+
+func TestPollerConcurrency(t *testing.T) {
+	store := NewMemoryStore()
+	users := map[string]*User{}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		users[id] = &User{}
+	}
+	saveUsers(t, store, users)
+
+	provider := &fakeProvider{delay: 20 * time.Millisecond}
+	p := NewPoller(store, map[string]Provider{NestProviderName: provider}, &Config{
+		NestPollIntervalSeconds:   60,
+		NestPollConcurrency:       3,
+		NestPollMaxBackoffSeconds: 300,
+	})
+	p.PollOnce(context.Background(), time.Now())
+
+	calls, maxActive := provider.stats()
+	if calls != len(users) {
+		t.Errorf("fetched %d users, want %d", calls, len(users))
+	}
+	if maxActive != 3 {
+		t.Errorf("fetched %d users at once, want 3", maxActive)
+	}
+}
@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+	"github.com/bklimt/relay/sdm"
+)
+
+// Token is a set of oauth credentials for a provider.
+type Token struct {
+	AccessToken  string
+	RefreshToken string    // Empty if the provider doesn't issue refresh tokens.
+	Expiry       time.Time // Zero if the provider didn't say.
+}
+
+// Provider is an API that thermostat data can be read from. Every provider
+// returns data in the shape of the Works with Nest API, so it can all be
+// saved with SaveNestData and LogNestData.
+type Provider interface {
+	// Returns the URL to send a user to in order to log in.
+	AuthorizationURL(state string) string
+	// Exchanges an oauth authorization code for a token.
+	Exchange(ctx context.Context, code string) (*Token, error)
+	// Gets a new token using a refresh token.
+	Refresh(ctx context.Context, refreshToken string) (*Token, error)
+	// Fetches the current data for the user with the given access token.
+	GetData(ctx context.Context, accessToken string) (*nest.Data, error)
+	// Sends a validated command, with temperatures in Celsius, to a
+	// thermostat.
+	SetThermostat(ctx context.Context, accessToken string, therm *nest.Thermostat, cmd *ThermostatCommand) error
+}
+
+const (
+	NestProviderName = "nest"
+	SDMProviderName  = "sdm"
+)
+
+// NestProvider reads data from the legacy Works with Nest API.
+type NestProvider struct {
+	Client       *nest.Client
+	ClientID     string
+	ClientSecret string
+}
+
+func (p *NestProvider) AuthorizationURL(state string) string {
+	return p.Client.AuthorizationURL(p.ClientID, state)
+}
+
+func (p *NestProvider) Exchange(ctx context.Context, code string) (*Token, error) {
+	accessToken, expiry, err := p.Client.GetAccessToken(ctx, p.ClientID, p.ClientSecret, code)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{AccessToken: accessToken, Expiry: expiry}, nil
+}
+
+func (p *NestProvider) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	return nil, common.Errorf(http.StatusForbidden, "nest tokens can't be refreshed")
+}
+
+func (p *NestProvider) GetData(ctx context.Context, accessToken string) (*nest.Data, error) {
+	return p.Client.GetData(ctx, accessToken)
+}
+
+func (p *NestProvider) SetThermostat(ctx context.Context, accessToken string, therm *nest.Thermostat, cmd *ThermostatCommand) error {
+	return p.Client.SetThermostat(ctx, accessToken, therm.DeviceID, nestCommandValues(cmd))
+}
+
+// SDMProvider reads data from Google's Smart Device Management API.
+type SDMProvider struct {
+	Client *sdm.Client
+}
+
+func (p *SDMProvider) AuthorizationURL(state string) string {
+	return p.Client.AuthorizationURL(state)
+}
+
+func (p *SDMProvider) Exchange(ctx context.Context, code string) (*Token, error) {
+	token, err := p.Client.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}, nil
+}
+
+func (p *SDMProvider) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	token, err := p.Client.Refresh(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}, nil
+}
+
+func (p *SDMProvider) GetData(ctx context.Context, accessToken string) (*nest.Data, error) {
+	return p.Client.GetData(ctx, accessToken)
+}
+
+func (p *SDMProvider) SetThermostat(ctx context.Context, accessToken string, therm *nest.Thermostat, cmd *ThermostatCommand) error {
+	const prefix = "sdm.devices.commands."
+	execute := func(command string, params map[string]interface{}) error {
+		return p.Client.ExecuteCommand(ctx, accessToken, therm.DeviceID, prefix+command, params)
+	}
+
+	switch {
+	case cmd.Target != nil && therm.HVACMode == "cool":
+		return execute("ThermostatTemperatureSetpoint.SetCool", map[string]interface{}{"coolCelsius": *cmd.Target})
+	case cmd.Target != nil:
+		return execute("ThermostatTemperatureSetpoint.SetHeat", map[string]interface{}{"heatCelsius": *cmd.Target})
+	case cmd.TargetLow != nil:
+		return execute("ThermostatTemperatureSetpoint.SetRange", map[string]interface{}{
+			"heatCelsius": *cmd.TargetLow,
+			"coolCelsius": *cmd.TargetHigh,
+		})
+	case cmd.Mode == "eco":
+		return execute("ThermostatEco.SetMode", map[string]interface{}{"mode": "MANUAL_ECO"})
+	case cmd.Mode != "":
+		// Leaving eco is a separate command from changing the mode.
+		if therm.HVACMode == "eco" {
+			if err := execute("ThermostatEco.SetMode", map[string]interface{}{"mode": "OFF"}); err != nil {
+				return err
+			}
+		}
+		mode := strings.ToUpper(strings.Replace(cmd.Mode, "-", "", -1))
+		return execute("ThermostatMode.SetMode", map[string]interface{}{"mode": mode})
+	case cmd.FanActive != nil && *cmd.FanActive:
+		params := map[string]interface{}{"timerMode": "ON"}
+		if cmd.FanDuration != 0 {
+			params["duration"] = fmt.Sprintf("%ds", cmd.FanDuration*60)
+		}
+		return execute("Fan.SetTimer", params)
+	case cmd.FanActive != nil:
+		return execute("Fan.SetTimer", map[string]interface{}{"timerMode": "OFF"})
+	}
+	return common.Errorf(http.StatusBadRequest, "empty command")
+}
+
+// instrumentedProvider is a Provider that records how long each call to the
+// underlying provider's API takes, and whether it fails.
+type instrumentedProvider struct {
+	name     string
+	provider Provider
+}
+
+// Returns a provider that records metrics for every API call made by
+// provider, labeled with name.
+func InstrumentProvider(name string, provider Provider) Provider {
+	return &instrumentedProvider{name: name, provider: provider}
+}
+
+// Records a call to the provider that started at start.
+func (p *instrumentedProvider) observe(call string, start time.Time, err error) {
+	observeCall(providerCallSeconds, providerCallErrors, p.name, call, start, err)
+}
+
+func (p *instrumentedProvider) AuthorizationURL(state string) string {
+	return p.provider.AuthorizationURL(state)
+}
+
+func (p *instrumentedProvider) Exchange(ctx context.Context, code string) (*Token, error) {
+	start := time.Now()
+	token, err := p.provider.Exchange(ctx, code)
+	p.observe("Exchange", start, err)
+	return token, err
+}
+
+func (p *instrumentedProvider) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	start := time.Now()
+	token, err := p.provider.Refresh(ctx, refreshToken)
+	p.observe("Refresh", start, err)
+	return token, err
+}
+
+func (p *instrumentedProvider) GetData(ctx context.Context, accessToken string) (*nest.Data, error) {
+	start := time.Now()
+	data, err := p.provider.GetData(ctx, accessToken)
+	p.observe("GetData", start, err)
+	return data, err
+}
+
+func (p *instrumentedProvider) SetThermostat(ctx context.Context, accessToken string, therm *nest.Thermostat, cmd *ThermostatCommand) error {
+	start := time.Now()
+	err := p.provider.SetThermostat(ctx, accessToken, therm, cmd)
+	p.observe("SetThermostat", start, err)
+	return err
+}
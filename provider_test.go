@@ -0,0 +1,177 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+	"github.com/bklimt/relay/nest/nesttest"
+	"github.com/bklimt/relay/sdm"
+	"github.com/bklimt/relay/sdm/sdmtest"
+)
+
+// Returns an SDM thermostat named therm1 in the Hall of structure home1,
+// with the given traits.
+func sdmThermostat(traits map[string]map[string]interface{}) *sdm.Device {
+	device := &sdm.Device{Name: "devices/therm1", Type: "sdm.devices.types.THERMOSTAT", Traits: traits}
+	device.ParentRelations = append(device.ParentRelations, struct {
+		Parent      string `json:"parent"`
+		DisplayName string `json:"displayName"`
+	}{"structures/home1/rooms/room1", "Hall"})
+	return device
+}
+
+// Returns a fake SDM server with one user, whose access token is "token1",
+// and a provider that talks to it.
+func newSDMProvider(t *testing.T) (*SDMProvider, *sdmtest.Server) {
+	fake := sdmtest.NewServer("project1", "client-id", "client-secret")
+	t.Cleanup(fake.Close)
+	home := &sdm.Structure{
+		Name:   "structures/home1",
+		Traits: map[string]map[string]interface{}{"sdm.structures.traits.Info": {"customName": "Home"}},
+	}
+	therm := sdmThermostat(map[string]map[string]interface{}{
+		"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 20.5},
+	})
+	fake.AddUser("code1", "refresh1", "token1", []*sdm.Device{therm}, []*sdm.Structure{home})
+	return &SDMProvider{Client: fake.Client()}, fake
+}
+
+func TestSDMProviderSetThermostat(t *testing.T) {
+	cases := []struct {
+		mode string // The thermostat's current mode.
+		cmd  *ThermostatCommand
+		want []sdmtest.Command
+	}{
+		{"heat", &ThermostatCommand{Target: nest.Float(20)}, []sdmtest.Command{
+			sdmCommand("ThermostatTemperatureSetpoint.SetHeat", map[string]interface{}{"heatCelsius": 20.0}),
+		}},
+		{"cool", &ThermostatCommand{Target: nest.Float(24)}, []sdmtest.Command{
+			sdmCommand("ThermostatTemperatureSetpoint.SetCool", map[string]interface{}{"coolCelsius": 24.0}),
+		}},
+		{"heat-cool", &ThermostatCommand{TargetLow: nest.Float(19), TargetHigh: nest.Float(24)}, []sdmtest.Command{
+			sdmCommand("ThermostatTemperatureSetpoint.SetRange", map[string]interface{}{"heatCelsius": 19.0, "coolCelsius": 24.0}),
+		}},
+		{"heat", &ThermostatCommand{Mode: "eco"}, []sdmtest.Command{
+			sdmCommand("ThermostatEco.SetMode", map[string]interface{}{"mode": "MANUAL_ECO"}),
+		}},
+		{"heat", &ThermostatCommand{Mode: "heat-cool"}, []sdmtest.Command{
+			sdmCommand("ThermostatMode.SetMode", map[string]interface{}{"mode": "HEATCOOL"}),
+		}},
+		// Leaving eco takes two commands.
+		{"eco", &ThermostatCommand{Mode: "cool"}, []sdmtest.Command{
+			sdmCommand("ThermostatEco.SetMode", map[string]interface{}{"mode": "OFF"}),
+			sdmCommand("ThermostatMode.SetMode", map[string]interface{}{"mode": "COOL"}),
+		}},
+		{"heat", &ThermostatCommand{FanActive: nest.Bool(true), FanDuration: 15}, []sdmtest.Command{
+			sdmCommand("Fan.SetTimer", map[string]interface{}{"timerMode": "ON", "duration": "900s"}),
+		}},
+		{"heat", &ThermostatCommand{FanActive: nest.Bool(false)}, []sdmtest.Command{
+			sdmCommand("Fan.SetTimer", map[string]interface{}{"timerMode": "OFF"}),
+		}},
+	}
+
+	for _, c := range cases {
+		provider, fake := newSDMProvider(t)
+		therm := &nest.Thermostat{DeviceID: "therm1", HVACMode: c.mode}
+		if err := provider.SetThermostat(context.Background(), "token1", therm, c.cmd); err != nil {
+			t.Errorf("%+v in %s mode: %s", c.cmd, c.mode, err)
+			continue
+		}
+		if got := fake.Commands("therm1"); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v in %s mode sent %+v, want %+v", c.cmd, c.mode, got, c.want)
+		}
+	}
+
+	provider, _ := newSDMProvider(t)
+	err := provider.SetThermostat(context.Background(), "token1", &nest.Thermostat{DeviceID: "therm1"}, &ThermostatCommand{})
+	if common.Status(err) != http.StatusBadRequest {
+		t.Errorf("empty command returned %v, want a bad request", err)
+	}
+}
+
+// Returns an SDM command with the prefix all device commands share.
+func sdmCommand(name string, params map[string]interface{}) sdmtest.Command {
+	return sdmtest.Command{Command: "sdm.devices.commands." + name, Params: params}
+}
+
+// Returns the names of the devices and structures logged from data.
+func loggedNames(t *testing.T, data *nest.Data) (devices, structures []string) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	if err := LogNestData(ctx, store, KeyForNow(), data); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, _ := store.GetDevices(ctx)
+	for name := range snapshots {
+		devices = append(devices, name)
+	}
+	homes, _ := store.GetStructures(ctx)
+	for name := range homes {
+		structures = append(structures, name)
+	}
+	sort.Strings(devices)
+	sort.Strings(structures)
+	return devices, structures
+}
+
+func TestProvidersNameDocumentsAlike(t *testing.T) {
+	ctx := context.Background()
+
+	// The same home, as the Works with Nest API described it.
+	nestFake := nesttest.NewServer("client-id", "client-secret")
+	defer nestFake.Close()
+	legacy := &nest.Data{}
+	legacy.Devices.Thermostats = map[string]*nest.Thermostat{
+		"abc": {DeviceID: "abc", Name: "Hall", NameLong: "Hall Thermostat", StructureID: "xyz"},
+	}
+	legacy.Structures = map[string]*nest.Structure{
+		"xyz": {StructureID: "xyz", Name: "Home", Thermostats: []string{"abc"}},
+	}
+	nestFake.AddUser("user1", "code1", "token1", legacy)
+	nestProvider := &NestProvider{Client: nestFake.Client(), ClientID: "client-id", ClientSecret: "client-secret"}
+
+	sdmProvider, _ := newSDMProvider(t)
+
+	nestData, err := nestProvider.GetData(ctx, "token1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdmData, err := sdmProvider.GetData(ctx, "token1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nestDevices, nestStructures := loggedNames(t, nestData)
+	sdmDevices, sdmStructures := loggedNames(t, sdmData)
+	if !sameStrings(nestDevices, []string{"Hall"}) || !sameStrings(sdmDevices, nestDevices) {
+		t.Errorf("SDM logged devices %v, and Nest logged %v", sdmDevices, nestDevices)
+	}
+	if !sameStrings(nestStructures, []string{"Home"}) || !sameStrings(sdmStructures, nestStructures) {
+		t.Errorf("SDM logged structures %v, and Nest logged %v", sdmStructures, nestStructures)
+	}
+}
+
+func TestSDMProviderExchangeAndRefresh(t *testing.T) {
+	provider, fake := newSDMProvider(t)
+	ctx := context.Background()
+
+	token, err := provider.Exchange(ctx, "code1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token1" || token.RefreshToken != "refresh1" || token.Expiry.IsZero() {
+		t.Errorf("unexpected token %+v", token)
+	}
+	token, err = provider.Refresh(ctx, "refresh1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token1" || token.RefreshToken != "refresh1" || fake.Refreshes() != 1 {
+		t.Errorf("unexpected refreshed token %+v", token)
+	}
+}
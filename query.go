@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+const (
+	// How many log entries a query returns if it doesn't say.
+	DefaultQueryLimit = 100
+	// The most log entries a query can return at once.
+	MaxQueryLimit = 1000
+)
+
+// LogQuery selects a range of entries from a device's running log, in key
+// order.
+type LogQuery struct {
+	From  string // The lowest key to return. Empty means from the start.
+	To    string // Only keys less than this are returned. Empty means to the end.
+	After string // Only keys greater than this are returned, for paging.
+	Limit int    // The most entries to return.
+}
+
+// LogEntry is one entry in a running log.
+type LogEntry struct {
+	Key  string                 `json:"key"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// LogPage is a page of log entries. If there may be more entries after
+// them, NextCursor is set to pass as the cursor for the next page.
+type LogPage struct {
+	Entries    []*LogEntry `json:"entries"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// Returns a time given in a query, which may be RFC 3339 or Unix seconds.
+func ParseQueryTime(name, value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return ParseDeviceTime(name, seconds)
+	}
+	return ParseDeviceTime(name, value)
+}
+
+// Returns the named device's log entries written in [from, to), where either
+// time may be zero to leave the range open. cursor is the NextCursor from a
+// previous page, or empty for the first page.
+func QueryDeviceLog(ctx context.Context, store Store, name string, from, to time.Time, limit int, cursor string) (*LogPage, error) {
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return nil, common.Errorf(http.StatusBadRequest, "from must be before to")
+	}
+
+	q := &LogQuery{Limit: limit}
+	if !from.IsZero() {
+		q.From = KeyForTime(from)
+	}
+	if !to.IsZero() {
+		q.To = KeyForTime(to)
+	}
+	if cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, common.Errorf(http.StatusBadRequest, "invalid cursor %q", cursor)
+		}
+		q.After = string(after)
+	}
+
+	entries, err := store.QueryDeviceLog(ctx, name, q)
+	if err != nil {
+		return nil, err
+	}
+	page := &LogPage{Entries: entries}
+	if len(entries) == limit {
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].Key))
+	}
+	return page, nil
+}
+
+// Returns whether key is in the range selected by q, ignoring its limit.
+func (q *LogQuery) contains(key string) bool {
+	if q.From != "" && key < q.From {
+		return false
+	}
+	if q.To != "" && key >= q.To {
+		return false
+	}
+	if q.After != "" && key <= q.After {
+		return false
+	}
+	return true
+}
+
+// Returns the lowest key q could match.
+func (q *LogQuery) start() string {
+	if q.After > q.From {
+		return q.After
+	}
+	return q.From
+}
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// Returns the keys of log entries.
+func entryKeys(entries []*LogEntry) []string {
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+// Checks that QueryDeviceLog pages through a log, and limits it to a range,
+// the same way with each store.
+func testQueryDeviceLog(t *testing.T, store Store) {
+	ctx := context.Background()
+	base := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	keys := []string{}
+	for i := 0; i < 10; i++ {
+		key := KeyAt(base.Add(time.Duration(i) * time.Minute))
+		keys = append(keys, key)
+		if err := store.LogDevice(ctx, "hall", key, map[string]interface{}{"i": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Neither another device's log nor this one's commands are included.
+	if err := store.LogDevice(ctx, "garage", KeyAt(base), map[string]interface{}{"i": -1.0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LogCommand(ctx, "hall", KeyAt(base), map[string]interface{}{"mode": "off"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns every page of a query, by following its cursors.
+	pages := func(from, to time.Time, limit int) [][]string {
+		result := [][]string{}
+		cursor := ""
+		for {
+			page, err := QueryDeviceLog(ctx, store, "hall", from, to, limit, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, entryKeys(page.Entries))
+			if page.NextCursor == "" {
+				return result
+			}
+			if len(result) > len(keys) {
+				t.Fatalf("query never ended: %v", result)
+			}
+			cursor = page.NextCursor
+		}
+	}
+	at := func(minutes int) time.Time {
+		return base.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	for _, c := range []struct {
+		name     string
+		from, to time.Time
+		limit    int
+		want     [][]string
+	}{
+		{"everything", time.Time{}, time.Time{}, 0, [][]string{keys}},
+		{"pages", time.Time{}, time.Time{}, 4, [][]string{keys[:4], keys[4:8], keys[8:]}},
+		{"whole pages", time.Time{}, time.Time{}, 5, [][]string{keys[:5], keys[5:], {}}},
+		{"from", at(7), time.Time{}, 0, [][]string{keys[7:]}},
+		{"to", time.Time{}, at(3), 0, [][]string{keys[:3]}},
+		{"range", at(2), at(7), 2, [][]string{keys[2:4], keys[4:6], keys[6:7]}},
+		{"empty range", at(20), time.Time{}, 0, [][]string{{}}},
+		{"too big a limit", time.Time{}, time.Time{}, MaxQueryLimit + 1, [][]string{keys}},
+	} {
+		got := pages(c.from, c.to, c.limit)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got pages %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if !sameStrings(got[i], c.want[i]) {
+				t.Errorf("%s: page %d is %v, want %v", c.name, i, got[i], c.want[i])
+			}
+		}
+	}
+
+	if _, err := QueryDeviceLog(ctx, store, "hall", time.Time{}, time.Time{}, 0, "not base64!"); common.Status(err) != http.StatusBadRequest {
+		t.Errorf("invalid cursor returned %v, want a bad request", err)
+	}
+	if _, err := QueryDeviceLog(ctx, store, "hall", at(5), at(2), 0, ""); common.Status(err) != http.StatusBadRequest {
+		t.Errorf("backwards range returned %v, want a bad request", err)
+	}
+}
+
+func TestMemoryStoreQueryDeviceLog(t *testing.T) {
+	testQueryDeviceLog(t, NewMemoryStore())
+}
+
+func TestBoltStoreQueryDeviceLog(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "relay.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testQueryDeviceLog(t, store)
+}
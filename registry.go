@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/bklimt/relay/common"
+)
+
+// The ID of the sensor that posts to /log without naming itself. It doesn't
+// have to be registered, so that existing Feathers keep working.
+const LegacyDeviceID = "feather"
+
+// Device IDs are used as document names, so they're kept to characters that
+// are safe in Firestore paths and URLs.
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Device IDs that would be mistaken for other routes under /log.
+var reservedDeviceIDs = map[string]bool{"batch": true}
+
+// Checks that id can be used as a device ID.
+func ValidateDeviceID(id string) error {
+	if !deviceIDPattern.MatchString(id) {
+		return common.Errorf(http.StatusBadRequest, "invalid device ID %q: must be 1-64 letters, digits, '-', or '_'", id)
+	}
+	if reservedDeviceIDs[id] {
+		return common.Errorf(http.StatusBadRequest, "device ID %q is reserved", id)
+	}
+	return nil
+}
+
+// Registers a sensor, or updates its metadata if it's already registered.
+func RegisterDevice(ctx context.Context, store Store, id string, reg *Registration) error {
+	if err := ValidateDeviceID(id); err != nil {
+		return err
+	}
+	if reg.Schema != nil {
+		if err := reg.Schema.Validate(); err != nil {
+			return err
+		}
+	}
+	return store.SaveRegistration(ctx, id, reg)
+}
+
+// Registers every sensor listed in the config, so that a fresh store knows
+// about them without any calls to /registry.
+func RegisterConfiguredDevices(ctx context.Context, store Store, devices map[string]*Registration) error {
+	for id, reg := range devices {
+		if err := RegisterDevice(ctx, store, id, reg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the registration for the sensor with the given ID, or an error if
+// it isn't registered.
+func sensorRegistration(ctx context.Context, store Store, id string) (*Registration, error) {
+	reg, err := store.GetRegistration(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if reg == nil {
+		if id != LegacyDeviceID {
+			return nil, common.Errorf(http.StatusNotFound, "unknown device %q", id)
+		}
+		reg = &Registration{}
+	}
+	return reg, nil
+}
+
+// Copies the sensor's metadata into a reading, unless the reading has fields
+// of the same name.
+func (reg *Registration) annotate(data map[string]interface{}) {
+	for field, value := range reg.fields() {
+		if _, ok := data[field]; !ok {
+			data[field] = value
+		}
+	}
+	if _, ok := data["device_type"]; !ok {
+		data["device_type"] = "sensor"
+	}
+}
+
+// Saves a reading from the registered sensor with the given ID as its latest
+// snapshot and appends it to its running log. The sensor's metadata is
+// copied into the reading, unless the reading has fields of the same name.
+// The reading's numeric fields are added to the sensor's rollups and metrics.
+func LogSensorData(ctx context.Context, store Store, id string, key string, data map[string]interface{}) error {
+	reg, err := sensorRegistration(ctx, store, id)
+	if err != nil {
+		return err
+	}
+	if _, err := reg.check(ctx, store, id, key, data); err != nil {
+		return err
+	}
+	reg.annotate(data)
+	if err := store.LogDevice(ctx, id, key, data); err != nil {
+		return err
+	}
+	deviceLogged(ctx, store, id, data)
+	return nil
+}
+
+// Checks a reading against the sensor's schema. If it doesn't match, the
+// returned error lists why, and if the schema says to, the reading is saved
+// to the quarantine log under key and quarantined is true.
+func (reg *Registration) check(ctx context.Context, store Store, id, key string, data map[string]interface{}) (quarantined bool, err error) {
+	if reg.Schema == nil {
+		return false, nil
+	}
+	violations := reg.Schema.Violations(data)
+	if len(violations) == 0 {
+		return false, nil
+	}
+
+	message := strings.Join(violations, "; ")
+	if !reg.Schema.Quarantine {
+		return false, common.Errorf(http.StatusBadRequest, "invalid reading from %s: %s", id, message)
+	}
+	data["violations"] = violations
+	if err := store.QuarantineReading(ctx, id, key, data); err != nil {
+		return false, err
+	}
+	return true, common.Errorf(http.StatusBadRequest, "invalid reading from %s was quarantined: %s", id, message)
+}
+
+// Returns the registration's metadata fields that are set.
+func (reg *Registration) fields() map[string]interface{} {
+	fields := map[string]interface{}{}
+	if reg.Name != "" {
+		fields["name"] = reg.Name
+	}
+	if reg.Location != "" {
+		fields["location"] = reg.Location
+	}
+	if reg.SensorType != "" {
+		fields["sensor_type"] = reg.SensorType
+	}
+	if reg.Owner != "" {
+		fields["owner"] = reg.Owner
+	}
+	return fields
+}
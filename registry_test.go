@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/bklimt/relay/common"
+)
+
+func TestValidateDeviceID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"garage":      true,
+		"Garage_2-b":  true,
+		"":            false,
+		"garage/door": false,
+		"garage door": false,
+		"../garage":   false,
+	} {
+		if err := ValidateDeviceID(id); (err == nil) != valid {
+			t.Errorf("ValidateDeviceID(%q) returned %v, want valid %v", id, err, valid)
+		}
+	}
+}
+
+func TestLogSensorData(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	err := LogSensorData(ctx, store, "garage", KeyForNow(), map[string]interface{}{"temperature": 10.0})
+	if common.Status(err) != http.StatusNotFound {
+		t.Errorf("unregistered sensor returned %v, want not found", err)
+	}
+	// The Feather doesn't have to be registered.
+	if err := LogSensorData(ctx, store, LegacyDeviceID, KeyForNow(), map[string]interface{}{"temperature": 21.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := &Registration{Name: "Garage", Location: "garage", SensorType: "bme280"}
+	if err := RegisterConfiguredDevices(ctx, store, map[string]*Registration{"garage": reg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterDevice(ctx, store, "garage/door", reg); common.Status(err) != http.StatusBadRequest {
+		t.Errorf("invalid device ID returned %v, want a bad request", err)
+	}
+	// The reading's own fields take precedence over the registration's.
+	data := map[string]interface{}{"temperature": 10.0, "location": "driveway"}
+	if err := LogSensorData(ctx, store, "garage", KeyForNow(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := store.GetDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garage := devices["garage"]
+	if garage["name"] != "Garage" || garage["sensor_type"] != "bme280" || garage["location"] != "driveway" || garage["device_type"] != "sensor" {
+		t.Errorf("unexpected garage snapshot %v", garage)
+	}
+	if _, ok := garage["owner"]; ok {
+		t.Errorf("unset owner was copied into %v", garage)
+	}
+	if devices[LegacyDeviceID]["temperature"] != 21.5 {
+		t.Errorf("unexpected feather snapshot %v", devices[LegacyDeviceID])
+	}
+}
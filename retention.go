@@ -0,0 +1,274 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"time"
+)
+
+// RetentionPolicy says how many days to keep each kind of device entry. In
+// a device's own policy, zero falls back to the default policy. Zero in the
+// default policy, or a negative number anywhere, keeps entries forever.
+type RetentionPolicy struct {
+	LogDays        int `json:"logDays"`        // Raw readings, in device/{name}/log.
+	QuarantineDays int `json:"quarantineDays"` // Readings that didn't match the schema.
+	CommandDays    int `json:"commandDays"`    // Commands sent to thermostats.
+	HourRollupDays int `json:"hourRollupDays"` // Hourly rollups.
+	DayRollupDays  int `json:"dayRollupDays"`  // Daily rollups.
+}
+
+// Returns the number of days to keep each kind of entry, keyed by kind.
+func (p *RetentionPolicy) days() map[string]int {
+	return map[string]int{
+		DeviceLog:        p.LogDays,
+		DeviceQuarantine: p.QuarantineDays,
+		DeviceCommand:    p.CommandDays,
+		DeviceRollupHour: p.HourRollupDays,
+		DeviceRollupDay:  p.DayRollupDays,
+	}
+}
+
+// Retention is the config for deleting old device entries, structure logs,
+// and images.
+type Retention struct {
+	RetentionPolicy                              // The policy for devices without their own.
+	Devices          map[string]*RetentionPolicy `json:"devices"`          // Policies for particular devices, by name.
+	StructureLogDays int                         `json:"structureLogDays"` // How long to keep structure/{name}/log. Zero keeps it forever.
+	ImageDays        int                         `json:"imageDays"`        // How long to keep images. Zero keeps them forever.
+	IntervalSeconds  int                         `json:"intervalSeconds"`  // How often to prune.
+	BatchSize        int                         `json:"batchSize"`        // The most to delete at once.
+	DryRun           bool                        `json:"dryRun"`           // Only report what would be deleted.
+}
+
+// Returns the number of days to keep each kind of entry for the named
+// device, keyed by kind. Kinds that are kept forever are left out.
+func (r *Retention) deviceDays(name string) map[string]int {
+	days := r.RetentionPolicy.days()
+	if policy := r.Devices[name]; policy != nil {
+		for kind, d := range policy.days() {
+			if d != 0 {
+				days[kind] = d
+			}
+		}
+	}
+	for kind, d := range days {
+		if d <= 0 {
+			delete(days, kind)
+		}
+	}
+	return days
+}
+
+// Matches the paths that /image writes to, i.e. YYYY/M/D/filename. Nothing
+// else in the bucket is pruned.
+var imagePathPattern = regexp.MustCompile(`^[0-9]{4}/[0-9]{1,2}/[0-9]{1,2}/[^/]+$`)
+
+// PruneReport says how much a janitor deleted, or would have deleted in a
+// dry run.
+type PruneReport struct {
+	DryRun  bool                      `json:"dry_run"`
+	Entries map[string]map[string]int `json:"entries"` // device or structure -> kind -> count
+	Images  int                       `json:"images"`
+}
+
+func (r *PruneReport) addEntries(name, kind string, n int) {
+	if r.Entries[name] == nil {
+		r.Entries[name] = map[string]int{}
+	}
+	r.Entries[name][kind] += n
+}
+
+// Janitor deletes device entries, structure logs, and images that are older
+// than the retention policy allows. It deletes in batches, so that no single
+// call to the store or the bucket is unbounded.
+type Janitor struct {
+	Store     Store
+	Blobs     BlobStore // Where images are. May be nil.
+	Retention *Retention
+
+	Interval  time.Duration // How often to prune.
+	BatchSize int           // The most entries or images to delete at once.
+	DryRun    bool          // Only report what would be deleted.
+}
+
+func NewJanitor(store Store, blobs BlobStore, cfg *Config) *Janitor {
+	return &Janitor{
+		Store:     store,
+		Blobs:     blobs,
+		Retention: cfg.Retention,
+		Interval:  time.Duration(cfg.Retention.IntervalSeconds) * time.Second,
+		BatchSize: cfg.Retention.BatchSize,
+		DryRun:    cfg.Retention.DryRun,
+	}
+}
+
+// Deletes everything that was older than its retention at now, and returns
+// what was deleted. A failure for one device doesn't stop the others from
+// being pruned, but the first failure is returned along with the report.
+func (j *Janitor) PruneOnce(ctx context.Context, now time.Time) (*PruneReport, error) {
+	report := &PruneReport{DryRun: j.DryRun, Entries: map[string]map[string]int{}}
+	var firstErr error
+	failed := func(err error) {
+		log.Printf("Unable to prune: %s", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	names, err := j.deviceNames(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, name := range names {
+		for kind, days := range j.Retention.deviceDays(name) {
+			cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+			if err := j.pruneDevice(ctx, name, kind, cutoff, report); err != nil {
+				failed(err)
+			}
+		}
+	}
+
+	if j.Retention.StructureLogDays > 0 {
+		structures, err := j.Store.GetStructures(ctx)
+		if err != nil {
+			failed(err)
+		}
+		cutoff := now.Add(-time.Duration(j.Retention.StructureLogDays) * 24 * time.Hour)
+		for name := range structures {
+			if err := j.pruneDevice(ctx, name, StructureLog, cutoff, report); err != nil {
+				failed(err)
+			}
+		}
+	}
+
+	if j.Blobs != nil && j.Retention.ImageDays > 0 {
+		cutoff := now.Add(-time.Duration(j.Retention.ImageDays) * 24 * time.Hour)
+		if err := j.pruneImages(ctx, cutoff, report); err != nil {
+			failed(err)
+		}
+	}
+
+	verb := "Deleted"
+	if j.DryRun {
+		verb = "Would delete"
+	}
+	for name, kinds := range report.Entries {
+		for kind, n := range kinds {
+			log.Printf("%s %d %s entries of %s.", verb, n, kind, name)
+		}
+	}
+	if report.Images > 0 {
+		log.Printf("%s %d images.", verb, report.Images)
+	}
+	return report, firstErr
+}
+
+// Returns the name of every device that has a snapshot, a registration, or
+// its own retention policy.
+func (j *Janitor) deviceNames(ctx context.Context) ([]string, error) {
+	seen := map[string]bool{}
+	devices, err := j.Store.GetDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for name := range devices {
+		seen[name] = true
+	}
+	regs, err := j.Store.GetRegistrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for name := range regs {
+		seen[name] = true
+	}
+	for name := range j.Retention.Devices {
+		seen[name] = true
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Deletes the named device's entries of the given kind from before cutoff.
+// With StructureLog, name is a structure's.
+func (j *Janitor) pruneDevice(ctx context.Context, name, kind string, cutoff time.Time, report *PruneReport) error {
+	before := KeyForTime(cutoff)
+	after := ""
+	for {
+		keys, err := j.Store.ListDeviceEntries(ctx, name, kind, after, before, j.BatchSize)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		if !j.DryRun {
+			if err := j.Store.DeleteDeviceEntries(ctx, name, kind, keys); err != nil {
+				return err
+			}
+		}
+		report.addEntries(name, kind, len(keys))
+		if len(keys) < j.BatchSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Deletes the images created before cutoff.
+func (j *Janitor) pruneImages(ctx context.Context, cutoff time.Time, report *PruneReport) error {
+	batch := []string{}
+	flush := func() error {
+		if !j.DryRun {
+			for _, path := range batch {
+				if err := j.Blobs.DeleteBlob(ctx, path); err != nil {
+					return err
+				}
+			}
+		}
+		report.Images += len(batch)
+		batch = batch[:0]
+		return ctx.Err()
+	}
+
+	var err error
+	walkErr := j.Blobs.WalkBlobs(ctx, func(path string, created time.Time) bool {
+		if !imagePathPattern.MatchString(path) || !created.Before(cutoff) {
+			return true
+		}
+		batch = append(batch, path)
+		if len(batch) < j.BatchSize {
+			return true
+		}
+		err = flush()
+		return err == nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Prunes every Interval until ctx is cancelled.
+func (j *Janitor) PruneForever(ctx context.Context) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		j.PruneOnce(ctx, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionDeviceDays(t *testing.T) {
+	r := &Retention{
+		RetentionPolicy: RetentionPolicy{LogDays: 30, QuarantineDays: 7},
+		Devices: map[string]*RetentionPolicy{
+			"garage": {LogDays: 365, QuarantineDays: -1, CommandDays: 10},
+		},
+	}
+
+	days := r.deviceDays("hall")
+	if len(days) != 2 || days[DeviceLog] != 30 || days[DeviceQuarantine] != 7 {
+		t.Errorf("hall keeps %v, want the default policy", days)
+	}
+	days = r.deviceDays("garage")
+	if len(days) != 2 || days[DeviceLog] != 365 || days[DeviceCommand] != 10 {
+		t.Errorf("garage keeps %v, want its own policy with quarantine kept forever", days)
+	}
+}
+
+// Returns the keys of every one of the named device's entries of the given
+// kind.
+func allEntries(t *testing.T, store Store, name, kind string) []string {
+	keys, err := store.ListDeviceEntries(context.Background(), name, kind, "", "~", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// Checks that a janitor prunes each kind of entry the same way with each
+// store.
+func testPrune(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	old, recent := KeyAt(now.Add(-100*24*time.Hour)), KeyAt(now.Add(-10*24*time.Hour))
+	for _, key := range []string{old, recent} {
+		if err := store.LogDevice(ctx, "garage", key, map[string]interface{}{"t": 1.0}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.LogDevice(ctx, "hall", key, map[string]interface{}{"t": 1.0}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.LogCommand(ctx, "hall", key, map[string]interface{}{"mode": "heat"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.QuarantineReading(ctx, "hall", key, map[string]interface{}{"t": "x"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.LogStructure(ctx, "Home", key, map[string]interface{}{"away": "home"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	janitor := &Janitor{
+		Store: store,
+		Retention: &Retention{
+			RetentionPolicy:  RetentionPolicy{LogDays: 30, QuarantineDays: 30},
+			Devices:          map[string]*RetentionPolicy{"garage": {LogDays: -1}},
+			StructureLogDays: 30,
+		},
+		BatchSize: 1,
+	}
+	report, err := janitor.PruneOnce(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 2 || report.Entries["hall"][DeviceLog] != 1 || report.Entries["hall"][DeviceQuarantine] != 1 || report.Entries["Home"][StructureLog] != 1 {
+		t.Errorf("unexpected report %v", report.Entries)
+	}
+
+	for _, c := range []struct {
+		name, kind string
+		want       []string
+	}{
+		{"hall", DeviceLog, []string{recent}},
+		{"hall", DeviceQuarantine, []string{recent}},
+		{"hall", DeviceCommand, []string{old, recent}},
+		{"garage", DeviceLog, []string{old, recent}},
+		{"Home", StructureLog, []string{recent}},
+	} {
+		if got := allEntries(t, store, c.name, c.kind); !sameStrings(got, c.want) {
+			t.Errorf("%s has %s entries %v, want %v", c.name, c.kind, got, c.want)
+		}
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	testPrune(t, NewMemoryStore())
+}
+
+func TestBoltStorePrune(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "relay.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testPrune(t, store)
+}
+
+func TestPruneDryRun(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		key := KeyAt(now.Add(-100 * 24 * time.Hour))
+		if err := store.LogStructure(ctx, "Home", key, map[string]interface{}{"away": "home"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	janitor := &Janitor{
+		Store:     store,
+		Retention: &Retention{StructureLogDays: 30},
+		BatchSize: 2,
+		DryRun:    true,
+	}
+	report, err := janitor.PruneOnce(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Entries["Home"][StructureLog] != 5 {
+		t.Errorf("dry run reported %v, want 5 structure log entries", report.Entries)
+	}
+	if n := len(store.GetLog("structure", "Home")); n != 5 {
+		t.Errorf("dry run left %d entries, want 5", n)
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	blobs := NewMemoryBlobStore()
+	ctx := context.Background()
+	for _, path := range []string{"2019/1/2/door.jpg", "2019/1/2/hall.jpg", "config/relay.json"} {
+		if err := blobs.WriteBlob(ctx, path, "image/jpeg", []byte("jpeg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	janitor := &Janitor{
+		Store:     NewMemoryStore(),
+		Blobs:     blobs,
+		Retention: &Retention{ImageDays: 30},
+		BatchSize: 1,
+	}
+	if report, err := janitor.PruneOnce(ctx, time.Now().Add(time.Hour)); err != nil || report.Images != 0 {
+		t.Fatalf("pruned %v images that were an hour old: %v", report, err)
+	}
+	report, err := janitor.PruneOnce(ctx, time.Now().Add(31*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Images != 2 {
+		t.Errorf("pruned %d images, want 2", report.Images)
+	}
+	if blobs.Blob("2019/1/2/door.jpg") != nil || blobs.Blob("2019/1/2/hall.jpg") != nil {
+		t.Errorf("old images weren't deleted")
+	}
+	if blobs.Blob("config/relay.json") == nil {
+		t.Errorf("deleted a file that /image didn't write")
+	}
+}
@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// The resolutions that device logs are rolled up at.
+const (
+	RollupHour = "hour"
+	RollupDay  = "day"
+)
+
+// The longest range that is queried at hourly resolution when the
+// resolution is picked automatically. Longer ranges use daily rollups.
+const maxHourlyRange = 14 * 24 * time.Hour
+
+// Rollup is the aggregate of one numeric field over a period.
+type Rollup struct {
+	Count  int64     `firestore:"count" json:"count"`
+	Min    float64   `firestore:"min" json:"min"`
+	Max    float64   `firestore:"max" json:"max"`
+	Sum    float64   `firestore:"sum" json:"sum"`
+	Mean   float64   `firestore:"mean" json:"mean"`
+	Last   float64   `firestore:"last" json:"last"`       // The value measured most recently.
+	LastAt time.Time `firestore:"last_at" json:"last_at"` // When Last was measured.
+}
+
+// Adds a value measured at the given time.
+func (r *Rollup) Add(value float64, at time.Time) {
+	if r.Count == 0 || value < r.Min {
+		r.Min = value
+	}
+	if r.Count == 0 || value > r.Max {
+		r.Max = value
+	}
+	r.Count++
+	r.Sum += value
+	r.Mean = r.Sum / float64(r.Count)
+	if !at.Before(r.LastAt) {
+		r.Last = value
+		r.LastAt = at
+	}
+}
+
+// RollupPeriod holds the rollups of every numeric field of a device over
+// one hour or day.
+type RollupPeriod struct {
+	Start  time.Time          `firestore:"start" json:"start"`
+	Fields map[string]*Rollup `firestore:"fields" json:"fields"`
+}
+
+// Returns the start of the period at the given resolution containing t.
+func periodStart(resolution string, t time.Time) time.Time {
+	t = t.UTC()
+	if resolution == RollupDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// Returns the numeric fields of a log entry, leaving out the ones relay
+// adds.
+func numericFields(data map[string]interface{}) map[string]float64 {
+	values := map[string]float64{}
+	for field, value := range data {
+		if relayFields[field] {
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			values[field] = v
+		case int64:
+			values[field] = float64(v)
+		case int:
+			values[field] = float64(v)
+		}
+	}
+	return values
+}
+
+// A period that rollups are kept for.
+type rollupKey struct {
+	resolution string
+	start      time.Time
+}
+
+// The numeric fields of a log entry, and when it was measured.
+type rollupValues struct {
+	at     time.Time
+	values map[string]float64
+}
+
+// Adds the numeric fields of log entries to the device's hourly and daily
+// rollups. The entries are grouped by period first, so that each period is
+// only updated once, however many entries are in it. Rollups are derived
+// from the log, so a failure is only logged, rather than failing the write.
+func updateRollups(ctx context.Context, store Store, name string, entries []map[string]interface{}) {
+	periods := map[rollupKey][]rollupValues{}
+	order := []rollupKey{}
+	for _, data := range entries {
+		values := numericFields(data)
+		if len(values) == 0 {
+			continue
+		}
+		at := entryTime(data)
+		for _, resolution := range []string{RollupHour, RollupDay} {
+			key := rollupKey{resolution, periodStart(resolution, at)}
+			if periods[key] == nil {
+				order = append(order, key)
+			}
+			periods[key] = append(periods[key], rollupValues{at, values})
+		}
+	}
+
+	for _, key := range order {
+		readings := periods[key]
+		err := store.UpdateRollup(ctx, name, key.resolution, key.start, func(period *RollupPeriod) {
+			for _, reading := range readings {
+				for field, value := range reading.values {
+					if period.Fields[field] == nil {
+						period.Fields[field] = &Rollup{}
+					}
+					period.Fields[field].Add(value, reading.at)
+				}
+			}
+		})
+		if err != nil {
+			log.Printf("Unable to update %s rollup for %s: %s", key.resolution, name, err)
+		}
+	}
+}
+
+// Returns the time a log entry was measured, or else now.
+func entryTime(data map[string]interface{}) time.Time {
+	if t, ok := data["measured_at"].(time.Time); ok {
+		return t
+	}
+	return time.Now().UTC()
+}
+
+// Rollups is the response to a rollup query.
+type Rollups struct {
+	Resolution string          `json:"resolution"`
+	Periods    []*RollupPeriod `json:"periods"`
+}
+
+// Returns the named device's rollups for the periods overlapping [from, to).
+// If resolution is empty or "auto", hourly rollups are used for ranges up to
+// two weeks, and daily rollups for longer ones. A zero to means now, and a
+// zero from means a week before to.
+func QueryRollups(ctx context.Context, store Store, name string, from, to time.Time, resolution string) (*Rollups, error) {
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if from.IsZero() {
+		from = to.Add(-7 * 24 * time.Hour)
+	}
+	if !from.Before(to) {
+		return nil, common.Errorf(http.StatusBadRequest, "from must be before to")
+	}
+
+	switch resolution {
+	case "", "auto":
+		resolution = RollupHour
+		if to.Sub(from) > maxHourlyRange {
+			resolution = RollupDay
+		}
+	case RollupHour, RollupDay:
+	default:
+		return nil, common.Errorf(http.StatusBadRequest, "unknown resolution %q", resolution)
+	}
+
+	// Include the period that from is in.
+	periods, err := store.QueryRollups(ctx, name, resolution, periodStart(resolution, from), to)
+	if err != nil {
+		return nil, err
+	}
+	return &Rollups{Resolution: resolution, Periods: periods}, nil
+}
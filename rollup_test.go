@@ -0,0 +1,191 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+func TestRollupAdd(t *testing.T) {
+	at := time.Date(2020, 1, 1, 5, 30, 0, 0, time.UTC)
+	r := &Rollup{}
+	r.Add(3, at)
+	r.Add(-1, at.Add(time.Minute))
+	// Measured earlier, but added last.
+	r.Add(10, at.Add(-time.Minute))
+
+	if r.Count != 3 || r.Min != -1 || r.Max != 10 || r.Sum != 12 || r.Mean != 4 {
+		t.Errorf("unexpected rollup %+v", r)
+	}
+	if r.Last != -1 || !r.LastAt.Equal(at.Add(time.Minute)) {
+		t.Errorf("last is %v at %s, want the value measured most recently", r.Last, r.LastAt)
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	at := time.Date(2020, 1, 1, 5, 30, 15, 0, time.FixedZone("EST", -5*60*60))
+	if got, want := periodStart(RollupHour, at), time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("hour starts at %s, want %s", got, want)
+	}
+	if got, want := periodStart(RollupDay, at), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("day starts at %s, want %s", got, want)
+	}
+}
+
+// Checks that updateRollups and QueryRollups work the same way with each
+// store.
+func testStoreRollups(t *testing.T, store Store) {
+	ctx := context.Background()
+	at := time.Date(2020, 1, 1, 5, 30, 0, 0, time.UTC)
+	entries := []map[string]interface{}{}
+	for i := 0; i < 3; i++ {
+		entries = append(entries, map[string]interface{}{"x": float64(i), "label": "not a number", "measured_at": at.Add(time.Duration(i) * time.Minute)})
+	}
+	updateRollups(ctx, store, "garage", entries)
+	// The next hour, but the same day.
+	updateRollups(ctx, store, "garage", []map[string]interface{}{{"x": 10.0, "measured_at": at.Add(time.Hour)}})
+
+	hours, err := store.QueryRollups(ctx, "garage", RollupHour, periodStart(RollupHour, at), at.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 2 {
+		t.Fatalf("got %d hourly periods, want 2", len(hours))
+	}
+	first := hours[0]
+	if !first.Start.Equal(at.Truncate(time.Hour)) {
+		t.Errorf("first hour starts at %s, want %s", first.Start, at.Truncate(time.Hour))
+	}
+	if x := first.Fields["x"]; x == nil || x.Count != 3 || x.Min != 0 || x.Max != 2 || x.Mean != 1 {
+		t.Errorf("unexpected rollup of x for the first hour: %+v", x)
+	}
+	for _, field := range []string{"label", "measured_at"} {
+		if _, ok := first.Fields[field]; ok {
+			t.Errorf("%s was rolled up", field)
+		}
+	}
+
+	days, err := store.QueryRollups(ctx, "garage", RollupDay, periodStart(RollupDay, at), at.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 1 {
+		t.Fatalf("got %d daily periods, want 1", len(days))
+	}
+	if x := days[0].Fields["x"]; x == nil || x.Count != 4 || x.Max != 10 || x.Last != 10 {
+		t.Errorf("unexpected rollup of x for the day: %+v", x)
+	}
+}
+
+func TestMemoryStoreRollups(t *testing.T) {
+	testStoreRollups(t, NewMemoryStore())
+}
+
+func TestBoltStoreRollups(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "relay.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testStoreRollups(t, store)
+}
+
+func TestQueryRollupsResolution(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	to := time.Now().UTC()
+
+	cases := []struct {
+		from       time.Time
+		resolution string
+		want       string
+	}{
+		{to.Add(-24 * time.Hour), "", RollupHour},
+		{to.Add(-30 * 24 * time.Hour), "auto", RollupDay},
+		{to.Add(-30 * 24 * time.Hour), RollupHour, RollupHour},
+		{time.Time{}, "", RollupHour},
+	}
+	for _, c := range cases {
+		rollups, err := QueryRollups(ctx, store, "garage", c.from, to, c.resolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rollups.Resolution != c.want {
+			t.Errorf("resolution %q from %s is %s, want %s", c.resolution, c.from, rollups.Resolution, c.want)
+		}
+	}
+
+	if _, err := QueryRollups(ctx, store, "garage", time.Time{}, to, "minute"); common.Status(err) != http.StatusBadRequest {
+		t.Errorf("unknown resolution returned %v, want a bad request", err)
+	}
+	if _, err := QueryRollups(ctx, store, "garage", to, to.Add(-time.Hour), ""); common.Status(err) != http.StatusBadRequest {
+		t.Errorf("backwards range returned %v, want a bad request", err)
+	}
+}
+
+func TestLoggingUpdatesRollups(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	if err := LogSensorData(ctx, store, LegacyDeviceID, KeyForNow(), map[string]interface{}{"temperature": 21.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	rollups, err := QueryRollups(ctx, store, LegacyDeviceID, time.Time{}, time.Time{}, RollupHour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups.Periods) != 1 {
+		t.Fatalf("got %d periods, want 1", len(rollups.Periods))
+	}
+	if r := rollups.Periods[0].Fields["temperature"]; r == nil || r.Count != 1 || r.Last != 21.5 {
+		t.Errorf("unexpected rollup of temperature: %+v", r)
+	}
+}
+
+// Counts the calls to UpdateRollup.
+type rollupCountingStore struct {
+	*MemoryStore
+	updates int
+}
+
+func (s *rollupCountingStore) UpdateRollup(ctx context.Context, name, resolution string, start time.Time, update func(*RollupPeriod)) error {
+	s.updates++
+	return s.MemoryStore.UpdateRollup(ctx, name, resolution, start, update)
+}
+
+func TestLogSensorBatchUpdatesEachPeriodOnce(t *testing.T) {
+	store := &rollupCountingStore{MemoryStore: NewMemoryStore()}
+	ctx := context.Background()
+
+	// 300 readings a minute apart span five or six hours, in one or two days.
+	readings := []map[string]interface{}{}
+	for i := 0; i < 300; i++ {
+		readings = append(readings, reading(60*(300-i), float64(i), ""))
+	}
+	if _, err := LogSensorBatch(ctx, store, LegacyDeviceID, readings, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	rollups := 0
+	for _, resolution := range []string{RollupHour, RollupDay} {
+		periods, err := store.QueryRollups(ctx, LegacyDeviceID, resolution, time.Now().Add(-48*time.Hour), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := int64(0)
+		for _, period := range periods {
+			count += period.Fields["temperature"].Count
+		}
+		if count != 300 {
+			t.Errorf("%s rollups count %d readings, want 300", resolution, count)
+		}
+		rollups += len(periods)
+	}
+	if store.updates != rollups {
+		t.Errorf("made %d rollup updates for %d periods", store.updates, rollups)
+	}
+}
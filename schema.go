@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bklimt/relay/common"
+)
+
+// Schema describes the readings a sensor sends. Readings that don't match it
+// are rejected, or quarantined if Quarantine is set.
+type Schema struct {
+	Fields map[string]*FieldSchema `firestore:"fields" json:"fields"`
+
+	// Whether readings may have fields that aren't in Fields.
+	AllowUnknown bool `firestore:"allow_unknown" json:"allow_unknown,omitempty"`
+	// Whether rejected readings are kept in the device's quarantine log.
+	Quarantine bool `firestore:"quarantine" json:"quarantine,omitempty"`
+}
+
+// FieldSchema describes one field of a reading.
+type FieldSchema struct {
+	Type     string   `firestore:"type" json:"type"`                     // "number", "string", "bool", "object", or "array".
+	Unit     string   `firestore:"unit,omitempty" json:"unit,omitempty"` // For people reading the data, e.g. "C" or "%".
+	Min      *float64 `firestore:"min,omitempty" json:"min,omitempty"`   // For numbers.
+	Max      *float64 `firestore:"max,omitempty" json:"max,omitempty"`   // For numbers.
+	Required bool     `firestore:"required,omitempty" json:"required,omitempty"`
+}
+
+// Fields relay adds to readings, which schemas don't have to list.
+var relayFields = map[string]bool{
+	"timestamp":          true,
+	"measured_at":        true,
+	"sent_at":            true,
+	"clock_skew":         true,
+	"clock_skew_seconds": true,
+	"idempotency_key":    true,
+}
+
+// Returns the name of the JSON type of a decoded value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Returns every way the reading doesn't match the schema, sorted by field.
+func (schema *Schema) Violations(data map[string]interface{}) []string {
+	violations := []string{}
+	for name, field := range schema.Fields {
+		value, ok := data[name]
+		if !ok {
+			if field.Required {
+				violations = append(violations, fmt.Sprintf("%s is required", name))
+			}
+			continue
+		}
+		if t := jsonType(value); t != field.Type {
+			violations = append(violations, fmt.Sprintf("%s must be a %s, not a %s", name, field.Type, t))
+			continue
+		}
+		if n, ok := value.(float64); ok {
+			if field.Min != nil && n < *field.Min {
+				violations = append(violations, fmt.Sprintf("%s %v is less than %v", name, n, *field.Min))
+			}
+			if field.Max != nil && n > *field.Max {
+				violations = append(violations, fmt.Sprintf("%s %v is more than %v", name, n, *field.Max))
+			}
+		}
+	}
+	if !schema.AllowUnknown {
+		for name := range data {
+			if _, ok := schema.Fields[name]; !ok && !relayFields[name] {
+				violations = append(violations, fmt.Sprintf("%s is not in the schema", name))
+			}
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// Checks that a schema makes sense, so that mistakes are caught when the
+// sensor is registered rather than when its readings are all rejected.
+func (schema *Schema) Validate() error {
+	problems := []string{}
+	for name, field := range schema.Fields {
+		if field == nil {
+			problems = append(problems, fmt.Sprintf("%s has no schema", name))
+			continue
+		}
+		switch field.Type {
+		case "number":
+			if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+				problems = append(problems, fmt.Sprintf("%s min is more than max", name))
+			}
+		case "string", "bool", "object", "array":
+			if field.Min != nil || field.Max != nil {
+				problems = append(problems, fmt.Sprintf("%s is a %s, so it can't have a min or max", name, field.Type))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s has unknown type %q", name, field.Type))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return common.Errorf(http.StatusBadRequest, "invalid schema: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+func temperatureSchema(quarantine bool) *Schema {
+	min, max := -40.0, 80.0
+	return &Schema{
+		Fields: map[string]*FieldSchema{
+			"temperature": {Type: "number", Unit: "C", Min: &min, Max: &max, Required: true},
+		},
+		Quarantine: quarantine,
+	}
+}
+
+func TestSchemaViolations(t *testing.T) {
+	schema := temperatureSchema(false)
+	cases := []struct {
+		data map[string]interface{}
+		want []string
+	}{
+		{map[string]interface{}{"temperature": 20.0, "measured_at": time.Now()}, []string{}},
+		{map[string]interface{}{}, []string{"temperature is required"}},
+		{map[string]interface{}{"temperature": "20"}, []string{"temperature must be a number, not a string"}},
+		{map[string]interface{}{"temperature": 9999.0}, []string{"temperature 9999 is more than 80"}},
+		{map[string]interface{}{"temperature": 20.0, "humidity": 40.0}, []string{"humidity is not in the schema"}},
+	}
+	for _, c := range cases {
+		if got := schema.Violations(c.data); !sameStrings(got, c.want) {
+			t.Errorf("Violations(%v) = %v, want %v", c.data, got, c.want)
+		}
+	}
+
+	schema.AllowUnknown = true
+	if got := schema.Violations(map[string]interface{}{"temperature": 20.0, "humidity": 40.0}); len(got) != 0 {
+		t.Errorf("unknown field was rejected with AllowUnknown: %v", got)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	if err := temperatureSchema(false).Validate(); err != nil {
+		t.Errorf("valid schema was rejected: %s", err)
+	}
+	min, max := 10.0, 0.0
+	bad := &Schema{Fields: map[string]*FieldSchema{
+		"a": {Type: "num"},
+		"b": {Type: "number", Min: &min, Max: &max},
+		"c": {Type: "string", Min: &min},
+	}}
+	err := bad.Validate()
+	if common.Status(err) != http.StatusBadRequest {
+		t.Fatalf("invalid schema returned %v, want a bad request", err)
+	}
+	for _, field := range []string{"a has unknown type", "b min is more than max", "c is a string"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("error %q doesn't mention %q", err, field)
+		}
+	}
+}
+
+func TestRejectedReadingsAreNotLogged(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	if err := RegisterDevice(ctx, store, "garage", &Registration{Schema: temperatureSchema(false)}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := LogSensorData(ctx, store, "garage", KeyForNow(), map[string]interface{}{"temperature": "warm"})
+	if common.Status(err) != http.StatusBadRequest {
+		t.Fatalf("invalid reading returned %v, want a bad request", err)
+	}
+	if n := len(store.GetLog("device", "garage")); n != 0 {
+		t.Errorf("logged %d invalid readings", n)
+	}
+	if n := len(store.GetQuarantine("garage")); n != 0 {
+		t.Errorf("quarantined %d readings without quarantine on", n)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	if err := RegisterDevice(ctx, store, "garage", &Registration{Schema: temperatureSchema(true)}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := KeyForNow()
+	err := LogSensorData(ctx, store, "garage", key, map[string]interface{}{"temperature": 9999.0})
+	if common.Status(err) != http.StatusBadRequest {
+		t.Fatalf("invalid reading returned %v, want a bad request", err)
+	}
+	quarantined := store.GetQuarantine("garage")
+	entry, ok := quarantined[key]
+	if !ok {
+		t.Fatalf("reading wasn't quarantined under %s: %v", key, quarantined)
+	}
+	if entry["temperature"] != 9999.0 {
+		t.Errorf("quarantined temperature is %v, want 9999", entry["temperature"])
+	}
+	if violations, _ := entry["violations"].([]string); len(violations) != 1 {
+		t.Errorf("quarantined reading has violations %v, want one", entry["violations"])
+	}
+	if n := len(store.GetLog("device", "garage")); n != 0 {
+		t.Errorf("logged %d invalid readings", n)
+	}
+
+	// In a batch, the valid readings are still logged.
+	now := float64(time.Now().Unix())
+	results, err := LogSensorBatch(ctx, store, "garage", []map[string]interface{}{
+		{"temperature": 20.0, "measured_at": now},
+		{"temperature": -100.0, "measured_at": now - 1},
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := statuses(results), []string{BatchCreated, BatchQuarantined}; !sameStrings(got, want) {
+		t.Errorf("statuses are %v, want %v", got, want)
+	}
+	if n := len(store.GetQuarantine("garage")); n != 2 {
+		t.Errorf("quarantined %d readings, want 2", n)
+	}
+	if n := len(store.GetLog("device", "garage")); n != 1 {
+		t.Errorf("logged %d readings, want 1", n)
+	}
+}
@@ -0,0 +1,52 @@
+package sdm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/bklimt/relay/common"
+)
+
+// Sends a command, such as
+// "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat", to a device.
+func (c *Client) ExecuteCommand(ctx context.Context, accessToken string, deviceID string, command string, params map[string]interface{}) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"command": command,
+		"params":  params,
+	})
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to encode command: %s", err)
+	}
+
+	u := fmt.Sprintf("%s/enterprises/%s/devices/%s:executeCommand", c.APIURL, c.ProjectID, deviceID)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to create request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	response, err := c.httpClient().Do(req)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to connect to sdm: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		status := common.UpstreamStatus(response.StatusCode)
+		if response.StatusCode == http.StatusBadRequest {
+			// SDM rejected the command, not the credentials.
+			status = http.StatusBadRequest
+		}
+		return common.Errorf(status, "unable to execute %s: %s: %s", command, response.Status, message)
+	}
+	return nil
+}
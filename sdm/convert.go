@@ -0,0 +1,206 @@
+package sdm
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/bklimt/relay/nest"
+)
+
+const (
+	thermostatType = "sdm.devices.types.THERMOSTAT"
+
+	infoTrait         = "sdm.devices.traits.Info"
+	connectivityTrait = "sdm.devices.traits.Connectivity"
+	fanTrait          = "sdm.devices.traits.Fan"
+	humidityTrait     = "sdm.devices.traits.Humidity"
+	settingsTrait     = "sdm.devices.traits.Settings"
+	temperatureTrait  = "sdm.devices.traits.Temperature"
+	ecoTrait          = "sdm.devices.traits.ThermostatEco"
+	hvacTrait         = "sdm.devices.traits.ThermostatHvac"
+	modeTrait         = "sdm.devices.traits.ThermostatMode"
+	setpointTrait     = "sdm.devices.traits.ThermostatTemperatureSetpoint"
+
+	structureInfoTrait = "sdm.structures.traits.Info"
+)
+
+// Fetches every device and structure the access token has been granted and
+// returns them in the same shape as the Works with Nest API. The user ID is
+// derived from the structures, since SDM doesn't expose one.
+func (c *Client) GetData(ctx context.Context, accessToken string) (*nest.Data, error) {
+	devices, err := c.ListDevices(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	structures, err := c.ListStructures(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &nest.Data{}
+	data.Metadata.AccessToken = accessToken
+	data.Devices.Thermostats = map[string]*nest.Thermostat{}
+	data.Structures = map[string]*nest.Structure{}
+
+	structureIDs := []string{}
+	for _, structure := range structures {
+		id := lastSegment(structure.Name)
+		structureIDs = append(structureIDs, id)
+		data.Structures[id] = &nest.Structure{
+			StructureID: id,
+			Name:        stringTrait(structure.Traits, structureInfoTrait, "customName"),
+		}
+	}
+	sort.Strings(structureIDs)
+	if len(structureIDs) > 0 {
+		data.Metadata.UserID = "sdm-" + structureIDs[0]
+	} else {
+		data.Metadata.UserID = "sdm-" + c.ProjectID
+	}
+
+	for _, device := range devices {
+		if device.Type != thermostatType {
+			continue
+		}
+		therm := ConvertThermostat(device)
+		data.Devices.Thermostats[therm.DeviceID] = therm
+
+		if s, ok := data.Structures[therm.StructureID]; ok {
+			s.Thermostats = append(s.Thermostats, therm.DeviceID)
+		}
+	}
+
+	return data, nil
+}
+
+// Maps an SDM thermostat's traits onto the fields of a Works with Nest
+// thermostat. Fields with no SDM equivalent are left unset.
+func ConvertThermostat(device *Device) *nest.Thermostat {
+	traits := device.Traits
+	therm := &nest.Thermostat{
+		DeviceID: lastSegment(device.Name),
+	}
+
+	// Names and structure membership.
+	name := stringTrait(traits, infoTrait, "customName")
+	for _, relation := range device.ParentRelations {
+		if name == "" {
+			name = relation.DisplayName
+		}
+		// The parent is enterprises/{project}/structures/{id}/rooms/{room}.
+		parts := strings.Split(relation.Parent, "/")
+		for i := 0; i+1 < len(parts); i++ {
+			if parts[i] == "structures" {
+				therm.StructureID = parts[i+1]
+			}
+		}
+	}
+	if name == "" {
+		name = therm.DeviceID
+	}
+	therm.Name = name
+	therm.NameLong = name + " Thermostat"
+
+	if status := stringTrait(traits, connectivityTrait, "status"); status != "" {
+		therm.IsOnline = nest.Bool(status == "ONLINE")
+	}
+
+	if scale := stringTrait(traits, settingsTrait, "temperatureScale"); scale != "" {
+		therm.TemperatureScale = scale[:1]
+	}
+
+	if humidity, ok := numberTrait(traits, humidityTrait, "ambientHumidityPercent"); ok {
+		therm.Humidity = nest.Float(math.Round(humidity))
+	}
+
+	if ambient, ok := numberTrait(traits, temperatureTrait, "ambientTemperatureCelsius"); ok {
+		nest.SetTemperature(&therm.AmbientTemperatureC, &therm.AmbientTemperatureF, ambient)
+	}
+
+	// HVAC status.
+	therm.HVACState = strings.ToLower(stringTrait(traits, hvacTrait, "status"))
+
+	// Thermostat mode, which Nest reported as "eco" when eco was on.
+	mode := stringTrait(traits, modeTrait, "mode")
+	if mode != "" {
+		therm.HVACMode = hvacMode(mode)
+	}
+	if modes, ok := traits[modeTrait]["availableModes"].([]interface{}); ok {
+		canHeat, canCool := false, false
+		for _, m := range modes {
+			switch m {
+			case "HEAT", "HEATCOOL":
+				canHeat = true
+			}
+			switch m {
+			case "COOL", "HEATCOOL":
+				canCool = true
+			}
+		}
+		therm.CanHeat = nest.Bool(canHeat)
+		therm.CanCool = nest.Bool(canCool)
+	}
+	if stringTrait(traits, ecoTrait, "mode") == "MANUAL_ECO" {
+		if mode != "" {
+			therm.PreviousHVACMode = hvacMode(mode)
+		}
+		therm.HVACMode = "eco"
+	}
+
+	// Eco setpoints.
+	if heat, ok := numberTrait(traits, ecoTrait, "heatCelsius"); ok {
+		nest.SetTemperature(&therm.EcoTemperatureLowC, &therm.EcoTemperatureLowF, heat)
+	}
+	if cool, ok := numberTrait(traits, ecoTrait, "coolCelsius"); ok {
+		nest.SetTemperature(&therm.EcoTemperatureHighC, &therm.EcoTemperatureHighF, cool)
+	}
+
+	// Target setpoints. Nest used a single target unless in heat-cool mode.
+	heat, hasHeat := numberTrait(traits, setpointTrait, "heatCelsius")
+	cool, hasCool := numberTrait(traits, setpointTrait, "coolCelsius")
+	switch {
+	case hasHeat && hasCool:
+		nest.SetTemperature(&therm.TargetTemperatureLowC, &therm.TargetTemperatureLowF, heat)
+		nest.SetTemperature(&therm.TargetTemperatureHighC, &therm.TargetTemperatureHighF, cool)
+	case hasHeat:
+		nest.SetTemperature(&therm.TargetTemperatureC, &therm.TargetTemperatureF, heat)
+	case hasCool:
+		nest.SetTemperature(&therm.TargetTemperatureC, &therm.TargetTemperatureF, cool)
+	}
+
+	// Fan. Thermostats without a fan don't have the trait.
+	fan, hasFan := traits[fanTrait]
+	therm.HasFan = nest.Bool(hasFan)
+	if hasFan {
+		therm.FanTimerActive = nest.Bool(fan["timerMode"] == "ON")
+		if timeout, ok := fan["timerTimeout"].(string); ok {
+			therm.FanTimerTimeout = timeout
+		}
+	}
+
+	therm.Validate()
+	return therm
+}
+
+func hvacMode(mode string) string {
+	if mode == "HEATCOOL" {
+		return "heat-cool"
+	}
+	return strings.ToLower(mode)
+}
+
+func stringTrait(traits map[string]map[string]interface{}, trait, field string) string {
+	s, _ := traits[trait][field].(string)
+	return s
+}
+
+func numberTrait(traits map[string]map[string]interface{}, trait, field string) (float64, bool) {
+	n, ok := traits[trait][field].(float64)
+	return n, ok
+}
+
+func lastSegment(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
@@ -0,0 +1,130 @@
+package sdm
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Returns a thermostat named therm1 in room "Hall" of structure home1, with
+// the given traits.
+func thermostat(traits map[string]map[string]interface{}) *Device {
+	device := &Device{
+		Name:   "enterprises/project1/devices/therm1",
+		Type:   thermostatType,
+		Traits: traits,
+	}
+	device.ParentRelations = append(device.ParentRelations, struct {
+		Parent      string `json:"parent"`
+		DisplayName string `json:"displayName"`
+	}{"enterprises/project1/structures/home1/rooms/room1", "Hall"})
+	return device
+}
+
+func TestConvertThermostat(t *testing.T) {
+	cases := []struct {
+		name   string
+		traits map[string]map[string]interface{}
+		want   map[string]interface{} // Fields that must have these values.
+		unset  []string               // Fields that must be left out.
+	}{{
+		name:   "names",
+		traits: map[string]map[string]interface{}{},
+		want: map[string]interface{}{
+			"device_id":    "therm1",
+			"name":         "Hall",
+			"name_long":    "Hall Thermostat",
+			"structure_id": "home1",
+		},
+		unset: []string{"ambient_temperature_c", "humidity", "hvac_mode", "target_temperature_c"},
+	}, {
+		name:   "custom name",
+		traits: map[string]map[string]interface{}{infoTrait: {"customName": "Upstairs"}},
+		want:   map[string]interface{}{"name": "Upstairs", "name_long": "Upstairs Thermostat"},
+	}, {
+		name: "readings",
+		traits: map[string]map[string]interface{}{
+			connectivityTrait: {"status": "ONLINE"},
+			settingsTrait:     {"temperatureScale": "FAHRENHEIT"},
+			humidityTrait:     {"ambientHumidityPercent": 41.6},
+			temperatureTrait:  {"ambientTemperatureCelsius": 20.6},
+			hvacTrait:         {"status": "HEATING"},
+		},
+		want: map[string]interface{}{
+			"is_online":             true,
+			"temperature_scale":     "F",
+			"humidity":              42.0,
+			"ambient_temperature_c": 20.5,
+			"ambient_temperature_f": 69.0,
+			"hvac_state":            "heating",
+		},
+	}, {
+		name: "heat",
+		traits: map[string]map[string]interface{}{
+			modeTrait:     {"mode": "HEAT", "availableModes": []interface{}{"HEAT", "OFF"}},
+			setpointTrait: {"heatCelsius": 19.0},
+		},
+		want: map[string]interface{}{
+			"hvac_mode":            "heat",
+			"can_heat":             true,
+			"can_cool":             false,
+			"target_temperature_c": 19.0,
+			"target_temperature_f": 66.0,
+		},
+		unset: []string{"target_temperature_low_c", "target_temperature_high_c"},
+	}, {
+		name: "heat-cool",
+		traits: map[string]map[string]interface{}{
+			modeTrait:     {"mode": "HEATCOOL", "availableModes": []interface{}{"HEAT", "COOL", "HEATCOOL", "OFF"}},
+			setpointTrait: {"heatCelsius": 19.0, "coolCelsius": 24.0},
+		},
+		want: map[string]interface{}{
+			"hvac_mode":                 "heat-cool",
+			"can_heat":                  true,
+			"can_cool":                  true,
+			"target_temperature_low_c":  19.0,
+			"target_temperature_high_c": 24.0,
+		},
+		unset: []string{"target_temperature_c"},
+	}, {
+		name: "eco",
+		traits: map[string]map[string]interface{}{
+			modeTrait: {"mode": "COOL"},
+			ecoTrait:  {"mode": "MANUAL_ECO", "heatCelsius": 10.0, "coolCelsius": 28.0},
+		},
+		want: map[string]interface{}{
+			"hvac_mode":              "eco",
+			"previous_hvac_mode":     "cool",
+			"eco_temperature_low_c":  10.0,
+			"eco_temperature_high_c": 28.0,
+			"has_fan":                false,
+		},
+		// Without the traits that say, these aren't known.
+		unset: []string{"can_heat", "can_cool", "is_online", "fan_timer_active"},
+	}, {
+		name:   "fan",
+		traits: map[string]map[string]interface{}{fanTrait: {"timerMode": "ON", "timerTimeout": "2020-01-01T00:15:00Z"}},
+		want: map[string]interface{}{
+			"has_fan":           true,
+			"fan_timer_active":  true,
+			"fan_timer_timeout": "2020-01-01T00:15:00Z",
+		},
+	}, {
+		name:   "invalid",
+		traits: map[string]map[string]interface{}{humidityTrait: {"ambientHumidityPercent": 140.0}, temperatureTrait: {"ambientTemperatureCelsius": "warm"}},
+		unset:  []string{"humidity", "ambient_temperature_c"},
+	}}
+
+	for _, c := range cases {
+		fields := ConvertThermostat(thermostat(c.traits)).Fields()
+		for field, want := range c.want {
+			if got := fields[field]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s is %#v, want %#v", c.name, field, got, want)
+			}
+		}
+		for _, field := range c.unset {
+			if got, ok := fields[field]; ok {
+				t.Errorf("%s: %s is %#v, want it left out", c.name, field, got)
+			}
+		}
+	}
+}
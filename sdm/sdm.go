@@ -0,0 +1,223 @@
+// Package sdm talks to Google's Smart Device Management API, which replaced
+// the Works with Nest API, and maps what it returns into the same shape as
+// the nest package's Data.
+package sdm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+const scope = "https://www.googleapis.com/auth/sdm.service"
+
+// Client talks to the SDM API for a single Device Access project.
+type Client struct {
+	ProjectID    string        // The Device Access project ID.
+	ClientID     string        // The Google oauth client ID.
+	ClientSecret string        // The Google oauth client secret.
+	RedirectURL  string        // Where Google sends users after they authorize.
+	AuthURL      string        // The partner connections page users log in with.
+	TokenURL     string        // The Google oauth token endpoint.
+	APIURL       string        // The root of the SDM API.
+	HTTPClient   *http.Client  // The client used for requests. Defaults to http.DefaultClient.
+	Timeout      time.Duration // How long each call may take. Zero means no limit.
+}
+
+// Returns a client for the production SDM API.
+func NewClient(projectID, clientID, clientSecret, redirectURL string) *Client {
+	return &Client{
+		ProjectID:    projectID,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		AuthURL:      "https://nestservices.google.com/partnerconnections/" + projectID + "/auth",
+		TokenURL:     "https://www.googleapis.com/oauth2/v4/token",
+		APIURL:       "https://smartdevicemanagement.googleapis.com/v1",
+		Timeout:      30 * time.Second,
+	}
+}
+
+// Token is a set of Google oauth credentials.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Device is a device as returned by the SDM API.
+type Device struct {
+	Name            string                            `json:"name"`
+	Type            string                            `json:"type"`
+	Traits          map[string]map[string]interface{} `json:"traits"`
+	ParentRelations []struct {
+		Parent      string `json:"parent"`
+		DisplayName string `json:"displayName"`
+	} `json:"parentRelations"`
+}
+
+// Structure is a structure (home) as returned by the SDM API.
+type Structure struct {
+	Name   string                            `json:"name"`
+	Traits map[string]map[string]interface{} `json:"traits"`
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Returns a context for a single call, limited by the client's timeout.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout > 0 {
+		return context.WithTimeout(ctx, c.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Returns the URL to redirect a user to so they can grant access to their
+// devices. Access is requested offline so that a refresh token is issued.
+func (c *Client) AuthorizationURL(state string) string {
+	values := url.Values{
+		"client_id":     {c.ClientID},
+		"redirect_uri":  {c.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {scope},
+		"access_type":   {"offline"},
+		"prompt":        {"consent"},
+		"state":         {state},
+	}
+	return fmt.Sprintf("%s?%s", c.AuthURL, values.Encode())
+}
+
+// Exchanges an authorization code for an access token and refresh token.
+func (c *Client) Exchange(ctx context.Context, code string) (*Token, error) {
+	return c.requestToken(ctx, url.Values{
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {c.RedirectURL},
+	})
+}
+
+// Gets a new access token using a refresh token. Google doesn't always
+// return a new refresh token, so the one passed in is kept if it doesn't.
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	token, err := c.requestToken(ctx, url.Values{
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+		"refresh_token": {refreshToken},
+		"grant_type":    {"refresh_token"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+func (c *Client) requestToken(ctx context.Context, values url.Values) (*Token, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", c.TokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to create request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to connect to google: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to read token body: %s", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, common.Errorf(common.TokenStatus(response.StatusCode, body), "unable to get token: %s: %s", response.Status, body)
+	}
+	tr := &tokenResponse{}
+	if err := json.Unmarshal(body, tr); err != nil {
+		return nil, common.Errorf(http.StatusInternalServerError, "unable to parse json: %s", err)
+	}
+	return &Token{
+		AccessToken:  tr.AccessToken,
+		RefreshToken: tr.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// Fetches path under the project and parses the JSON response into v.
+func (c *Client) get(ctx context.Context, accessToken, path string, v interface{}) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	u := fmt.Sprintf("%s/enterprises/%s/%s", c.APIURL, c.ProjectID, path)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to create request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	response, err := c.httpClient().Do(req)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to connect to sdm: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to read %s body: %s", path, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return common.Errorf(common.UpstreamStatus(response.StatusCode), "unable to get %s: %s: %s", path, response.Status, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return common.Errorf(http.StatusInternalServerError, "unable to parse json: %s", err)
+	}
+	return nil
+}
+
+// Lists every device the access token has been granted.
+func (c *Client) ListDevices(ctx context.Context, accessToken string) ([]*Device, error) {
+	var response struct {
+		Devices []*Device `json:"devices"`
+	}
+	if err := c.get(ctx, accessToken, "devices", &response); err != nil {
+		return nil, err
+	}
+	return response.Devices, nil
+}
+
+// Lists every structure the access token has been granted.
+func (c *Client) ListStructures(ctx context.Context, accessToken string) ([]*Structure, error) {
+	var response struct {
+		Structures []*Structure `json:"structures"`
+	}
+	if err := c.get(ctx, accessToken, "structures", &response); err != nil {
+		return nil, err
+	}
+	return response.Structures, nil
+}
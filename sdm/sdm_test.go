@@ -0,0 +1,139 @@
+package sdm_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/sdm"
+	"github.com/bklimt/relay/sdm/sdmtest"
+)
+
+// Returns a fake SDM server with one user, who logs in with code "code1"
+// and has a thermostat in the Hall and a camera.
+func newFake(t *testing.T) *sdmtest.Server {
+	fake := sdmtest.NewServer("project1", "client-id", "client-secret")
+	t.Cleanup(fake.Close)
+
+	therm := &sdm.Device{
+		Name: "devices/therm1",
+		Type: "sdm.devices.types.THERMOSTAT",
+		Traits: map[string]map[string]interface{}{
+			"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 20.5},
+		},
+	}
+	therm.ParentRelations = append(therm.ParentRelations, struct {
+		Parent      string `json:"parent"`
+		DisplayName string `json:"displayName"`
+	}{"structures/home1/rooms/room1", "Hall"})
+	camera := &sdm.Device{Name: "devices/camera1", Type: "sdm.devices.types.CAMERA"}
+	home := &sdm.Structure{
+		Name:   "structures/home1",
+		Traits: map[string]map[string]interface{}{"sdm.structures.traits.Info": {"customName": "Home"}},
+	}
+	fake.AddUser("code1", "refresh1", "token1", []*sdm.Device{therm, camera}, []*sdm.Structure{home})
+	return fake
+}
+
+func TestAuthorizationURL(t *testing.T) {
+	client := newFake(t).Client()
+	authURL, err := url.Parse(client.AuthorizationURL("state1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authURL.Query()
+	if query.Get("state") != "state1" || query.Get("client_id") != "client-id" || query.Get("access_type") != "offline" {
+		t.Errorf("unexpected authorization URL %s", authURL)
+	}
+}
+
+func TestExchangeAndRefresh(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	ctx := context.Background()
+
+	token, err := client.Exchange(ctx, "code1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token1" || token.RefreshToken != "refresh1" || !token.Expiry.After(time.Now()) {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if _, err := client.Exchange(ctx, "code1"); common.Status(err) != http.StatusForbidden {
+		t.Errorf("reused code returned %v, want forbidden", err)
+	}
+
+	// Google doesn't send a new refresh token, so the old one is kept.
+	token, err = client.Refresh(ctx, "refresh1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token1" || token.RefreshToken != "refresh1" {
+		t.Errorf("unexpected refreshed token %+v", token)
+	}
+	if fake.Refreshes() != 1 {
+		t.Errorf("served %d refreshes, want 1", fake.Refreshes())
+	}
+
+	// A revoked refresh token means the user has to log in again.
+	if _, err := client.Refresh(ctx, "revoked"); common.Status(err) != http.StatusForbidden {
+		t.Errorf("revoked refresh token returned %v, want forbidden", err)
+	}
+}
+
+func TestGetData(t *testing.T) {
+	client := newFake(t).Client()
+
+	data, err := client.GetData(context.Background(), "token1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Metadata.UserID != "sdm-home1" || data.Metadata.AccessToken != "token1" {
+		t.Errorf("unexpected metadata %+v", data.Metadata)
+	}
+	if len(data.Devices.Thermostats) != 1 {
+		t.Fatalf("got %d thermostats, want only therm1", len(data.Devices.Thermostats))
+	}
+	therm := data.Devices.Thermostats["therm1"]
+	if therm == nil || therm.Name != "Hall" || therm.StructureID != "home1" || therm.AmbientTemperatureC == nil || *therm.AmbientTemperatureC != 20.5 {
+		t.Errorf("unexpected thermostat %+v", therm)
+	}
+	home := data.Structures["home1"]
+	if home == nil || home.Name != "Home" || len(home.Thermostats) != 1 || home.Thermostats[0] != "therm1" {
+		t.Errorf("unexpected structure %+v", home)
+	}
+
+	if _, err := client.GetData(context.Background(), "bogus"); common.Status(err) != http.StatusForbidden {
+		t.Errorf("bad token returned %v, want forbidden", err)
+	}
+}
+
+func TestExecuteCommand(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	ctx := context.Background()
+
+	const command = "sdm.devices.commands.ThermostatMode.SetMode"
+	if err := client.ExecuteCommand(ctx, "token1", "therm1", command, map[string]interface{}{"mode": "HEAT"}); err != nil {
+		t.Fatal(err)
+	}
+	commands := fake.Commands("therm1")
+	if len(commands) != 1 || commands[0].Command != command || commands[0].Params["mode"] != "HEAT" {
+		t.Errorf("unexpected commands %+v", commands)
+	}
+
+	// SDM rejecting a command is the caller's fault, not the credentials'.
+	fake.FailCommands("therm1", http.StatusBadRequest)
+	err := client.ExecuteCommand(ctx, "token1", "therm1", command, map[string]interface{}{"mode": "HEAT"})
+	if common.Status(err) != http.StatusBadRequest || !strings.Contains(err.Error(), "400") {
+		t.Errorf("rejected command returned %v, want a bad request", err)
+	}
+	fake.FailCommands("therm1", http.StatusInternalServerError)
+	if err := client.ExecuteCommand(ctx, "token1", "therm1", command, nil); common.Status(err) != http.StatusBadGateway {
+		t.Errorf("failed command returned %v, want a bad gateway", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Package sdmtest provides a fake Smart Device Management API server for
+// hermetic tests.
+package sdmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bklimt/relay/sdm"
+)
+
+// Command is a command executed on a device.
+type Command struct {
+	Command string                 `json:"command"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+// Server is a fake SDM API. It serves the Google oauth token endpoint at
+// /token, and the API for a single project under /v1.
+type Server struct {
+	*httptest.Server
+
+	ProjectID    string
+	ClientID     string
+	ClientSecret string
+
+	mu         sync.Mutex
+	codes      map[string]string    // authorization code -> refresh token
+	refresh    map[string]string    // refresh token -> access token
+	users      map[string]*user     // access token -> user
+	commands   map[string][]Command // device ID -> commands executed
+	refreshes  int                  // number of refreshes served
+	commandErr map[string]int       // device ID -> status to fail commands with
+}
+
+type user struct {
+	devices    []*sdm.Device
+	structures []*sdm.Structure
+}
+
+// Starts a new fake SDM server for the given project that accepts the given
+// client credentials. Callers should call Close when done.
+func NewServer(projectID, clientID, clientSecret string) *Server {
+	s := &Server{
+		ProjectID:    projectID,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		codes:        map[string]string{},
+		refresh:      map[string]string{},
+		users:        map[string]*user{},
+		commands:     map[string][]Command{},
+		commandErr:   map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/v1/enterprises/"+projectID+"/", s.handleAPI)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Returns an sdm.Client that talks to this server.
+func (s *Server) Client() *sdm.Client {
+	return &sdm.Client{
+		ProjectID:    s.ProjectID,
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		RedirectURL:  "https://relay.example.com/oauth",
+		AuthURL:      s.URL + "/auth",
+		TokenURL:     s.URL + "/token",
+		APIURL:       s.URL + "/v1",
+		HTTPClient:   s.Server.Client(),
+		Timeout:      10 * time.Second,
+	}
+}
+
+// Registers a user. Exchanging code at the token endpoint yields
+// accessToken and refreshToken, and refreshing with refreshToken yields
+// accessToken again. Listing with accessToken returns devices and
+// structures, whose names should be relative to the project, like
+// "devices/therm1".
+func (s *Server) AddUser(code, refreshToken, accessToken string, devices []*sdm.Device, structures []*sdm.Structure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, device := range devices {
+		device.Name = s.resourceName(device.Name)
+		for i := range device.ParentRelations {
+			device.ParentRelations[i].Parent = s.resourceName(device.ParentRelations[i].Parent)
+		}
+	}
+	for _, structure := range structures {
+		structure.Name = s.resourceName(structure.Name)
+	}
+	s.codes[code] = refreshToken
+	s.refresh[refreshToken] = accessToken
+	s.users[accessToken] = &user{devices: devices, structures: structures}
+}
+
+// Returns name as a full resource name in the project.
+func (s *Server) resourceName(name string) string {
+	return fmt.Sprintf("enterprises/%s/%s", s.ProjectID, name)
+}
+
+// Makes every command sent to the given device fail with status, or succeed
+// again if status is zero.
+func (s *Server) FailCommands(deviceID string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commandErr[deviceID] = status
+}
+
+// Returns the commands executed on the given device so far, in order.
+func (s *Server) Commands(deviceID string) []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Command{}, s.commands[deviceID]...)
+}
+
+// Returns the number of refresh tokens exchanged so far.
+func (s *Server) Refreshes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes
+}
+
+// Writes an oauth error, the way Google does.
+func tokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("client_id") != s.ClientID || r.PostForm.Get("client_secret") != s.ClientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := map[string]interface{}{"expires_in": 3600}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		refreshToken, ok := s.codes[code]
+		if !ok {
+			tokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		// Codes can only be used once.
+		delete(s.codes, code)
+		response["access_token"] = s.refresh[refreshToken]
+		response["refresh_token"] = refreshToken
+	case "refresh_token":
+		// Like Google, refreshing doesn't issue a new refresh token.
+		accessToken, ok := s.refresh[r.PostForm.Get("refresh_token")]
+		if !ok {
+			tokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		s.refreshes++
+		response["access_token"] = accessToken
+	default:
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	if !ok {
+		http.Error(w, "invalid access token", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/enterprises/"+s.ProjectID+"/")
+	switch {
+	case path == "devices" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": u.devices})
+	case path == "structures" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"structures": u.structures})
+	case strings.HasPrefix(path, "devices/") && strings.HasSuffix(path, ":executeCommand") && r.Method == "POST":
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "devices/"), ":executeCommand")
+		s.executeCommand(w, r, u, id)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// Records a command for the device. s.mu must be held.
+func (s *Server) executeCommand(w http.ResponseWriter, r *http.Request, u *user, id string) {
+	found := false
+	for _, device := range u.devices {
+		if device.Name == s.resourceName("devices/"+id) {
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("unknown device %q", id), http.StatusNotFound)
+		return
+	}
+	if status := s.commandErr[id]; status != 0 {
+		http.Error(w, "command failed", status)
+		return
+	}
+
+	var cmd Command
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.commands[id] = append(s.commands[id], cmd)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
@@ -0,0 +1,180 @@
+package relay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// DeviceKey is a secret a sensor uses to sign its requests. A sensor can have
+// several at once, so that a new key can be rolled out before the old one is
+// revoked.
+type DeviceKey struct {
+	Secret    string    `firestore:"secret" json:"secret,omitempty"`
+	Created   time.Time `firestore:"created" json:"created"`
+	Revoked   bool      `firestore:"revoked" json:"revoked"`
+	RevokedAt time.Time `firestore:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// SignedRequest is the part of a request from a sensor covered by its
+// signature.
+type SignedRequest struct {
+	Device    string // The device ID the request is from.
+	KeyID     string // Which of the device's keys signed it.
+	Timestamp string // When it was signed, in Unix seconds.
+	Signature string // The hex HMAC-SHA256 of the message, as sent.
+	Method    string
+	Path      string
+	Body      []byte
+}
+
+// Returns the bytes a request's signature is computed over: the timestamp,
+// method, and path on their own lines, followed by the body.
+func (req *SignedRequest) message() []byte {
+	msg := []byte(fmt.Sprintf("%s\n%s\n%s\n", req.Timestamp, req.Method, req.Path))
+	return append(msg, req.Body...)
+}
+
+// Returns the hex HMAC-SHA256 signature of the request with the given secret.
+func Sign(secret string, req *SignedRequest) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(req.message())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Creates a new key for the sensor with the given ID and returns its ID and
+// the key. The secret is only ever returned here.
+func CreateDeviceKey(ctx context.Context, store Store, device string) (string, *DeviceKey, error) {
+	if device != LegacyDeviceID {
+		reg, err := store.GetRegistration(ctx, device)
+		if err != nil {
+			return "", nil, err
+		}
+		if reg == nil {
+			return "", nil, common.Errorf(http.StatusNotFound, "unknown device %q", device)
+		}
+	}
+
+	id, err := newDocID()
+	if err != nil {
+		return "", nil, common.Errorf(http.StatusInternalServerError, "unable to generate key ID: %s", err)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, common.Errorf(http.StatusInternalServerError, "unable to generate key: %s", err)
+	}
+
+	key := &DeviceKey{
+		Secret:  hex.EncodeToString(secret),
+		Created: time.Now().UTC(),
+	}
+	if err := store.SaveDeviceKey(ctx, device, id, key); err != nil {
+		return "", nil, err
+	}
+	return id, key, nil
+}
+
+// Revokes one of a sensor's keys. Requests signed with it are rejected from
+// then on.
+func RevokeDeviceKey(ctx context.Context, store Store, device, id string) error {
+	keys, err := store.GetDeviceKeys(ctx, device)
+	if err != nil {
+		return err
+	}
+	key, ok := keys[id]
+	if !ok {
+		return common.Errorf(http.StatusNotFound, "device %q has no key %q", device, id)
+	}
+	if key.Revoked {
+		return nil
+	}
+	key.Revoked = true
+	key.RevokedAt = time.Now().UTC()
+	return store.SaveDeviceKey(ctx, device, id, key)
+}
+
+// Returns whether the sensor with the given ID has any keys that haven't
+// been revoked.
+func HasDeviceKeys(ctx context.Context, store Store, device string) (bool, error) {
+	keys, err := store.GetDeviceKeys(ctx, device)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if !key.Revoked {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Verifier checks the signatures on requests from sensors. Each signature is
+// only accepted once, and only within Window of its timestamp.
+type Verifier struct {
+	Store  Store
+	Window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time // signature -> timestamp
+}
+
+func NewVerifier(store Store, window time.Duration) *Verifier {
+	return &Verifier{
+		Store:  store,
+		Window: window,
+		seen:   map[string]time.Time{},
+	}
+}
+
+// Checks that the request was signed by one of the device's current keys,
+// recently, and hasn't been seen before.
+func (v *Verifier) Verify(ctx context.Context, req *SignedRequest) error {
+	if req.KeyID == "" || req.Timestamp == "" || req.Signature == "" {
+		return common.Errorf(http.StatusUnauthorized, "request from %s is not signed", req.Device)
+	}
+
+	seconds, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return common.Errorf(http.StatusUnauthorized, "invalid signature timestamp %q", req.Timestamp)
+	}
+	signed := time.Unix(seconds, 0)
+	now := time.Now()
+	if signed.Before(now.Add(-v.Window)) || signed.After(now.Add(v.Window)) {
+		return common.Errorf(http.StatusUnauthorized, "signature timestamp %s is outside of the %s window", signed.UTC().Format(time.RFC3339), v.Window)
+	}
+
+	keys, err := v.Store.GetDeviceKeys(ctx, req.Device)
+	if err != nil {
+		return err
+	}
+	key, ok := keys[req.KeyID]
+	if !ok || key.Revoked {
+		return common.Errorf(http.StatusUnauthorized, "unknown or revoked key %q for %s", req.KeyID, req.Device)
+	}
+	expected := Sign(key.Secret, req)
+	if !hmac.Equal([]byte(expected), []byte(req.Signature)) {
+		return common.Errorf(http.StatusUnauthorized, "invalid signature from %s", req.Device)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for sig, t := range v.seen {
+		if t.Before(now.Add(-v.Window)) {
+			delete(v.seen, sig)
+		}
+	}
+	if _, ok := v.seen[req.Signature]; ok {
+		return common.Errorf(http.StatusUnauthorized, "request from %s has already been received", req.Device)
+	}
+	v.seen[req.Signature] = signed
+	return nil
+}
@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+)
+
+// Returns a store with a registered device "garage" that has one key, and
+// the key's ID and secret.
+func newSigningStore(t *testing.T) (*MemoryStore, string, string) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	if err := RegisterDevice(ctx, store, "garage", &Registration{}); err != nil {
+		t.Fatal(err)
+	}
+	id, key, err := CreateDeviceKey(ctx, store, "garage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, id, key.Secret
+}
+
+// Returns a request from garage signed at the given time.
+func signedRequest(keyID, secret string, at time.Time, body string) *SignedRequest {
+	req := &SignedRequest{
+		Device:    "garage",
+		KeyID:     keyID,
+		Timestamp: strconv.FormatInt(at.Unix(), 10),
+		Method:    "POST",
+		Path:      "/log/garage",
+		Body:      []byte(body),
+	}
+	req.Signature = Sign(secret, req)
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	store, id, secret := newSigningStore(t)
+	verifier := NewVerifier(store, 5*time.Minute)
+	ctx := context.Background()
+
+	req := signedRequest(id, secret, time.Now(), `{"temperature": 20}`)
+	if err := verifier.Verify(ctx, req); err != nil {
+		t.Fatalf("valid request was rejected: %s", err)
+	}
+	if err := verifier.Verify(ctx, req); err == nil {
+		t.Errorf("replayed request was accepted")
+	}
+
+	// Changing anything covered by the signature invalidates it.
+	tampered := signedRequest(id, secret, time.Now().Add(time.Second), `{"temperature": 20}`)
+	tampered.Body = []byte(`{"temperature": 30}`)
+	if err := verifier.Verify(ctx, tampered); err == nil {
+		t.Errorf("request with a changed body was accepted")
+	}
+	tampered = signedRequest(id, secret, time.Now().Add(2*time.Second), `{}`)
+	tampered.Path = "/log/other"
+	if err := verifier.Verify(ctx, tampered); err == nil {
+		t.Errorf("request with a changed path was accepted")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	store, id, secret := newSigningStore(t)
+	ctx := context.Background()
+
+	unsigned := &SignedRequest{Device: "garage", Method: "POST", Path: "/log/garage"}
+	cases := map[string]*SignedRequest{
+		"unsigned":     unsigned,
+		"too old":      signedRequest(id, secret, time.Now().Add(-10*time.Minute), `{}`),
+		"too new":      signedRequest(id, secret, time.Now().Add(10*time.Minute), `{}`),
+		"unknown key":  signedRequest("bogus", secret, time.Now(), `{}`),
+		"wrong secret": signedRequest(id, "bogus", time.Now(), `{}`),
+	}
+	for name, req := range cases {
+		err := NewVerifier(store, 5*time.Minute).Verify(ctx, req)
+		if err == nil {
+			t.Errorf("%s: request was accepted", name)
+		} else if status := common.Status(err); status != http.StatusUnauthorized {
+			t.Errorf("%s: status is %d, want %d", name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestRevokeDeviceKey(t *testing.T) {
+	store, id, secret := newSigningStore(t)
+	ctx := context.Background()
+
+	if has, err := HasDeviceKeys(ctx, store, "garage"); err != nil || !has {
+		t.Fatalf("HasDeviceKeys = %v, %v, want true", has, err)
+	}
+	if err := RevokeDeviceKey(ctx, store, "garage", id); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := HasDeviceKeys(ctx, store, "garage"); err != nil || has {
+		t.Errorf("HasDeviceKeys = %v, %v after revoking, want false", has, err)
+	}
+	if err := NewVerifier(store, 5*time.Minute).Verify(ctx, signedRequest(id, secret, time.Now(), `{}`)); err == nil {
+		t.Errorf("request signed with a revoked key was accepted")
+	}
+	if err := RevokeDeviceKey(ctx, store, "garage", "bogus"); common.Status(err) != http.StatusNotFound {
+		t.Errorf("revoking an unknown key returned %v, want not found", err)
+	}
+}
+
+func TestCreateDeviceKeyRequiresRegistration(t *testing.T) {
+	_, _, err := CreateDeviceKey(context.Background(), NewMemoryStore(), "unregistered")
+	if common.Status(err) != http.StatusNotFound {
+		t.Errorf("creating a key for an unregistered device returned %v, want not found", err)
+	}
+}
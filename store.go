@@ -0,0 +1,352 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+
+	firebase "firebase.google.com/go"
+)
+
+// User is a Nest account that relay has been authorized to read.
+type User struct {
+	Provider     string `firestore:"provider,omitempty" json:"provider,omitempty"` // Empty for the legacy Nest API.
+	AccessToken  string `firestore:"access_token" json:"access_token"`
+	RefreshToken string `firestore:"refresh_token,omitempty" json:"refresh_token,omitempty"`
+
+	// When the access token expires. Zero if the provider didn't say.
+	Expiry time.Time `firestore:"expiry,omitempty" json:"expiry,omitempty"`
+
+	// Set when the user's credentials stopped working and they have to log
+	// in again. Cleared by logging in.
+	NeedsReauth  bool   `firestore:"needs_reauth" json:"needs_reauth"`
+	ReauthReason string `firestore:"reauth_reason,omitempty" json:"reauth_reason,omitempty"`
+}
+
+// Returns the name of the provider the user's data comes from.
+func (u *User) ProviderName() string {
+	if u.Provider == "" {
+		return NestProviderName
+	}
+	return u.Provider
+}
+
+// Registration is the metadata for a sensor, like a Feather, that posts
+// readings to /log/{device}.
+type Registration struct {
+	Name       string `firestore:"name,omitempty" json:"name,omitempty"`               // A human-readable name.
+	Location   string `firestore:"location,omitempty" json:"location,omitempty"`       // Where it is, e.g. "garage".
+	SensorType string `firestore:"sensor_type,omitempty" json:"sensor_type,omitempty"` // What it measures with, e.g. "bme280".
+	Owner      string `firestore:"owner,omitempty" json:"owner,omitempty"`             // Who to ask about it.
+
+	// What the sensor's readings look like. If nil, any reading is accepted.
+	Schema *Schema `firestore:"schema,omitempty" json:"schema,omitempty"`
+}
+
+// The kinds of entries kept for each device, named after the subcollections
+// of device/{name} that hold them.
+const (
+	DeviceLog        = "log"
+	DeviceQuarantine = "quarantine"
+	DeviceCommand    = "command"
+	DeviceRollupHour = "rollup_" + RollupHour
+	DeviceRollupDay  = "rollup_" + RollupDay
+)
+
+// The kind of entry in a structure's running log, structure/{name}/log. It's
+// listed and deleted like a device's entries, by structure name.
+const StructureLog = "structure_log"
+
+// Store is the persistence layer for relay. It holds oauth state tokens,
+// authorized users, registered sensors, the latest snapshot of each device,
+// and each device's running log.
+type Store interface {
+	// Creates a new, unused oauth state token and returns it.
+	CreateAuthState(ctx context.Context) (string, error)
+	// Marks an oauth state token as used. Fails if the token is unknown or
+	// has already been used. The check and the update are atomic, so each
+	// token can only be used once, even by concurrent requests.
+	UseAuthState(ctx context.Context, state string) error
+
+	// Creates or replaces the user with the given ID.
+	SaveUser(ctx context.Context, id string, user *User) error
+	// Saves the raw data for a thermostat belonging to the given user.
+	SaveUserThermostat(ctx context.Context, userID, id string, data map[string]interface{}) error
+	// Saves the raw data for a structure belonging to the given user.
+	SaveUserStructure(ctx context.Context, userID, id string, data map[string]interface{}) error
+	// Returns every user, keyed by user ID.
+	GetUsers(ctx context.Context) (map[string]*User, error)
+
+	// Creates or replaces the registration for the sensor with the given ID.
+	SaveRegistration(ctx context.Context, id string, reg *Registration) error
+	// Returns the registration for the sensor with the given ID, or nil if
+	// it isn't registered.
+	GetRegistration(ctx context.Context, id string) (*Registration, error)
+	// Returns every registered sensor, keyed by device ID.
+	GetRegistrations(ctx context.Context) (map[string]*Registration, error)
+	// Creates or replaces one of the signing keys for the sensor with the
+	// given ID.
+	SaveDeviceKey(ctx context.Context, device, id string, key *DeviceKey) error
+	// Returns every signing key for the sensor, including revoked ones, keyed
+	// by key ID.
+	GetDeviceKeys(ctx context.Context, device string) (map[string]*DeviceKey, error)
+
+	// Replaces the latest snapshot for the named device and appends the same
+	// data to the device's running log under key, atomically, so the log is
+	// never missing an entry the snapshot shows. The store sets the
+	// "timestamp" field to the time of the write.
+	LogDevice(ctx context.Context, name, key string, data map[string]interface{}) error
+	// Saves a reading that didn't match the named device's schema to the
+	// device's quarantine log under key, without changing its snapshot.
+	QuarantineReading(ctx context.Context, name, key string, data map[string]interface{}) error
+	// Appends entries to the named device's running log, keyed by log key,
+	// skipping any key that's already in the log. If snapshot isn't nil, it
+	// replaces the device's latest snapshot. The store sets the "timestamp"
+	// field of each to the time of the write. Returns the set of keys that
+	// were added.
+	AppendDeviceLog(ctx context.Context, name string, entries map[string]map[string]interface{}, snapshot map[string]interface{}) (map[string]bool, error)
+	// Returns the entries of the named device's running log selected by q,
+	// in key order.
+	QueryDeviceLog(ctx context.Context, name string, q *LogQuery) ([]*LogEntry, error)
+	// Returns the latest snapshot of every device, keyed by device name.
+	GetDevices(ctx context.Context) (map[string]map[string]interface{}, error)
+	// Returns the latest snapshot of the named device, or nil if there
+	// isn't one.
+	GetDevice(ctx context.Context, name string) (map[string]interface{}, error)
+
+	// Reads the named device's rollups for the period at the given resolution
+	// ("hour" or "day") starting at start, passes them to update to modify,
+	// and writes them back, atomically. If there are no rollups for the
+	// period yet, update is passed an empty one.
+	UpdateRollup(ctx context.Context, name, resolution string, start time.Time, update func(*RollupPeriod)) error
+	// Returns the named device's rollups at the given resolution for the
+	// periods starting in [from, to), in time order.
+	QueryRollups(ctx context.Context, name, resolution string, from, to time.Time) ([]*RollupPeriod, error)
+
+	// Returns the keys of up to limit of the named device's entries of the
+	// given kind, such as DeviceLog, that sort after after and before
+	// before, in key order. An empty after starts from the first entry. With
+	// StructureLog, name is a structure's instead.
+	ListDeviceEntries(ctx context.Context, name, kind, after, before string, limit int) ([]string, error)
+	// Deletes the named device's entries of the given kind with the given
+	// keys. Keys that don't exist are ignored.
+	DeleteDeviceEntries(ctx context.Context, name, kind string, keys []string) error
+
+	// Appends a command sent to the named device to the device's command
+	// log under key.
+	LogCommand(ctx context.Context, name, key string, data map[string]interface{}) error
+
+	// Replaces the latest snapshot for the named structure and appends the
+	// same data to the structure's running log under key, just like
+	// LogDevice.
+	LogStructure(ctx context.Context, name, key string, data map[string]interface{}) error
+	// Returns the latest snapshot of every structure, keyed by structure
+	// name.
+	GetStructures(ctx context.Context) (map[string]map[string]interface{}, error)
+
+	// Releases any resources held by the store.
+	Close() error
+}
+
+// Opens the store selected by cfg.Store, which records metrics for every
+// call. The app is only used by the Firestore store, and may be nil
+// otherwise.
+func OpenStore(cfg *Config, app *firebase.App) (Store, error) {
+	store, err := openStore(cfg, app)
+	if err != nil {
+		return nil, err
+	}
+	return InstrumentStore(cfg.Store, store), nil
+}
+
+func openStore(cfg *Config, app *firebase.App) (Store, error) {
+	switch cfg.Store {
+	case "firestore":
+		if app == nil {
+			return nil, fmt.Errorf("firestore store requires firebase")
+		}
+		// One client is shared by the whole process.
+		client, err := app.Firestore(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize firestore: %s", err)
+		}
+		return NewFirestoreStore(client), nil
+	case "bolt":
+		return NewBoltStore(cfg.BoltPath)
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+func GenerateStateToken(ctx context.Context, store Store) (string, error) {
+	return store.CreateAuthState(ctx)
+}
+
+func CheckState(ctx context.Context, store Store, state string) error {
+	return store.UseAuthState(ctx, state)
+}
+
+// Saves a newly authorized user along with their thermostats.
+func SaveNestData(ctx context.Context, store Store, user *User, data *nest.Data) error {
+	userID := data.Metadata.UserID
+	if err := store.SaveUser(ctx, userID, user); err != nil {
+		return err
+	}
+
+	for id, therm := range data.Devices.Thermostats {
+		if err := store.SaveUserThermostat(ctx, userID, id, therm.Fields()); err != nil {
+			return err
+		}
+	}
+
+	for id, structure := range data.Structures {
+		if err := store.SaveUserStructure(ctx, userID, id, structure.Fields()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Logs every device and structure in data under key, and adds the devices'
+// numeric fields to their rollups and metrics.
+//
+// The store takes documents as maps, so each device is written as its
+// Fields(). Those come from the typed model rather than from the API's
+// JSON: a declared field is always written with the type it's declared
+// with, numbers are always float64, and missing or invalid values are left
+// out instead of being written as zero.
+func LogNestData(ctx context.Context, store Store, key string, data *nest.Data) error {
+	for id, therm := range data.Devices.Thermostats {
+		name := therm.Name
+		if name == "" {
+			name = id
+		}
+		for _, problem := range therm.Problems {
+			log.Printf("Thermostat %s: %s", name, problem)
+		}
+		fields := therm.Fields()
+		if err := store.LogDevice(ctx, name, key, fields); err != nil {
+			return err
+		}
+		deviceLogged(ctx, store, name, fields)
+	}
+
+	for id, alarm := range data.Devices.SmokeCOAlarms {
+		name := nestDeviceName(alarm.NameLong, alarm.Name, id)
+		for _, problem := range alarm.Problems {
+			log.Printf("Smoke alarm %s: %s", name, problem)
+		}
+		fields := alarm.Fields()
+		fields["device_type"] = "smoke_co_alarm"
+
+		previous, err := store.GetDevice(ctx, name)
+		if err != nil {
+			return err
+		}
+		CheckAlarm(name, previous, fields)
+
+		if err := store.LogDevice(ctx, name, key, fields); err != nil {
+			return err
+		}
+		deviceLogged(ctx, store, name, fields)
+	}
+
+	for id, camera := range data.Devices.Cameras {
+		name := nestDeviceName(camera.NameLong, camera.Name, id)
+		for _, problem := range camera.Problems {
+			log.Printf("Camera %s: %s", name, problem)
+		}
+		fields := camera.Fields()
+		fields["device_type"] = "camera"
+		if err := store.LogDevice(ctx, name, key, fields); err != nil {
+			return err
+		}
+		deviceLogged(ctx, store, name, fields)
+	}
+
+	for id, structure := range data.Structures {
+		name := structure.Name
+		if name == "" {
+			name = id
+		}
+		for _, problem := range structure.Problems {
+			log.Printf("Structure %s: %s", name, problem)
+		}
+
+		// Record which thermostats are in eco mode, since Nest sets them all
+		// to eco when everyone leaves.
+		fields := structure.Fields()
+		eco := []string{}
+		for _, thermID := range structure.Thermostats {
+			if therm, ok := data.Devices.Thermostats[thermID]; ok && therm.HVACMode == "eco" {
+				eco = append(eco, thermID)
+			}
+		}
+		fields["eco_thermostats"] = eco
+
+		if err := store.LogStructure(ctx, name, key, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the document name for a Nest Protect or camera. They're often
+// named after the same room as a thermostat, so the long name is preferred
+// to keep them from overwriting each other.
+func nestDeviceName(nameLong, name, id string) string {
+	if nameLong != "" {
+		return nameLong
+	}
+	if name != "" {
+		return name
+	}
+	return id
+}
+
+// Saves a reading from the legacy, unnamed Feather.
+func LogFeatherData(ctx context.Context, store Store, key string, data map[string]interface{}) error {
+	return LogSensorData(ctx, store, LegacyDeviceID, key, data)
+}
+
+// Returns a map of device name to timestamp.
+func GetMostRecentDeviceTimestamps(ctx context.Context, store Store) (map[string]time.Time, error) {
+	devices, err := store.GetDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps := map[string]time.Time{}
+	for name, data := range devices {
+		if timestamp, ok := data["timestamp"].(time.Time); ok {
+			timestamps[name] = timestamp
+		} else {
+			return nil, common.Errorf(
+				http.StatusInternalServerError,
+				"device %s has invalid timestamp: %v", name, data["timestamp"])
+		}
+	}
+
+	return timestamps, nil
+}
+
+// Returns a map of user ID to user, checking that every user has a token.
+func GetNestUsers(ctx context.Context, store Store) (map[string]*User, error) {
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		return map[string]*User{}, err
+	}
+
+	for id, user := range users {
+		if user.AccessToken == "" && user.RefreshToken == "" {
+			return users, common.Errorf(http.StatusInternalServerError, "user missing access token: %s", id)
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+)
+
+// Checks the basic operations of a store: oauth state, users, and device
+// logs.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	state, err := store.CreateAuthState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UseAuthState(ctx, state); err != nil {
+		t.Errorf("unable to use new state: %s", err)
+	}
+	if err := store.UseAuthState(ctx, state); common.Status(err) != http.StatusForbidden {
+		t.Errorf("reusing state returned %v, want forbidden", err)
+	}
+	if err := store.UseAuthState(ctx, "unknown"); common.Status(err) != http.StatusForbidden {
+		t.Errorf("unknown state returned %v, want forbidden", err)
+	}
+
+	// Only one of several concurrent logins with the same state gets in.
+	state, err = store.CreateAuthState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var used int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if store.UseAuthState(ctx, state) == nil {
+				atomic.AddInt32(&used, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if used != 1 {
+		t.Errorf("state was used %d times, want once", used)
+	}
+
+	if err := store.SaveUser(ctx, "user1", &User{AccessToken: "token1"}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users["user1"] == nil || users["user1"].AccessToken != "token1" {
+		t.Errorf("got users %v, want user1", users)
+	}
+
+	before := time.Now().UTC()
+	for _, key := range []string{"2019-01-02T03:04:05Z", "2019-01-02T03:04:06Z"} {
+		if err := store.LogDevice(ctx, "hall", key, map[string]interface{}{"t": 20.5, "key": key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices, err := store.GetDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hall := devices["hall"]
+	if len(devices) != 1 || hall == nil || hall["key"] != "2019-01-02T03:04:06Z" || hall["t"] != 20.5 {
+		t.Errorf("got devices %v, want the latest hall snapshot", devices)
+	}
+	if timestamp, ok := hall["timestamp"].(time.Time); !ok || timestamp.Before(before) {
+		t.Errorf("snapshot has timestamp %v, want the time it was written", hall["timestamp"])
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is still there when the file is opened again.
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	users, err := store.GetUsers(context.Background())
+	if err != nil || len(users) != 1 {
+		t.Errorf("reopened store has users %v: %v", users, err)
+	}
+}
+
+// Runs against the Firestore emulator, if FIRESTORE_EMULATOR_HOST is set,
+// e.g. by "gcloud emulators firestore start".
+func TestFirestoreStore(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	client, err := firestore.NewClient(context.Background(), "relay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFirestoreStore(client)
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestLogNestDataWritesTypedFields(t *testing.T) {
+	var data nest.Data
+	err := json.Unmarshal([]byte(`{
+		"devices": {"thermostats": {"t1": {"name": "Hall", "ambient_temperature_f": 68, "humidity": "high", "has_fan": false}}},
+		"structures": {"s1": {"name": "Home", "away": "home", "thermostats": ["t1"]}}
+	}`), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryStore()
+	if err := LogNestData(context.Background(), store, KeyForNow(), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := store.GetDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hall := devices["Hall"]
+	if hall["ambient_temperature_f"] != 68.0 || hall["ambient_temperature_c"] != 20.0 {
+		t.Errorf("temperatures weren't written as float64: %v, %v", hall["ambient_temperature_f"], hall["ambient_temperature_c"])
+	}
+	if v, ok := hall["humidity"]; ok {
+		t.Errorf("invalid humidity was written as %v", v)
+	}
+	if v, ok := hall["is_online"]; ok {
+		t.Errorf("missing is_online was written as %v", v)
+	}
+	if v, ok := hall["has_fan"]; !ok || v != false {
+		t.Errorf("has_fan was written as %v, want false", v)
+	}
+	if len(store.GetLog("structure", "Home")) != 1 {
+		t.Errorf("structure Home wasn't logged")
+	}
+}
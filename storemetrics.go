@@ -0,0 +1,196 @@
+package relay
+
+import (
+	"context"
+	"time"
+)
+
+// instrumentedStore is a Store that records how long each call to the
+// underlying store takes, and whether it fails.
+type instrumentedStore struct {
+	name  string
+	store Store
+}
+
+// Returns a store that records metrics for every call to store, labeled
+// with name, e.g. "firestore".
+func InstrumentStore(name string, store Store) Store {
+	return &instrumentedStore{name: name, store: store}
+}
+
+// Records a call to the store that started at start.
+func (s *instrumentedStore) observe(call string, start time.Time, err error) {
+	observeCall(storeCallSeconds, storeCallErrors, s.name, call, start, err)
+}
+
+func (s *instrumentedStore) CreateAuthState(ctx context.Context) (string, error) {
+	called := time.Now()
+	result, err := s.store.CreateAuthState(ctx)
+	s.observe("CreateAuthState", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) UseAuthState(ctx context.Context, state string) error {
+	called := time.Now()
+	err := s.store.UseAuthState(ctx, state)
+	s.observe("UseAuthState", called, err)
+	return err
+}
+
+func (s *instrumentedStore) SaveUser(ctx context.Context, id string, user *User) error {
+	called := time.Now()
+	err := s.store.SaveUser(ctx, id, user)
+	s.observe("SaveUser", called, err)
+	return err
+}
+
+func (s *instrumentedStore) SaveUserThermostat(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	called := time.Now()
+	err := s.store.SaveUserThermostat(ctx, userID, id, data)
+	s.observe("SaveUserThermostat", called, err)
+	return err
+}
+
+func (s *instrumentedStore) SaveUserStructure(ctx context.Context, userID, id string, data map[string]interface{}) error {
+	called := time.Now()
+	err := s.store.SaveUserStructure(ctx, userID, id, data)
+	s.observe("SaveUserStructure", called, err)
+	return err
+}
+
+func (s *instrumentedStore) GetUsers(ctx context.Context) (map[string]*User, error) {
+	called := time.Now()
+	result, err := s.store.GetUsers(ctx)
+	s.observe("GetUsers", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) SaveRegistration(ctx context.Context, id string, reg *Registration) error {
+	called := time.Now()
+	err := s.store.SaveRegistration(ctx, id, reg)
+	s.observe("SaveRegistration", called, err)
+	return err
+}
+
+func (s *instrumentedStore) GetRegistration(ctx context.Context, id string) (*Registration, error) {
+	called := time.Now()
+	result, err := s.store.GetRegistration(ctx, id)
+	s.observe("GetRegistration", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) GetRegistrations(ctx context.Context) (map[string]*Registration, error) {
+	called := time.Now()
+	result, err := s.store.GetRegistrations(ctx)
+	s.observe("GetRegistrations", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) SaveDeviceKey(ctx context.Context, device, id string, key *DeviceKey) error {
+	called := time.Now()
+	err := s.store.SaveDeviceKey(ctx, device, id, key)
+	s.observe("SaveDeviceKey", called, err)
+	return err
+}
+
+func (s *instrumentedStore) GetDeviceKeys(ctx context.Context, device string) (map[string]*DeviceKey, error) {
+	called := time.Now()
+	result, err := s.store.GetDeviceKeys(ctx, device)
+	s.observe("GetDeviceKeys", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) LogDevice(ctx context.Context, name, key string, data map[string]interface{}) error {
+	called := time.Now()
+	err := s.store.LogDevice(ctx, name, key, data)
+	s.observe("LogDevice", called, err)
+	return err
+}
+
+func (s *instrumentedStore) QuarantineReading(ctx context.Context, name, key string, data map[string]interface{}) error {
+	called := time.Now()
+	err := s.store.QuarantineReading(ctx, name, key, data)
+	s.observe("QuarantineReading", called, err)
+	return err
+}
+
+func (s *instrumentedStore) AppendDeviceLog(ctx context.Context, name string, entries map[string]map[string]interface{}, snapshot map[string]interface{}) (map[string]bool, error) {
+	called := time.Now()
+	result, err := s.store.AppendDeviceLog(ctx, name, entries, snapshot)
+	s.observe("AppendDeviceLog", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) QueryDeviceLog(ctx context.Context, name string, q *LogQuery) ([]*LogEntry, error) {
+	called := time.Now()
+	result, err := s.store.QueryDeviceLog(ctx, name, q)
+	s.observe("QueryDeviceLog", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) GetDevices(ctx context.Context) (map[string]map[string]interface{}, error) {
+	called := time.Now()
+	result, err := s.store.GetDevices(ctx)
+	s.observe("GetDevices", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) GetDevice(ctx context.Context, name string) (map[string]interface{}, error) {
+	called := time.Now()
+	result, err := s.store.GetDevice(ctx, name)
+	s.observe("GetDevice", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) UpdateRollup(ctx context.Context, name, resolution string, start time.Time, update func(*RollupPeriod)) error {
+	called := time.Now()
+	err := s.store.UpdateRollup(ctx, name, resolution, start, update)
+	s.observe("UpdateRollup", called, err)
+	return err
+}
+
+func (s *instrumentedStore) QueryRollups(ctx context.Context, name, resolution string, from, to time.Time) ([]*RollupPeriod, error) {
+	called := time.Now()
+	result, err := s.store.QueryRollups(ctx, name, resolution, from, to)
+	s.observe("QueryRollups", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) ListDeviceEntries(ctx context.Context, name, kind, after, before string, limit int) ([]string, error) {
+	called := time.Now()
+	result, err := s.store.ListDeviceEntries(ctx, name, kind, after, before, limit)
+	s.observe("ListDeviceEntries", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) DeleteDeviceEntries(ctx context.Context, name, kind string, keys []string) error {
+	called := time.Now()
+	err := s.store.DeleteDeviceEntries(ctx, name, kind, keys)
+	s.observe("DeleteDeviceEntries", called, err)
+	return err
+}
+
+func (s *instrumentedStore) LogCommand(ctx context.Context, name, key string, data map[string]interface{}) error {
+	called := time.Now()
+	err := s.store.LogCommand(ctx, name, key, data)
+	s.observe("LogCommand", called, err)
+	return err
+}
+
+func (s *instrumentedStore) LogStructure(ctx context.Context, name, key string, data map[string]interface{}) error {
+	called := time.Now()
+	err := s.store.LogStructure(ctx, name, key, data)
+	s.observe("LogStructure", called, err)
+	return err
+}
+
+func (s *instrumentedStore) GetStructures(ctx context.Context) (map[string]map[string]interface{}, error) {
+	called := time.Now()
+	result, err := s.store.GetStructures(ctx)
+	s.observe("GetStructures", called, err)
+	return result, err
+}
+
+func (s *instrumentedStore) Close() error {
+	return s.store.Close()
+}
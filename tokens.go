@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+)
+
+// How long before an access token expires that it gets refreshed.
+const tokenRefreshMargin = 10 * time.Minute
+
+// Marks the user as needing to log in again and saves them. Returns an
+// error describing why, so callers can return it directly.
+func MarkNeedsReauth(ctx context.Context, store Store, id string, user *User, reason string) error {
+	log.Printf("User %s needs to log in again: %s", id, reason)
+	user.NeedsReauth = true
+	user.ReauthReason = reason
+	if err := store.SaveUser(ctx, id, user); err != nil {
+		return err
+	}
+	return common.Errorf(http.StatusForbidden, "user %s needs to log in again: %s", id, reason)
+}
+
+// Returns an access token for the user that won't expire for at least
+// tokenRefreshMargin, refreshing and saving the user's token if needed. If
+// the provider rejects the refresh token, the user is marked as needing to
+// log in again.
+func FreshAccessToken(ctx context.Context, store Store, provider Provider, id string, user *User) (string, error) {
+	if user.NeedsReauth {
+		return "", common.Errorf(http.StatusForbidden, "user %s needs to log in again: %s", id, user.ReauthReason)
+	}
+
+	now := time.Now()
+	if user.RefreshToken == "" {
+		if !user.Expiry.IsZero() && !now.Before(user.Expiry) {
+			return "", MarkNeedsReauth(ctx, store, id, user, "access token expired")
+		}
+		return user.AccessToken, nil
+	}
+
+	// Users saved before expiry was tracked have a zero expiry, so refresh
+	// them once to find out.
+	if !user.Expiry.IsZero() && now.Add(tokenRefreshMargin).Before(user.Expiry) {
+		return user.AccessToken, nil
+	}
+
+	token, err := provider.Refresh(ctx, user.RefreshToken)
+	if err != nil {
+		// Providers report rejected credentials, including an invalid_grant
+		// from the token endpoint, as StatusForbidden. Anything else may be
+		// temporary.
+		if common.Status(err) == http.StatusForbidden {
+			return "", MarkNeedsReauth(ctx, store, id, user, err.Error())
+		}
+		// The provider may just be down, so keep using the old token while
+		// it's still good.
+		if now.Before(user.Expiry) {
+			log.Printf("Unable to refresh token for user %s, using existing token: %s", id, err)
+			return user.AccessToken, nil
+		}
+		return "", err
+	}
+
+	user.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		user.RefreshToken = token.RefreshToken
+	}
+	user.Expiry = token.Expiry
+	if err := store.SaveUser(ctx, id, user); err != nil {
+		return "", err
+	}
+	return user.AccessToken, nil
+}
+
+// Fetches the current data for a user from its provider, refreshing the
+// user's access token first if it's about to expire.
+func FetchNestData(ctx context.Context, store Store, providers map[string]Provider, id string, user *User) (*nest.Data, error) {
+	provider, ok := providers[user.ProviderName()]
+	if !ok {
+		return nil, common.Errorf(http.StatusInternalServerError, "user %s has unknown provider %q", id, user.Provider)
+	}
+
+	accessToken, err := FreshAccessToken(ctx, store, provider, id, user)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := provider.GetData(ctx, accessToken)
+	if err != nil {
+		if common.Status(err) == http.StatusForbidden {
+			return nil, MarkNeedsReauth(ctx, store, id, user, err.Error())
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bklimt/relay/common"
+	"github.com/bklimt/relay/nest"
+)
+
+// refreshProvider is a Provider whose Refresh returns err, or else a new
+// token.
+type refreshProvider struct {
+	err error
+}
+
+func (p *refreshProvider) AuthorizationURL(state string) string { return "" }
+
+func (p *refreshProvider) Exchange(ctx context.Context, code string) (*Token, error) {
+	return nil, p.err
+}
+
+func (p *refreshProvider) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Token{AccessToken: "new", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func (p *refreshProvider) GetData(ctx context.Context, accessToken string) (*nest.Data, error) {
+	return &nest.Data{}, nil
+}
+
+func (p *refreshProvider) SetThermostat(ctx context.Context, accessToken string, therm *nest.Thermostat, cmd *ThermostatCommand) error {
+	return nil
+}
+
+func TestFreshAccessTokenRefreshes(t *testing.T) {
+	store := NewMemoryStore()
+	user := &User{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(time.Minute)}
+
+	token, err := FreshAccessToken(context.Background(), store, &refreshProvider{}, "user1", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "new" {
+		t.Errorf("token is %q, want new", token)
+	}
+	users, _ := store.GetUsers(context.Background())
+	if users["user1"] == nil || users["user1"].AccessToken != "new" {
+		t.Errorf("refreshed token wasn't saved: %v", users["user1"])
+	}
+}
+
+func TestFreshAccessTokenReauth(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int // The status the token endpoint returned.
+		body   string
+		reauth bool
+	}{
+		{"unauthorized", http.StatusUnauthorized, "", true},
+		{"forbidden", http.StatusForbidden, "", true},
+		{"invalid grant", http.StatusBadRequest, `{"error": "invalid_grant"}`, true},
+		{"bad request", http.StatusBadRequest, `{"error": "invalid_request"}`, false},
+		{"unavailable", http.StatusServiceUnavailable, "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			user := &User{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(time.Minute)}
+			provider := &refreshProvider{
+				err: common.Errorf(common.TokenStatus(c.status, []byte(c.body)), "unable to get token"),
+			}
+
+			token, err := FreshAccessToken(context.Background(), store, provider, "user1", user)
+			if user.NeedsReauth != c.reauth {
+				t.Errorf("NeedsReauth is %v, want %v", user.NeedsReauth, c.reauth)
+			}
+			if c.reauth {
+				if err == nil {
+					t.Errorf("got token %q for a user who needs to log in again", token)
+				}
+				return
+			}
+			// The old token is still good, so it's used until it expires.
+			if err != nil || token != "old" {
+				t.Errorf("got %q, %v, want the old token", token, err)
+			}
+		})
+	}
+}